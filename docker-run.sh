@@ -1,3 +1,4 @@
 #!/usr/bin/env bash
 
-docker run --env-file ./.env --rm -it -p 8090:8090 tugayac/ct_api
+# Jobs are kept in a named volume, so they survive the container being replaced
+docker run --env-file ./.env --rm -it -p 8090:8090 -v clustertruck-jobs:/var/lib/clustertruck/jobs tugayac/ct_api
@@ -6,10 +6,28 @@ import (
 	"io/ioutil"
 	"os"
 	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"strings"
+	"log"
+	"net/url"
 )
 
-func SetupAPI(httpClient HttpClient) *http.ServeMux {
+// The endpoints of the server, along with the services behind them
+type API struct {
+	*http.ServeMux
+	driveTimeService *DriveTimeService
+	jobManager       *JobManager
+}
+
+// Sets up the endpoints without touching the jobs directory or scheduling kitchen refreshes, so nothing runs in
+// the background until Start is called
+func SetupAPI(httpClient HttpClient, config Config) *API {
 	httpMux := http.NewServeMux()
+	driveTimeService := NewDriveTimeService(httpClient, config)
+	jobManager := NewJobManager(driveTimeService, NewJobStore(config.JobsDir), config.JobsConcurrency,
+		config.RequestTimeout, config.JobsRetention)
 
 	driveTimeEndpoint := http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
 		if request.Method == "POST" {
@@ -26,10 +44,20 @@ func SetupAPI(httpClient HttpClient) *http.ServeMux {
 				return
 			}
 
+			err = requestPayload.validate()
+			if err != nil {
+				requestPayloadIsInvalidError(response, err, requestPayload)
+				return
+			}
+
+			ctx, cancel := contextWithTimeout(request.Context(), config.RequestTimeout)
+			defer cancel()
+
 			closestClusterTruckInfo, err :=
-				findDriveTimeToClosestClusterTruckKitchen(httpClient, requestPayload.StartingAddress)
+				driveTimeService.findDriveTimeToClosestClusterTruckKitchen(ctx, requestPayload)
 			if err != nil {
 				errorWhileSearchingForDriveTime(response, err)
+				return
 			}
 
 			responseBody, err := json.Marshal(closestClusterTruckInfo)
@@ -43,9 +71,237 @@ func SetupAPI(httpClient HttpClient) *http.ServeMux {
 		}
 	})
 
+	// Same as the drive time endpoint, but sends Server-Sent Events as the directions to each kitchen arrive,
+	// followed by the result
+	streamEndpoint := http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method == "GET" {
+			requestPayload, err := requestPayloadFromQuery(request.URL.Query())
+			if err != nil {
+				queryParametersAreInvalidError(response, err)
+				return
+			}
+
+			err = requestPayload.validate()
+			if err != nil {
+				requestPayloadIsInvalidError(response, err, requestPayload)
+				return
+			}
+
+			ctx, cancel := contextWithTimeout(request.Context(), config.RequestTimeout)
+			defer cancel()
+
+			response.Header().Set("Content-Type", "text/event-stream")
+			response.Header().Set("Cache-Control", "no-cache")
+			response.WriteHeader(http.StatusOK)
+			closestClusterTruckInfo, err := driveTimeService.streamDriveTimeToClosestClusterTruckKitchen(ctx,
+				requestPayload, func(progress DriveTimeProgress) {
+					writeEvent(response, streamEventProgress, progress)
+				})
+			if err != nil {
+				statusCode, httpError := driveTimeSearchError(err)
+				writeEvent(response, streamEventError, StreamError{Status: statusCode, HTTPError: httpError})
+				return
+			}
+
+			writeEvent(response, streamEventResult, closestClusterTruckInfo)
+		}
+	})
+
+	// Finds the drive time for many addresses, and streams the results as newline delimited JSON as they are found
+	batchEndpoint := http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method == "POST" {
+			body, err := ioutil.ReadAll(request.Body)
+			if err != nil {
+				requestBodyCouldNotBeReadError(response, err, request)
+				return
+			}
+
+			items, err := parseBatchBody(body, config.BatchMaxItems)
+			if err != nil {
+				batchIsInvalidError(response, err)
+				return
+			}
+
+			response.Header().Set("Content-Type", "application/x-ndjson")
+			response.WriteHeader(http.StatusOK)
+			flusher, _ := response.(http.Flusher)
+			var responseMutex sync.Mutex
+			driveTimeService.findDriveTimesForBatch(request.Context(), items, config.BatchConcurrency,
+				config.RequestTimeout, func(result BatchResult) {
+					line, err := json.Marshal(result)
+					if err != nil {
+						_, httpError := driveTimeSearchError(err)
+						line, _ = json.Marshal(BatchResult{
+							Index:  result.Index,
+							ID:     result.ID,
+							Status: http.StatusInternalServerError,
+							Error:  httpError,
+						})
+					}
+
+					responseMutex.Lock()
+					defer responseMutex.Unlock()
+					response.Write(append(line, '\n'))
+					if flusher != nil {
+						flusher.Flush()
+					}
+				})
+		}
+	})
+
+	// Creates a job that looks up the drive times of a batch in the background
+	jobsEndpoint := http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method == "POST" {
+			body, err := ioutil.ReadAll(request.Body)
+			if err != nil {
+				requestBodyCouldNotBeReadError(response, err, request)
+				return
+			}
+
+			items, err := parseBatchBody(body, config.JobsMaxItems)
+			if err != nil {
+				batchIsInvalidError(response, err)
+				return
+			}
+
+			job, err := jobManager.Create(items)
+			if err != nil {
+				jobError(response, err)
+				return
+			}
+
+			response.Header().Set("Location", "/api/jobs/"+job.ID)
+			writeJSON(response, http.StatusAccepted, job)
+		}
+	})
+
+	// Handles "/api/jobs/{id}", "/api/jobs/{id}/results" and "/api/jobs/{id}/cancel"
+	jobEndpoint := http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		path := strings.Split(strings.TrimPrefix(request.URL.Path, "/api/jobs/"), "/")
+		id := path[0]
+		action := ""
+		if len(path) > 1 {
+			action = strings.Join(path[1:], "/")
+		}
+
+		allowedMethod := map[string]string{"": "GET", "results": "GET", "cancel": "POST"}[action]
+		if allowedMethod == "" {
+			jobError(response, newAPIError(ErrorCodeJobNotFound, fmt.Sprintf("there is no job with ID \"%s\"", id)))
+			return
+		}
+		if request.Method != allowedMethod {
+			response.Header().Set("Allow", allowedMethod)
+			jobError(response, newAPIError(ErrorCodeMethodNotAllowed,
+				fmt.Sprintf("%s is not supported, only %s is", request.Method, allowedMethod)))
+			return
+		}
+
+		switch action {
+		case "":
+			job, err := jobManager.Get(id)
+			if err != nil {
+				jobError(response, err)
+				return
+			}
+			writeJSON(response, http.StatusOK, job)
+		case "results":
+			offset, limit, err := parsePage(request.URL.Query())
+			if err != nil {
+				jobError(response, err)
+				return
+			}
+
+			page, err := jobManager.Results(id, offset, limit)
+			if err != nil {
+				jobError(response, err)
+				return
+			}
+			writeJSON(response, http.StatusOK, page)
+		case "cancel":
+			job, err := jobManager.Cancel(id)
+			if err != nil {
+				jobError(response, err)
+				return
+			}
+			writeJSON(response, http.StatusOK, job)
+		}
+	})
+
+	metricsEndpoint := http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method == "GET" {
+			responseBody, err := json.Marshal(driveTimeService.Metrics())
+			if err != nil {
+				metricsCouldNotBeReturnedError(response, err)
+				return
+			}
+
+			response.Header().Set("Content-Type", "application/json")
+			response.WriteHeader(http.StatusOK)
+			response.Write(responseBody)
+		}
+	})
+
+	// Doesn't need an access key, so load balancers can call it. The status is always 200, since the service
+	// can still answer from cached data while it's degraded
+	healthEndpoint := http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method == "GET" {
+			writeJSON(response, http.StatusOK, driveTimeService.Health())
+		}
+	})
+
+	// Removes cached directions, either every entry, or only those of the starting point ("address", "location" or
+	// "place_id") and "kitchen_id" query parameters
+	directionsCacheEndpoint := http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method == "DELETE" {
+			query := request.URL.Query()
+			requestPayload, err := requestPayloadFromQuery(query)
+			if err == nil && (requestPayload.StartingAddress != "" || requestPayload.Location != nil ||
+				requestPayload.PlaceID != "") {
+				err = requestPayload.validateStartingPoint()
+			}
+			if err != nil {
+				queryParametersAreInvalidError(response, err)
+				return
+			}
+
+			origin := Waypoint{
+				Address:     requestPayload.StartingAddress,
+				PlaceID:     requestPayload.PlaceID,
+				Coordinates: requestPayload.coordinates(),
+			}
+			purged := driveTimeService.PurgeDirectionsCache(origin, query.Get("kitchen_id"))
+
+			responseBody, _ := json.Marshal(map[string]int{"purged": purged})
+			response.Header().Set("Content-Type", "application/json")
+			response.WriteHeader(http.StatusOK)
+			response.Write(responseBody)
+		}
+	})
+
 	httpMux.Handle("/api/drive-time", verifyAccessKeyMiddleware(driveTimeEndpoint))
+	httpMux.Handle("/api/drive-time/stream", accessKeyFromQueryMiddleware(verifyAccessKeyMiddleware(streamEndpoint)))
+	httpMux.Handle("/api/drive-time/batch", verifyAccessKeyMiddleware(batchEndpoint))
+	httpMux.Handle("/api/jobs", verifyAccessKeyMiddleware(jobsEndpoint))
+	httpMux.Handle("/api/jobs/", verifyAccessKeyMiddleware(jobEndpoint))
+	httpMux.Handle("/api/metrics", verifyAccessKeyMiddleware(metricsEndpoint))
+	httpMux.Handle("/api/health", healthEndpoint)
+	httpMux.Handle("/api/admin/directions-cache", verifyAdminAccessKeyMiddleware(directionsCacheEndpoint))
+
+	return &API{
+		ServeMux:         httpMux,
+		driveTimeService: driveTimeService,
+		jobManager:       jobManager,
+	}
+}
 
-	return httpMux
+// Starts refreshing the kitchens, and resumes the jobs that were running when the server stopped. Only the server
+// calls it, once, before serving.
+func (a *API) Start() {
+	a.driveTimeService.StartRefreshingKitchens()
+	err := a.jobManager.Resume()
+	if err != nil {
+		log.Printf("Some jobs could not be resumed: %s\n", err.Error())
+	}
 }
 
 func verifyAccessKeyMiddleware(next http.Handler) http.Handler {
@@ -61,9 +317,56 @@ func verifyAccessKeyMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// Browsers can't send headers with Server-Sent Events, so the access key can be given in the "access_key"
+// query parameter instead. The parameter is removed from the URL once it's moved to the header, so the key
+// doesn't end up in anything that logs the URL of the request.
+func accessKeyFromQueryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		query := request.URL.Query()
+		accessKey := query.Get("access_key")
+		if accessKey != "" && request.Header.Get("Access-Key") == "" {
+			request.Header.Set("Access-Key", accessKey)
+		}
+
+		if _, found := query["access_key"]; found {
+			query.Del("access_key")
+			strippedUrl := *request.URL
+			strippedUrl.RawQuery = query.Encode()
+			request = request.WithContext(request.Context())
+			request.URL = &strippedUrl
+			request.RequestURI = strippedUrl.RequestURI()
+		}
+
+		next.ServeHTTP(response, request)
+	})
+}
+
+// Admin endpoints use a separate key. They are disabled when no admin key is set.
+func verifyAdminAccessKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		adminAccessKey := os.Getenv("CT_ADMIN_ACCESS_KEY")
+		userAdminAccessKey := request.Header.Get("Admin-Access-Key")
+		if adminAccessKey == "" || userAdminAccessKey != adminAccessKey {
+			adminUnauthorizedError(response)
+			return
+		}
+
+		next.ServeHTTP(response, request)
+	})
+}
+
+func adminUnauthorizedError(response http.ResponseWriter) {
+	response.WriteHeader(http.StatusUnauthorized)
+	response.Write(marshalError(&HTTPError{
+		Code:    ErrorCodeUnauthorized,
+		Message: "Your Admin Access Key could not be verified. Please check your Admin Access Key and try again.",
+	}))
+}
+
 func unauthorizedError(response http.ResponseWriter, request *http.Request) {
 	response.WriteHeader(http.StatusUnauthorized)
 	response.Write(marshalError(&HTTPError{
+		Code:    ErrorCodeUnauthorized,
 		Message: "Your Access Key could not be verified. Please check your Access Key and try again.",
 		Parameters: map[string]interface{}{
 			"access_key": request.Header.Get("Access-Key"),
@@ -74,6 +377,7 @@ func unauthorizedError(response http.ResponseWriter, request *http.Request) {
 func resultsCouldNotBeReturnedError(response http.ResponseWriter, err error, closestClusterTruckInfo *ClosestClusterTruck) {
 	response.WriteHeader(http.StatusInternalServerError)
 	response.Write(marshalError(&HTTPError{
+		Code: ErrorCodeInternal,
 		Message: fmt.Sprintf("There was a problem with returning you the results: %s",
 			err.Error()),
 		Parameters: map[string]interface{}{
@@ -82,9 +386,26 @@ func resultsCouldNotBeReturnedError(response http.ResponseWriter, err error, clo
 	}))
 }
 
+func responseCouldNotBeReturnedError(response http.ResponseWriter, err error) {
+	response.WriteHeader(http.StatusInternalServerError)
+	response.Write(marshalError(&HTTPError{
+		Code:    ErrorCodeInternal,
+		Message: fmt.Sprintf("There was a problem with returning you the response: %s", err.Error()),
+	}))
+}
+
+func metricsCouldNotBeReturnedError(response http.ResponseWriter, err error) {
+	response.WriteHeader(http.StatusInternalServerError)
+	response.Write(marshalError(&HTTPError{
+		Code:    ErrorCodeInternal,
+		Message: fmt.Sprintf("There was a problem with returning you the metrics: %s", err.Error()),
+	}))
+}
+
 func requestBodyCouldNotBeDeserializedError(response http.ResponseWriter, err error, request *http.Request) {
 	response.WriteHeader(http.StatusBadRequest)
 	response.Write(marshalError(&HTTPError{
+		Code: ErrorCodeInvalidRequest,
 		Message: fmt.Sprintf("The request body you provided could not be deserialized: %s",
 			err.Error()),
 		Parameters: map[string]interface{}{
@@ -93,9 +414,50 @@ func requestBodyCouldNotBeDeserializedError(response http.ResponseWriter, err er
 	}))
 }
 
+func requestPayloadIsInvalidError(response http.ResponseWriter, err error, requestPayload RequestPayload) {
+	response.WriteHeader(http.StatusBadRequest)
+	response.Write(marshalError(&HTTPError{
+		Code:    ErrorCodeInvalidRequest,
+		Message: fmt.Sprintf("The request body you provided is invalid: %s", err.Error()),
+		Parameters: map[string]interface{}{
+			"body": requestPayload,
+		},
+	}))
+}
+
+func jobError(response http.ResponseWriter, err error) {
+	statusCode := http.StatusInternalServerError
+	if apiError, ok := err.(*APIError); ok {
+		statusCode = apiError.StatusCode()
+	}
+
+	response.WriteHeader(statusCode)
+	response.Write(marshalError(&HTTPError{
+		Code:    errorCode(err),
+		Message: fmt.Sprintf("An error occurred with the job: %s", err.Error()),
+	}))
+}
+
+func queryParametersAreInvalidError(response http.ResponseWriter, err error) {
+	response.WriteHeader(http.StatusBadRequest)
+	response.Write(marshalError(&HTTPError{
+		Code:    ErrorCodeInvalidRequest,
+		Message: fmt.Sprintf("The query parameters you provided are invalid: %s", err.Error()),
+	}))
+}
+
+func batchIsInvalidError(response http.ResponseWriter, err error) {
+	response.WriteHeader(http.StatusBadRequest)
+	response.Write(marshalError(&HTTPError{
+		Code:    ErrorCodeInvalidRequest,
+		Message: fmt.Sprintf("The batch you provided is invalid: %s", err.Error()),
+	}))
+}
+
 func requestBodyCouldNotBeReadError(response http.ResponseWriter, err error, request *http.Request) {
 	response.WriteHeader(http.StatusBadRequest)
 	response.Write(marshalError(&HTTPError{
+		Code: ErrorCodeInvalidRequest,
 		Message: fmt.Sprintf("The request body you provided could not be read: %s",
 			err.Error()),
 		Parameters: map[string]interface{}{
@@ -105,9 +467,70 @@ func requestBodyCouldNotBeReadError(response http.ResponseWriter, err error, req
 }
 
 func errorWhileSearchingForDriveTime(response http.ResponseWriter, err error) {
-	response.WriteHeader(http.StatusBadRequest)
-	response.Write(marshalError(&HTTPError{
+	if apiError, ok := err.(*APIError); ok && apiError.RetryAfter > 0 {
+		retryAfterSeconds := int(math.Ceil(apiError.RetryAfter.Seconds()))
+		response.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+	}
+
+	statusCode, httpError := driveTimeSearchError(err)
+	response.WriteHeader(statusCode)
+	response.Write(marshalError(httpError))
+}
+
+// The status depends on the code of the error. Errors without a code are treated as internal errors.
+func driveTimeSearchError(err error) (int, *HTTPError) {
+	statusCode := http.StatusInternalServerError
+	var parameters map[string]interface{}
+	if apiError, ok := err.(*APIError); ok {
+		statusCode = apiError.StatusCode()
+		parameters = make(map[string]interface{})
+		for name, value := range apiError.Parameters {
+			parameters[name] = value
+		}
+		if apiError.Upstream != "" {
+			parameters["upstream"] = apiError.Upstream
+			parameters["upstream_status"] = apiError.UpstreamStatus
+		}
+	}
+
+	return statusCode, &HTTPError{
+		Code: errorCode(err),
 		Message: fmt.Sprintf("An error occurred while searching for drive time: %s",
-			err.Error()),
-	}))
+			publicErrorMessage(err)),
+		Parameters: parameters,
+	}
+}
+
+func writeJSON(response http.ResponseWriter, statusCode int, value interface{}) {
+	responseBody, err := json.Marshal(value)
+	if err != nil {
+		responseCouldNotBeReturnedError(response, err)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(statusCode)
+	response.Write(responseBody)
+}
+
+// Reads the "offset" and "limit" query parameters of a page of results
+func parsePage(query url.Values) (int, int, error) {
+	offset, limit := 0, defaultPageLimit
+	var err error
+	if value := query.Get("offset"); value != "" {
+		offset, err = strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			return 0, 0, newAPIError(ErrorCodeInvalidRequest,
+				fmt.Sprintf("offset must be a positive whole number, but was \"%s\"", value))
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return 0, 0, newAPIError(ErrorCodeInvalidRequest,
+				fmt.Sprintf("limit must be between 1 and %d, but was \"%s\"", maxPageLimit, value))
+		}
+	}
+
+	return offset, limit, nil
 }
@@ -8,6 +8,8 @@ import (
 	"io/ioutil"
 	"encoding/json"
 	"strings"
+	"errors"
+	"net/url"
 )
 
 func TestAPIWithInvalidAccessKey(t *testing.T) {
@@ -24,7 +26,7 @@ func TestAPIWithInvalidAccessKey(t *testing.T) {
 		},
 	}
 
-	api := SetupAPI(client)
+	api := SetupAPI(client, DefaultConfig())
 	recorder := httptest.NewRecorder()
 
 	request := httptest.NewRequest("POST", "/api/drive-time",
@@ -57,7 +59,7 @@ func TestAPIWithValidAccessKey(t *testing.T) {
 		},
 	}
 
-	api := SetupAPI(client)
+	api := SetupAPI(client, DefaultConfig())
 	recorder := httptest.NewRecorder()
 
 	request := httptest.NewRequest("POST", "/api/drive-time",
@@ -68,3 +70,109 @@ func TestAPIWithValidAccessKey(t *testing.T) {
 
 	assertResult(t, http.StatusOK, recorder.Code)
 }
+
+func TestAPIReturnsErrorCodeWhenNoRoutesAreFound(t *testing.T) {
+	mockGmapsResponseData := readMockFile("directions_response_no_route.json")
+	mockKitchenResponse := readMockFile("kitchen_response.json")
+
+	client := &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			if strings.Contains(req.URL.String(), "kitchens") {
+				return createHttpResponseForTest(http.StatusOK, bytes.NewBuffer(mockKitchenResponse)), nil
+			} else {
+				return createHttpResponseForTest(http.StatusOK, bytes.NewBuffer(mockGmapsResponseData)), nil
+			}
+		},
+	}
+
+	api := SetupAPI(client, DefaultConfig())
+	recorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest("POST", "/api/drive-time",
+		noopCloser{bytes.NewBufferString(`{"address": "Martinsville, IN"}`)})
+	request.Header.Add("Access-Key", "JVvlYlqTBwhs2yu8")
+
+	api.ServeHTTP(recorder, request)
+
+	assertResult(t, http.StatusNotFound, recorder.Code)
+
+	// Only the error should be written, without a response body after it
+	result, _ := ioutil.ReadAll(recorder.Result().Body)
+	var response HTTPError
+	err := json.Unmarshal(result, &response)
+	assertResult(t, nil, err)
+	assertResult(t, ErrorCodeNoRoute, response.Code)
+	assertResult(t, "An error occurred while searching for drive time: no routes were found from your "+
+		"starting address", response.Message)
+}
+
+func TestAPIReturnsServiceUnavailableWhenKitchensCannotBeFetched(t *testing.T) {
+	client := &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			return createHttpResponseForTest(http.StatusInternalServerError, bytes.NewBufferString("")), nil
+		},
+	}
+
+	api := SetupAPI(client, DefaultConfig())
+	recorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest("POST", "/api/drive-time",
+		noopCloser{bytes.NewBufferString(`{"address": "Martinsville, IN"}`)})
+	request.Header.Add("Access-Key", "JVvlYlqTBwhs2yu8")
+
+	api.ServeHTTP(recorder, request)
+
+	assertResult(t, http.StatusServiceUnavailable, recorder.Code)
+
+	result, _ := ioutil.ReadAll(recorder.Result().Body)
+	var response HTTPError
+	json.Unmarshal(result, &response)
+	assertResult(t, ErrorCodeUpstreamUnavailable, response.Code)
+	assertResult(t, "ClusterTruck Kitchens API", response.Parameters["upstream"].(string))
+	assertResult(t, "500", response.Parameters["upstream_status"].(string))
+}
+
+func TestAPIDoesNotReturnGoogleMapsAPIKeyWhenRequestsFail(t *testing.T) {
+	mockKitchenResponse := readMockFile("kitchen_response.json")
+	mockGmapsResponseData := readMockFile("directions_response_multiple_routes_simplified_1.json")
+	client := &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			if strings.Contains(req.URL.String(), "kitchens") {
+				return createHttpResponseForTest(http.StatusOK, bytes.NewBuffer(mockKitchenResponse)), nil
+			} else if strings.Contains(req.URL.String(), "Indianapolis") {
+				return createHttpResponseForTest(http.StatusOK, bytes.NewBuffer(mockGmapsResponseData)), nil
+			}
+			// The error of an HTTP client has the URL of the request, which has the API key
+			return nil, &url.Error{Op: "Get", URL: req.URL.String(), Err: errors.New("connection refused")}
+		},
+	}
+	config := DefaultConfig()
+	config.KitchenEligibility = EligibilityIncludeAll
+	config.GoogleMapsAPIKey = "secret-gmaps-key"
+	// The failures are kept in the excluded kitchens, rather than turned into circuit breaker errors
+	config.CircuitBreaker.FailureThreshold = 0
+	api := SetupAPI(client, config)
+	recorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest("POST", "/api/drive-time",
+		noopCloser{bytes.NewBufferString(`{"address": "Martinsville, IN", "explain": true}`)})
+	request.Header.Add("Access-Key", "JVvlYlqTBwhs2yu8")
+
+	api.ServeHTTP(recorder, request)
+
+	assertResult(t, http.StatusOK, recorder.Code)
+	var response ClosestClusterTruck
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	assertResult(t, true, len(response.ExcludedKitchens) > 0)
+	for _, excludedKitchen := range response.ExcludedKitchens {
+		assertResult(t, ErrorCodeUpstreamBadResponse, excludedKitchen.Error.Code)
+		assertResult(t, "There was an error performing a request to the GMaps Directions API: connection refused",
+			excludedKitchen.Error.Message)
+	}
+	for _, explanation := range response.Explanation {
+		if explanation.Outcome == explanationOutcomeExcluded {
+			assertResult(t, ErrorCodeUpstreamBadResponse, explanation.Error.Code)
+		}
+	}
+	assertResult(t, false, strings.Contains(recorder.Body.String(), "secret-gmaps-key"))
+}
@@ -0,0 +1,146 @@
+package clustertruck
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// One address of a batch request. Either a string with the address, or an object with the same properties
+// as a single request, and an optional ID.
+type BatchItem struct {
+	// Returned with the result, so it can be matched with the item. Optional
+	ID string `json:"id"`
+	RequestPayload
+}
+
+// The result of one item of a batch request. Results are returned in the order they complete,
+// so they are matched with items by their index or ID.
+type BatchResult struct {
+	// Position of the item in the batch, starting at 0
+	Index int    `json:"index"`
+	ID    string `json:"id,omitempty"`
+	// HTTP status a single request for the item would have returned
+	Status int `json:"status"`
+	// Only set if the drive time was found
+	Result *ClosestClusterTruck `json:"result,omitempty"`
+	// Only set if there is an error
+	Error *HTTPError `json:"error,omitempty"`
+}
+
+func (i *BatchItem) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("\"")) {
+		return json.Unmarshal(data, &i.StartingAddress)
+	}
+
+	// Unmarshaling into a type without this method avoids calling it again
+	type batchItem BatchItem
+	return json.Unmarshal(data, (*batchItem)(i))
+}
+
+// Splits the body of a batch request into items. The body is either a JSON array, or newline delimited JSON
+// with one item per line. Items are returned unparsed, so an invalid item doesn't fail the whole batch.
+func parseBatchBody(body []byte, maxItems int) ([]json.RawMessage, error) {
+	var items []json.RawMessage
+	body = bytes.TrimSpace(body)
+	if bytes.HasPrefix(body, []byte("[")) {
+		err := json.Unmarshal(body, &items)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("the batch is not a valid JSON array: %s", err.Error()))
+		}
+	} else {
+		for i, line := range bytes.Split(body, []byte("\n")) {
+			line = bytes.TrimSpace(line)
+			if len(line) == 0 {
+				continue
+			}
+			if !json.Valid(line) {
+				return nil, errors.New(fmt.Sprintf("line %d of the batch is not valid JSON", i+1))
+			}
+			items = append(items, json.RawMessage(line))
+		}
+	}
+
+	if len(items) == 0 {
+		return nil, errors.New("the batch is empty")
+	}
+	if maxItems > 0 && len(items) > maxItems {
+		return nil, errors.New(fmt.Sprintf("the batch has %d items, but at most %d are allowed", len(items),
+			maxItems))
+	}
+
+	return items, nil
+}
+
+// Finds the drive time for every item of a batch, with at most concurrency items at once, and sends each
+// result to the output function as soon as it's found. Each item has its own timeout, and all of them share
+// the caches and the directions worker pool of the service, the same way single requests do.
+func (s *DriveTimeService) findDriveTimesForBatch(ctx context.Context, items []json.RawMessage, concurrency int,
+	timeout time.Duration, output func(BatchResult)) {
+
+	var waitGroup sync.WaitGroup
+	semaphore := make(chan struct{}, concurrency)
+	for index, item := range items {
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+			// The user stopped waiting, so the remaining items are not looked up
+			waitGroup.Wait()
+			return
+		}
+
+		waitGroup.Add(1)
+		go func(index int, item json.RawMessage) {
+			defer waitGroup.Done()
+			defer func() { <-semaphore }()
+
+			output(s.findDriveTimeForBatchItem(ctx, index, item, timeout))
+		}(index, item)
+	}
+
+	waitGroup.Wait()
+}
+
+func (s *DriveTimeService) findDriveTimeForBatchItem(ctx context.Context, index int, item json.RawMessage,
+	timeout time.Duration) BatchResult {
+
+	var batchItem BatchItem
+	err := json.Unmarshal(item, &batchItem)
+	if err != nil {
+		return invalidBatchItemResult(index, "", fmt.Sprintf("The item could not be deserialized: %s",
+			err.Error()))
+	}
+
+	err = batchItem.validate()
+	if err != nil {
+		return invalidBatchItemResult(index, batchItem.ID, fmt.Sprintf("The item is invalid: %s", err.Error()))
+	}
+
+	ctx, cancel := contextWithTimeout(ctx, timeout)
+	defer cancel()
+
+	closestClusterTruck, err := s.findDriveTimeToClosestClusterTruckKitchen(ctx, batchItem.RequestPayload)
+	if err != nil {
+		statusCode, httpError := driveTimeSearchError(err)
+		return BatchResult{Index: index, ID: batchItem.ID, Status: statusCode, Error: httpError}
+	}
+
+	return BatchResult{Index: index, ID: batchItem.ID, Status: http.StatusOK, Result: closestClusterTruck}
+}
+
+func invalidBatchItemResult(index int, id string, message string) BatchResult {
+	return BatchResult{
+		Index:  index,
+		ID:     id,
+		Status: http.StatusBadRequest,
+		Error: &HTTPError{
+			Code:    ErrorCodeInvalidRequest,
+			Message: message,
+		},
+	}
+}
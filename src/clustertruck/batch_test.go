@@ -0,0 +1,99 @@
+package clustertruck
+
+import (
+	"testing"
+	"net/http"
+	"net/http/httptest"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sort"
+	"sync/atomic"
+)
+
+func TestParseBatchBody(t *testing.T) {
+	items, err := parseBatchBody([]byte(`["a", {"address": "b"}]`), 10)
+	assertResult(t, nil, err)
+	assertResult(t, 2, len(items))
+
+	items, err = parseBatchBody([]byte("{\"address\": \"a\"}\n\n\"b\"\n"), 10)
+	assertResult(t, nil, err)
+	assertResult(t, 2, len(items))
+	assertResult(t, `"b"`, string(items[1]))
+
+	_, err = parseBatchBody([]byte("{\"address\": \"a\"}\n{\"address\""), 10)
+	assertResult(t, "line 2 of the batch is not valid JSON", err.Error())
+
+	_, err = parseBatchBody([]byte(" "), 10)
+	assertResult(t, "the batch is empty", err.Error())
+
+	_, err = parseBatchBody([]byte(`["a", "b", "c"]`), 2)
+	assertResult(t, "the batch has 3 items, but at most 2 are allowed", err.Error())
+}
+
+func TestUnmarshalBatchItem(t *testing.T) {
+	var item BatchItem
+	json.Unmarshal([]byte(`"123 Main St"`), &item)
+	assertResult(t, "123 Main St", item.StartingAddress)
+
+	item = BatchItem{}
+	json.Unmarshal([]byte(`{"id": "customer-1", "address": "123 Main St", "limit": 2}`), &item)
+	assertResult(t, "customer-1", item.ID)
+	assertResult(t, "123 Main St", item.StartingAddress)
+	assertResult(t, 2, item.Limit)
+}
+
+func TestAPIStreamsBatchResults(t *testing.T) {
+	var directionsCalls int32
+	config := DefaultConfig()
+	config.KitchenEligibility = EligibilityIncludeAll
+	api := SetupAPI(createCountingClientWithRoutesToEveryKitchen(&directionsCalls), config)
+	recorder := httptest.NewRecorder()
+
+	body := "{\"id\": \"customer-1\", \"address\": \"Martinsville, IN\"}\n" +
+		"\"martinsville, in\"\n" +
+		"{\"id\": \"customer-3\", \"address\": \"Martinsville, IN\", \"ranking\": \"fastest\"}\n"
+	request := httptest.NewRequest("POST", "/api/drive-time/batch", noopCloser{bytes.NewBufferString(body)})
+	request.Header.Add("Access-Key", "JVvlYlqTBwhs2yu8")
+
+	api.ServeHTTP(recorder, request)
+
+	assertResult(t, http.StatusOK, recorder.Code)
+	assertResult(t, "application/x-ndjson", recorder.Header().Get("Content-Type"))
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	assertResult(t, 3, len(lines))
+
+	results := make([]BatchResult, len(lines))
+	for i, line := range lines {
+		json.Unmarshal([]byte(line), &results[i])
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Index < results[j].Index
+	})
+
+	assertResult(t, "customer-1", results[0].ID)
+	assertResult(t, http.StatusOK, results[0].Status)
+	assertResult(t, "Downtown Columbus", results[0].Result.LocationName)
+	assertResult(t, http.StatusOK, results[1].Status)
+	assertResult(t, "martinsville, in", results[1].Result.StartAddress)
+	assertResult(t, "customer-3", results[2].ID)
+	assertResult(t, http.StatusBadRequest, results[2].Status)
+	assertResult(t, ErrorCodeInvalidRequest, results[2].Error.Code)
+
+	// Both addresses share the same directions calls, through the directions cache or a shared lookup
+	assertResult(t, int32(6), atomic.LoadInt32(&directionsCalls))
+}
+
+func TestAPIRejectsInvalidBatch(t *testing.T) {
+	api := SetupAPI(createClientWithRoutesToEveryKitchen(), DefaultConfig())
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/api/drive-time/batch", noopCloser{bytes.NewBufferString("[")})
+	request.Header.Add("Access-Key", "JVvlYlqTBwhs2yu8")
+
+	api.ServeHTTP(recorder, request)
+
+	assertResult(t, http.StatusBadRequest, recorder.Code)
+	var response HTTPError
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	assertResult(t, ErrorCodeInvalidRequest, response.Code)
+}
@@ -0,0 +1,252 @@
+package clustertruck
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States of a circuit breaker
+const (
+	// Requests are sent to the upstream API
+	circuitBreakerClosed = "closed"
+	// Requests fail right away, without being sent
+	circuitBreakerOpen = "open"
+	// A single trial request is sent at a time, to find out whether the upstream API has recovered
+	circuitBreakerHalfOpen = "half_open"
+)
+
+// Decides when the circuit breaker of an upstream API opens, and when it closes again
+type CircuitBreakerPolicy struct {
+	// Number of failed requests in a row that opens the breaker. 0 turns circuit breakers off
+	FailureThreshold int
+	// How long the breaker stays open before a trial request is let through
+	OpenTimeout time.Duration
+	// Number of trial requests in a row that must succeed to close the breaker again
+	HalfOpenSuccesses int
+}
+
+func DefaultCircuitBreakerPolicy() CircuitBreakerPolicy {
+	return CircuitBreakerPolicy{
+		FailureThreshold:  5,
+		OpenTimeout:       30 * time.Second,
+		HalfOpenSuccesses: 1,
+	}
+}
+
+// Returned instead of sending a request while the breaker of its upstream API is open
+type CircuitOpenError struct {
+	Upstream string
+	// When the next trial request will be let through
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("the circuit breaker of the %s is open after repeated failures", e.Upstream)
+}
+
+// Reports the state of the circuit breaker of an upstream API
+type CircuitBreakerStatus struct {
+	Upstream string `json:"upstream"`
+	// Either "closed", "open" or "half_open"
+	State string `json:"state"`
+	// Number of failed requests in a row
+	ConsecutiveFailures int `json:"consecutive_failures"`
+	// When the breaker last opened. Only set while it's not closed
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+	// Number of times the breaker opened
+	Trips int64 `json:"trips"`
+	// Number of requests that failed right away because the breaker was open
+	Rejected int64 `json:"rejected"`
+}
+
+// Stops sending requests to an upstream API that keeps failing, so requests fail right away instead of
+// waiting for a call that's likely to fail as well
+type CircuitBreaker struct {
+	upstream string
+	policy   CircuitBreakerPolicy
+	now      func() time.Time
+
+	mutex               sync.Mutex
+	state               string
+	consecutiveFailures int
+	halfOpenSuccesses   int
+	openedAt            time.Time
+	// Whether a trial request is in progress while the breaker is half open
+	trialInProgress bool
+	trips           int64
+	rejected        int64
+}
+
+func NewCircuitBreaker(upstream string, policy CircuitBreakerPolicy) *CircuitBreaker {
+	return &CircuitBreaker{
+		upstream: upstream,
+		policy:   policy,
+		now:      time.Now,
+		state:    circuitBreakerClosed,
+	}
+}
+
+// Returns an error if the request must not be sent, and otherwise whether the request is a trial request.
+// Every allowed request must be followed by a call to done.
+func (b *CircuitBreaker) allow() (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == circuitBreakerOpen {
+		retryAfter := b.openedAt.Add(b.policy.OpenTimeout).Sub(b.now())
+		if retryAfter > 0 {
+			b.rejected++
+			return false, &CircuitOpenError{Upstream: b.upstream, RetryAfter: retryAfter}
+		}
+		b.state = circuitBreakerHalfOpen
+		b.halfOpenSuccesses = 0
+	}
+
+	if b.state == circuitBreakerHalfOpen {
+		if b.trialInProgress {
+			b.rejected++
+			return false, &CircuitOpenError{Upstream: b.upstream, RetryAfter: time.Second}
+		}
+		b.trialInProgress = true
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// Records the outcome of an allowed request. Requests that the caller stopped waiting for, because it was
+// canceled or ran out of time, are not counted, since they say nothing about the upstream API.
+func (b *CircuitBreaker) done(trial bool, failed bool, canceled bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if trial {
+		b.trialInProgress = false
+	}
+	if canceled {
+		return
+	}
+
+	if !failed {
+		b.consecutiveFailures = 0
+		if trial {
+			b.halfOpenSuccesses++
+			if b.halfOpenSuccesses >= b.policy.HalfOpenSuccesses {
+				b.state = circuitBreakerClosed
+			}
+		}
+		return
+	}
+
+	b.consecutiveFailures++
+	if trial || (b.state == circuitBreakerClosed && b.consecutiveFailures >= b.policy.FailureThreshold) {
+		b.state = circuitBreakerOpen
+		b.openedAt = b.now()
+		b.trips++
+	}
+}
+
+func (b *CircuitBreaker) Status() CircuitBreakerStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	status := CircuitBreakerStatus{
+		Upstream:            b.upstream,
+		State:               b.state,
+		ConsecutiveFailures: b.consecutiveFailures,
+		Trips:               b.trips,
+		Rejected:            b.rejected,
+	}
+	if b.state != circuitBreakerClosed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+
+	return status
+}
+
+// Wraps an HttpClient with a circuit breaker per upstream API, found by the start of the request URL.
+// Requests to other URLs are sent as they are.
+//
+// Requests fail when no response comes back, or when the HTTP status means the upstream API failed, such as
+// a 503. Errors in the body of a successful response, such as a GMaps ZERO_RESULTS status, are answers
+// rather than failures.
+type CircuitBreakingHttpClient struct {
+	httpClient HttpClient
+	// Checked in order
+	urlPrefixes []string
+	breakers    []*CircuitBreaker
+}
+
+func NewCircuitBreakingHttpClient(httpClient HttpClient) *CircuitBreakingHttpClient {
+	return &CircuitBreakingHttpClient{httpClient: httpClient}
+}
+
+// Adds a circuit breaker for the requests whose URL starts with the prefix
+func (c *CircuitBreakingHttpClient) addBreaker(urlPrefix string, breaker *CircuitBreaker) {
+	c.urlPrefixes = append(c.urlPrefixes, urlPrefix)
+	c.breakers = append(c.breakers, breaker)
+}
+
+func (c *CircuitBreakingHttpClient) Do(req *http.Request) (*http.Response, error) {
+	breaker := c.breakerFor(req)
+	if breaker == nil {
+		return c.httpClient.Do(req)
+	}
+
+	trial, err := breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.httpClient.Do(req)
+	failed := err != nil || isUpstreamFailureStatus(res.StatusCode)
+	breaker.done(trial, failed, callerStoppedWaiting(req.Context()))
+
+	return res, err
+}
+
+func (c *CircuitBreakingHttpClient) breakerFor(req *http.Request) *CircuitBreaker {
+	requestUrl := req.URL.String()
+	for i, urlPrefix := range c.urlPrefixes {
+		if strings.HasPrefix(requestUrl, urlPrefix) {
+			return c.breakers[i]
+		}
+	}
+
+	return nil
+}
+
+// Reports the state of every circuit breaker, in the order they were added
+func (c *CircuitBreakingHttpClient) Status() []CircuitBreakerStatus {
+	statuses := make([]CircuitBreakerStatus, len(c.breakers))
+	for i, breaker := range c.breakers {
+		statuses[i] = breaker.Status()
+	}
+
+	return statuses
+}
+
+// Adds a circuit breaker for each upstream API in the configuration. No breakers are added if the failure
+// threshold is 0.
+func newCircuitBreakingHttpClientForConfig(httpClient HttpClient, config Config) *CircuitBreakingHttpClient {
+	client := NewCircuitBreakingHttpClient(httpClient)
+	if config.CircuitBreaker.FailureThreshold == 0 {
+		return client
+	}
+
+	client.addBreaker(config.KitchensAPIURL, NewCircuitBreaker(upstreamKitchensAPI, config.CircuitBreaker))
+	// Each GMaps API has its own breaker, so an outage of one of them doesn't stop calls to the others
+	client.addBreaker(config.GoogleMapsURL+"/maps/api/geocode/",
+		NewCircuitBreaker(upstreamGoogleGeocoding, config.CircuitBreaker))
+	client.addBreaker(config.GoogleMapsURL+"/maps/api/directions/",
+		NewCircuitBreaker(upstreamGoogleDirections, config.CircuitBreaker))
+	client.addBreaker(config.GoogleMapsURL+"/maps/api/distancematrix/",
+		NewCircuitBreaker(upstreamGoogleDistanceMatrix, config.CircuitBreaker))
+	client.addBreaker(config.OSRMURL, NewCircuitBreaker(upstreamOSRM, config.CircuitBreaker))
+
+	return client
+}
@@ -0,0 +1,256 @@
+package clustertruck
+
+import (
+	"testing"
+	"net/http"
+	"net/http/httptest"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+)
+
+func createCircuitBreakerPolicyForTest() CircuitBreakerPolicy {
+	return CircuitBreakerPolicy{
+		FailureThreshold:  3,
+		OpenTimeout:       time.Minute,
+		HalfOpenSuccesses: 2,
+	}
+}
+
+func createRequestForTest(requestUrl string) *http.Request {
+	req, _ := http.NewRequest("GET", requestUrl, nil)
+	return req
+}
+
+// Opens the breaker as if its upstream API failed as many times in a row as the policy allows
+func openCircuitBreakerForTest(breaker *CircuitBreaker) {
+	for i := 0; i < breaker.policy.FailureThreshold; i++ {
+		breaker.done(false, true, false)
+	}
+}
+
+func TestCircuitBreakingHttpClientOpensAfterFailureThreshold(t *testing.T) {
+	calls := 0
+	client := NewCircuitBreakingHttpClient(createClientRespondingWith(&calls,
+		func() (*http.Response, error) {
+			return createHttpResponseForTest(http.StatusServiceUnavailable, bytes.NewBufferString("")), nil
+		}))
+	breaker := NewCircuitBreaker(upstreamGoogleDirections, createCircuitBreakerPolicyForTest())
+	client.addBreaker("https://maps.googleapis.com/maps/api/directions/", breaker)
+
+	for i := 0; i < 3; i++ {
+		res, err := client.Do(createRequestForTest("https://maps.googleapis.com/maps/api/directions/json"))
+		assertResult(t, nil, err)
+		assertResult(t, http.StatusServiceUnavailable, res.StatusCode)
+	}
+
+	_, err := client.Do(createRequestForTest("https://maps.googleapis.com/maps/api/directions/json"))
+	circuitOpenError, ok := err.(*CircuitOpenError)
+	assertResult(t, true, ok)
+	assertResult(t, upstreamGoogleDirections, circuitOpenError.Upstream)
+	assertResult(t, 3, calls)
+
+	status := breaker.Status()
+	assertResult(t, circuitBreakerOpen, status.State)
+	assertResult(t, 3, status.ConsecutiveFailures)
+	assertResult(t, int64(1), status.Trips)
+	assertResult(t, int64(1), status.Rejected)
+
+	// Requests to other URLs don't go through the breaker
+	_, err = client.Do(createRequestForTest("https://api.staging.clustertruck.com/api/kitchens"))
+	assertResult(t, nil, err)
+	assertResult(t, 4, calls)
+}
+
+func TestCircuitBreakerClosesAfterTrialRequestsSucceed(t *testing.T) {
+	now := time.Date(2017, 12, 4, 12, 0, 0, 0, time.UTC)
+	breaker := NewCircuitBreaker(upstreamGoogleDirections, createCircuitBreakerPolicyForTest())
+	breaker.now = func() time.Time { return now }
+	openCircuitBreakerForTest(breaker)
+
+	now = now.Add(59 * time.Second)
+	_, err := breaker.allow()
+	assertResult(t, time.Second, err.(*CircuitOpenError).RetryAfter)
+
+	now = now.Add(time.Second)
+	trial, err := breaker.allow()
+	assertResult(t, nil, err)
+	assertResult(t, true, trial)
+	assertResult(t, circuitBreakerHalfOpen, breaker.Status().State)
+
+	// Only a single trial request is let through at a time
+	_, err = breaker.allow()
+	assertResult(t, true, err != nil)
+
+	breaker.done(true, false, false)
+	assertResult(t, circuitBreakerHalfOpen, breaker.Status().State)
+	trial, _ = breaker.allow()
+	breaker.done(trial, false, false)
+	assertResult(t, circuitBreakerClosed, breaker.Status().State)
+	assertResult(t, (*time.Time)(nil), breaker.Status().OpenedAt)
+}
+
+func TestCircuitBreakerReopensWhenTrialRequestFails(t *testing.T) {
+	now := time.Date(2017, 12, 4, 12, 0, 0, 0, time.UTC)
+	breaker := NewCircuitBreaker(upstreamGoogleDirections, createCircuitBreakerPolicyForTest())
+	breaker.now = func() time.Time { return now }
+	openCircuitBreakerForTest(breaker)
+
+	now = now.Add(time.Minute)
+	trial, _ := breaker.allow()
+	breaker.done(trial, true, false)
+
+	status := breaker.Status()
+	assertResult(t, circuitBreakerOpen, status.State)
+	assertResult(t, int64(2), status.Trips)
+	assertResult(t, now, *status.OpenedAt)
+}
+
+func TestCircuitBreakerIgnoresCanceledRequests(t *testing.T) {
+	breaker := NewCircuitBreaker(upstreamGoogleDirections, createCircuitBreakerPolicyForTest())
+	for i := 0; i < 5; i++ {
+		trial, _ := breaker.allow()
+		breaker.done(trial, true, true)
+	}
+
+	assertResult(t, circuitBreakerClosed, breaker.Status().State)
+	assertResult(t, 0, breaker.Status().ConsecutiveFailures)
+}
+
+func TestCircuitBreakingHttpClientIgnoresCallersThatRanOutOfTime(t *testing.T) {
+	client := NewCircuitBreakingHttpClient(&MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		},
+	})
+	breaker := NewCircuitBreaker(upstreamGoogleDirections, createCircuitBreakerPolicyForTest())
+	client.addBreaker("https://maps.googleapis.com/maps/api/directions/", breaker)
+
+	// The deadline of the caller passed before the upstream API's own timeout
+	for i := 0; i < 5; i++ {
+		callerCtx, cancelCaller := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		ctx, cancel := contextWithUpstreamTimeout(callerCtx, time.Minute)
+		client.Do(createRequestForTest("https://maps.googleapis.com/maps/api/directions/json").WithContext(ctx))
+		cancel()
+		cancelCaller()
+	}
+	assertResult(t, circuitBreakerClosed, breaker.Status().State)
+	assertResult(t, 0, breaker.Status().ConsecutiveFailures)
+
+	// The upstream API took longer than its own timeout
+	ctx, cancel := contextWithUpstreamTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	client.Do(createRequestForTest("https://maps.googleapis.com/maps/api/directions/json").WithContext(ctx))
+	assertResult(t, 1, breaker.Status().ConsecutiveFailures)
+}
+
+func TestUpstreamTransportErrorWhileCircuitIsOpen(t *testing.T) {
+	apiError := upstreamTransportError(upstreamGoogleDirections, "There was an error performing a request",
+		&CircuitOpenError{Upstream: upstreamGoogleDirections, RetryAfter: 10 * time.Second})
+
+	assertResult(t, ErrorCodeUpstreamCircuitOpen, apiError.Code)
+	assertResult(t, http.StatusServiceUnavailable, apiError.StatusCode())
+	assertResult(t, 10*time.Second, apiError.RetryAfter)
+}
+
+func TestFindDriveTimeFallsBackToStaleDirectionsWhileCircuitIsOpen(t *testing.T) {
+	var directionsCalls int32
+	service := createDriveTimeServiceForTest(createCountingClientWithRoutesToEveryKitchen(&directionsCalls),
+		"2017-12-04 12:00")
+	_, err := service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{StartingAddress: "Martinsville, IN"})
+	assertResult(t, nil, err)
+
+	service.directionsCache.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	openCircuitBreakerForTest(service.circuitBreakers.breakerFor(
+		createRequestForTest(service.config.GoogleMapsURL + "/maps/api/directions/json")))
+
+	closestClusterTruckInfo, err := service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{StartingAddress: "Martinsville, IN", Explain: true})
+	assertResult(t, nil, err)
+	assertResult(t, "Downtown Columbus", closestClusterTruckInfo.LocationName)
+	assertResult(t, 6, closestClusterTruckInfo.Metadata.StaleResults)
+	assertResult(t, true, findExplanationForTest(closestClusterTruckInfo.Explanation, "Downtown Columbus").Stale)
+	assertResult(t, int32(6), directionsCalls)
+	assertResult(t, int64(6), service.Metrics().DirectionsCache.StaleHits)
+
+	// Without stale directions or estimates, the request fails right away
+	service.config.EstimateFallback = false
+	_, err = service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{StartingAddress: "Mooresville, IN"})
+	assertResult(t, ErrorCodeUpstreamCircuitOpen, errorCode(err))
+	assertResult(t, true, err.(*APIError).RetryAfter > 0)
+	assertResult(t, int32(6), directionsCalls)
+}
+
+func TestGoogleMapsAPIsHaveSeparateCircuitBreakers(t *testing.T) {
+	service := createDriveTimeServiceForTest(createClientWithRoutesToEveryKitchen(), "2017-12-04 12:00")
+	geocodingBreaker := service.circuitBreakers.breakerFor(
+		createRequestForTest(service.config.GoogleMapsURL + "/maps/api/geocode/json"))
+	assertResult(t, upstreamGoogleGeocoding, geocodingBreaker.Status().Upstream)
+	openCircuitBreakerForTest(geocodingBreaker)
+
+	// Directions are still found, since only the starting point needs to be geocoded
+	closestClusterTruckInfo, err := service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{StartingAddress: "Martinsville, IN"})
+	assertResult(t, nil, err)
+	assertResult(t, "Downtown Columbus", closestClusterTruckInfo.LocationName)
+	directionsBreaker := service.circuitBreakers.breakerFor(
+		createRequestForTest(service.config.GoogleMapsURL + "/maps/api/directions/json"))
+	assertResult(t, circuitBreakerClosed, directionsBreaker.Status().State)
+}
+
+func TestDriveTimeServiceHealth(t *testing.T) {
+	service := createDriveTimeServiceForTest(createClientWithRoutesToEveryKitchen(), "2017-12-04 12:00")
+
+	health := service.Health()
+	assertResult(t, healthStatusOK, health.Status)
+	assertResult(t, 5, len(health.CircuitBreakers))
+
+	openCircuitBreakerForTest(service.circuitBreakers.breakers[0])
+	health = service.Health()
+	assertResult(t, healthStatusDegraded, health.Status)
+	assertResult(t, upstreamKitchensAPI, health.CircuitBreakers[0].Upstream)
+	assertResult(t, circuitBreakerOpen, health.CircuitBreakers[0].State)
+}
+
+func TestAPIHealthWithoutAccessKey(t *testing.T) {
+	api := SetupAPI(createClientWithRoutesToEveryKitchen(), DefaultConfig())
+	recorder := httptest.NewRecorder()
+
+	api.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/health", nil))
+
+	var health HealthStatus
+	json.Unmarshal(recorder.Body.Bytes(), &health)
+	assertResult(t, http.StatusOK, recorder.Code)
+	assertResult(t, healthStatusOK, health.Status)
+	assertResult(t, circuitBreakerClosed, health.CircuitBreakers[1].State)
+}
+
+func TestLoadConfigFromEnvWithCircuitBreakerPolicy(t *testing.T) {
+	os.Setenv("CT_BREAKER_FAILURE_THRESHOLD", "10")
+	os.Setenv("CT_BREAKER_OPEN_TIMEOUT", "1m")
+	defer os.Unsetenv("CT_BREAKER_FAILURE_THRESHOLD")
+	defer os.Unsetenv("CT_BREAKER_OPEN_TIMEOUT")
+
+	config, err := LoadConfigFromEnv()
+	assertResult(t, nil, err)
+	assertResult(t, CircuitBreakerPolicy{FailureThreshold: 10, OpenTimeout: time.Minute, HalfOpenSuccesses: 1},
+		config.CircuitBreaker)
+
+	os.Setenv("CT_BREAKER_HALF_OPEN_SUCCESSES", "0")
+	defer os.Unsetenv("CT_BREAKER_HALF_OPEN_SUCCESSES")
+	_, err = LoadConfigFromEnv()
+	assertResult(t, "CT_BREAKER_HALF_OPEN_SUCCESSES must be at least 1", err.Error())
+}
+
+func TestCircuitBreakersTurnedOff(t *testing.T) {
+	config := DefaultConfig()
+	config.CircuitBreaker.FailureThreshold = 0
+
+	client := newCircuitBreakingHttpClientForConfig(createClientWithRoutesToEveryKitchen(), config)
+	assertResult(t, 0, len(client.Status()))
+}
@@ -0,0 +1,238 @@
+package clustertruck
+
+import (
+	"context"
+	"sync"
+	"fmt"
+	"time"
+)
+
+// Makes concurrent identical calls only once, and shares the result between the callers.
+//
+// Each caller stops waiting when its own context is done. The shared call is canceled once every caller
+// has stopped waiting, so it doesn't keep running for nobody. Its deadline is the latest deadline of the
+// callers, so upstream calls made for it know how much time they have.
+type callGroup struct {
+	mutex sync.Mutex
+	calls map[string]*sharedCall
+}
+
+type sharedCall struct {
+	ctx  *sharedCallContext
+	done chan struct{}
+	// Created when the call starts, and returned to every caller, even the ones that stopped waiting
+	state   interface{}
+	value   interface{}
+	err     error
+	waiters int
+}
+
+// The context of a shared call. It is canceled when the last caller stops waiting, and reports the same
+// error as the context of that caller, so a shared call canceled because its last caller timed out is
+// reported as a timeout.
+type sharedCallContext struct {
+	context.Context
+	cancelContext context.CancelFunc
+	mutex         sync.Mutex
+	err           error
+	// Latest deadline of the callers. Not set if one of them has no deadline
+	deadline    time.Time
+	hasDeadline bool
+}
+
+func newCallGroup() *callGroup {
+	return &callGroup{calls: make(map[string]*sharedCall)}
+}
+
+// The context starts with the deadline of the first caller
+func newSharedCallContext(callerCtx context.Context) *sharedCallContext {
+	ctx, cancel := context.WithCancel(context.Background())
+	sharedCtx := &sharedCallContext{Context: ctx, cancelContext: cancel}
+	sharedCtx.deadline, sharedCtx.hasDeadline = callerCtx.Deadline()
+
+	return sharedCtx
+}
+
+// The call is canceled by the last caller to stop waiting, which is never before the latest deadline
+func (c *sharedCallContext) Deadline() (time.Time, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.deadline, c.hasDeadline
+}
+
+// Extends the deadline to the deadline of a caller that joined the call, if it's later
+func (c *sharedCallContext) addCaller(callerCtx context.Context) {
+	deadline, hasDeadline := callerCtx.Deadline()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !hasDeadline {
+		c.hasDeadline = false
+	} else if c.hasDeadline && deadline.After(c.deadline) {
+		c.deadline = deadline
+	}
+}
+
+func (c *sharedCallContext) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.err != nil {
+		return c.err
+	}
+
+	return c.Context.Err()
+}
+
+func (c *sharedCallContext) cancel(err error) {
+	c.mutex.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mutex.Unlock()
+
+	c.cancelContext()
+}
+
+// Calls fn, unless a call with the same key is already in progress, in which case its result is waited for.
+// Returns whether the result was shared with another caller.
+//
+// If the context of the caller is done first, the context error is returned. The last caller to stop waiting
+// cancels the call and waits for it to return instead, so it gets whatever the call found before it was canceled.
+func (g *callGroup) do(ctx context.Context, key string,
+	fn func(ctx context.Context) (interface{}, error)) (interface{}, error, bool) {
+
+	value, err, shared, _ := g.doWithState(ctx, key, nil,
+		func(ctx context.Context, state interface{}) (interface{}, error) {
+			return fn(ctx)
+		})
+
+	return value, err, shared
+}
+
+// Like do, but newState is called when the call starts, and its result is passed to fn and returned to every
+// caller, so callers that stop waiting can still find out how far the call got. newState can be nil.
+func (g *callGroup) doWithState(ctx context.Context, key string, newState func() interface{},
+	fn func(ctx context.Context, state interface{}) (interface{}, error)) (interface{}, error, bool, interface{}) {
+
+	g.mutex.Lock()
+	call, shared := g.calls[key]
+	if !shared {
+		call = &sharedCall{
+			ctx:  newSharedCallContext(ctx),
+			done: make(chan struct{}),
+		}
+		if newState != nil {
+			call.state = newState()
+		}
+		g.calls[key] = call
+		go g.run(key, call, fn)
+	} else {
+		call.ctx.addCaller(ctx)
+	}
+	call.waiters++
+	g.mutex.Unlock()
+
+	select {
+	case <-call.done:
+		return call.value, call.err, shared, call.state
+	case <-ctx.Done():
+	}
+
+	g.mutex.Lock()
+	call.waiters--
+	lastWaiter := call.waiters == 0
+	if lastWaiter && g.calls[key] == call {
+		// Later callers start a new call, instead of joining one that is being canceled
+		delete(g.calls, key)
+	}
+	g.mutex.Unlock()
+
+	if !lastWaiter {
+		return nil, contextError(ctx), shared, call.state
+	}
+
+	call.ctx.cancel(ctx.Err())
+	<-call.done
+	return call.value, call.err, shared, call.state
+}
+
+func (g *callGroup) run(key string, call *sharedCall,
+	fn func(ctx context.Context, state interface{}) (interface{}, error)) {
+
+	call.value, call.err = fn(call.ctx, call.state)
+
+	g.mutex.Lock()
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+	g.mutex.Unlock()
+
+	call.ctx.cancel(context.Canceled)
+	close(call.done)
+}
+
+// Makes concurrent identical calls to a directions provider only once
+type coalescingDirectionsProvider struct {
+	provider DirectionsProvider
+	calls    *callGroup
+}
+
+// Also makes concurrent identical distance matrix calls only once. Only used for providers that support them,
+// so whether distance matrices are supported can still be found with a type assertion.
+type coalescingDistanceMatrixProvider struct {
+	*coalescingDirectionsProvider
+	matrixProvider DistanceMatrixProvider
+}
+
+func newCoalescingDirectionsProvider(provider DirectionsProvider) DirectionsProvider {
+	coalescingProvider := &coalescingDirectionsProvider{
+		provider: provider,
+		calls:    newCallGroup(),
+	}
+	if matrixProvider, ok := provider.(DistanceMatrixProvider); ok {
+		return &coalescingDistanceMatrixProvider{
+			coalescingDirectionsProvider: coalescingProvider,
+			matrixProvider:               matrixProvider,
+		}
+	}
+
+	return coalescingProvider
+}
+
+func (p *coalescingDirectionsProvider) Name() string {
+	return p.provider.Name()
+}
+
+func (p *coalescingDirectionsProvider) GetDirections(ctx context.Context, origin Waypoint, destination Waypoint,
+	options TravelOptions) ([]Route, error) {
+
+	key := fmt.Sprintf("%s|%s|%s|%s", RoutingModeDirections, normalizeOrigin(origin), normalizeOrigin(destination),
+		travelOptionsCacheKey(options))
+	routes, err, _ := p.calls.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		return p.provider.GetDirections(ctx, origin, destination, options)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return routes.([]Route), nil
+}
+
+func (p *coalescingDistanceMatrixProvider) GetDistanceMatrix(ctx context.Context, origin Waypoint,
+	destinations []Waypoint, options TravelOptions) ([]DistanceMatrixElement, error) {
+
+	key := fmt.Sprintf("%s|%s|%s", RoutingModeDistanceMatrix, normalizeOrigin(origin), travelOptionsCacheKey(options))
+	for _, destination := range destinations {
+		key += "|" + normalizeOrigin(destination)
+	}
+	elements, err, _ := p.calls.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		return p.matrixProvider.GetDistanceMatrix(ctx, origin, destinations, options)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return elements.([]DistanceMatrixElement), nil
+}
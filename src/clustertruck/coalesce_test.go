@@ -0,0 +1,198 @@
+package clustertruck
+
+import (
+	"testing"
+	"context"
+	"time"
+	"sync"
+	"sync/atomic"
+	"net/http"
+	"strings"
+)
+
+// Waits until the given number of callers are waiting for the call with the given key
+func waitForWaiters(group *callGroup, key string, waiters int) {
+	for {
+		group.mutex.Lock()
+		call, found := group.calls[key]
+		ready := found && call.waiters == waiters
+		group.mutex.Unlock()
+		if ready {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCallGroupSharesConcurrentCalls(t *testing.T) {
+	group := newCallGroup()
+	release := make(chan struct{})
+	var calls int32
+	fn := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "result", nil
+	}
+
+	var waitGroup sync.WaitGroup
+	results := make([]interface{}, 2)
+	shared := make([]bool, 2)
+	for i := 0; i < 2; i++ {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			results[i], _, shared[i] = group.do(context.Background(), "key", fn)
+		}(i)
+	}
+	waitForWaiters(group, "key", 2)
+	close(release)
+	waitGroup.Wait()
+
+	assertResult(t, int32(1), atomic.LoadInt32(&calls))
+	assertResult(t, "result", results[0])
+	assertResult(t, "result", results[1])
+	assertResult(t, true, shared[0] != shared[1])
+}
+
+func TestCallGroupCallerStopsWaitingWhenItsContextIsDone(t *testing.T) {
+	group := newCallGroup()
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		<-release
+		return "result", ctx.Err()
+	}
+
+	patientResult := make(chan interface{})
+	go func() {
+		result, _, _ := group.do(context.Background(), "key", fn)
+		patientResult <- result
+	}()
+	waitForWaiters(group, "key", 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err, shared := group.do(ctx, "key", fn)
+	assertResult(t, true, shared)
+	assertResult(t, ErrorCodeRequestTimeout, errorCode(err))
+
+	// The call is not canceled, since another caller is still waiting for it
+	close(release)
+	assertResult(t, "result", <-patientResult)
+}
+
+func TestCallGroupCancelsCallWhenLastCallerStopsWaiting(t *testing.T) {
+	group := newCallGroup()
+	fn := func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		return nil, contextError(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err, _ := group.do(ctx, "key", fn)
+
+	assertResult(t, ErrorCodeRequestTimeout, errorCode(err))
+	group.mutex.Lock()
+	assertResult(t, 0, len(group.calls))
+	group.mutex.Unlock()
+}
+
+func TestFindDriveTimeSharesIdenticalConcurrentRequests(t *testing.T) {
+	release := make(chan struct{})
+	var directionsCalls int32
+	client := createClientWithRoutesToEveryKitchen()
+	doFunc := client.DoFunc
+	client.DoFunc = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "directions") {
+			atomic.AddInt32(&directionsCalls, 1)
+			<-release
+		}
+		return doFunc(req)
+	}
+	service := createDriveTimeServiceForTest(client, "2017-12-04 12:00")
+
+	payloads := []RequestPayload{{StartingAddress: "Martinsville, IN"}, {StartingAddress: "martinsville,  IN"}}
+	results := make([]*ClosestClusterTruck, len(payloads))
+	var waitGroup sync.WaitGroup
+	for i, payload := range payloads {
+		waitGroup.Add(1)
+		go func(i int, payload RequestPayload) {
+			defer waitGroup.Done()
+			results[i], _ = service.findDriveTimeToClosestClusterTruckKitchen(context.Background(), payload)
+		}(i, payload)
+	}
+	waitForWaiters(service.lookups, payloads[0].coalescingKey(), 2)
+	close(release)
+	waitGroup.Wait()
+
+	assertResult(t, int32(6), atomic.LoadInt32(&directionsCalls))
+	assertResult(t, "Downtown Columbus", results[0].LocationName)
+	assertResult(t, "Downtown Columbus", results[1].LocationName)
+	assertResult(t, "Martinsville, IN", results[0].StartAddress)
+	assertResult(t, "martinsville,  IN", results[1].StartAddress)
+	assertResult(t, true, results[0].Metadata.Coalesced != results[1].Metadata.Coalesced)
+}
+
+func TestCallGroupSharedCallHasLatestDeadlineOfCallers(t *testing.T) {
+	group := newCallGroup()
+	release := make(chan struct{})
+	deadlines := make(chan time.Time, 1)
+	fn := func(ctx context.Context) (interface{}, error) {
+		<-release
+		deadline, _ := ctx.Deadline()
+		deadlines <- deadline
+		return "result", nil
+	}
+
+	earlier := time.Now().Add(time.Hour)
+	later := earlier.Add(time.Hour)
+	var waitGroup sync.WaitGroup
+	for i, deadline := range []time.Time{earlier, later} {
+		waitGroup.Add(1)
+		go func(deadline time.Time) {
+			defer waitGroup.Done()
+			ctx, cancel := context.WithDeadline(context.Background(), deadline)
+			defer cancel()
+			group.do(ctx, "key", fn)
+		}(deadline)
+		waitForWaiters(group, "key", i+1)
+	}
+	close(release)
+	waitGroup.Wait()
+
+	assertResult(t, later, <-deadlines)
+}
+
+func TestFindDriveTimeReportsPendingKitchensWhenCallerStopsWaitingForSharedLookup(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	var directionsCalls int32
+	client := createClientWithRoutesToEveryKitchen()
+	doFunc := client.DoFunc
+	client.DoFunc = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "directions") {
+			atomic.AddInt32(&directionsCalls, 1)
+			<-release
+		}
+		return doFunc(req)
+	}
+	service := createDriveTimeServiceForTest(client, "2017-12-04 12:00")
+	payload := RequestPayload{StartingAddress: "Martinsville, IN"}
+
+	go service.findDriveTimeToClosestClusterTruckKitchen(context.Background(), payload)
+	for atomic.LoadInt32(&directionsCalls) < 6 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		waitForWaiters(service.lookups, payload.coalescingKey(), 2)
+		cancel()
+	}()
+	_, err := service.findDriveTimeToClosestClusterTruckKitchen(ctx, payload)
+
+	apiError := err.(*APIError)
+	assertResult(t, ErrorCodeRequestCanceled, apiError.Code)
+	assertResult(t, 6, len(apiError.Parameters["pending_kitchens"].([]PendingKitchen)))
+	assertResult(t, "the request was canceled, 6 of the 6 kitchens did not answer in time", apiError.Message)
+}
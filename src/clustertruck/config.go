@@ -0,0 +1,438 @@
+package clustertruck
+
+import (
+	"os"
+	"time"
+	"errors"
+	"fmt"
+	"strings"
+	"strconv"
+)
+
+// Configuration of the server. Every value can be overridden with an environment variable.
+type Config struct {
+	// URL of the ClusterTruck Kitchens API (CT_KITCHENS_API_URL)
+	KitchensAPIURL string
+	// How long kitchen information is served before it's refreshed in the background (CT_KITCHEN_CACHE_TTL)
+	KitchenCacheTTL time.Duration
+	// How often kitchen information is refreshed in the background, whether or not it's stale. 0 means it's
+	// only refreshed once a request finds it stale (CT_KITCHEN_REFRESH_INTERVAL)
+	KitchenRefreshInterval time.Duration
+	// Which kitchens users can be sent to, unless a request asks for something else (CT_KITCHEN_ELIGIBILITY)
+	KitchenEligibility EligibilityPolicy
+	// Either "google" or "osrm" (CT_DIRECTIONS_PROVIDER)
+	DirectionsProvider string
+	// API key for the GMaps Directions and Geocoding APIs (CT_GMAPS_API_KEY)
+	GoogleMapsAPIKey string
+	// Base URL of the GMaps APIs (CT_GMAPS_URL)
+	GoogleMapsURL string
+	// Base URL of the OSRM server, used by the "osrm" directions provider (CT_OSRM_URL)
+	OSRMURL string
+	// Either "directions" or "distance_matrix" (CT_ROUTING_MODE)
+	RoutingMode string
+	// Only get directions to this many of the kitchens closest to the starting address,
+	// as the crow flies. 0 means no limit (CT_PREFILTER_TOP_K)
+	PrefilterTopK int
+	// Only get directions to kitchens within this many miles of the starting address,
+	// as the crow flies. 0 means no limit (CT_PREFILTER_RADIUS_MILES)
+	PrefilterRadiusMiles float64
+	// Longest time a request to this server can take, including every call to upstream APIs.
+	// 0 means no limit (CT_REQUEST_TIMEOUT)
+	RequestTimeout time.Duration
+	// Longest time a single call to each upstream API can take, including retries. 0 means no limit
+	// (CT_KITCHENS_API_TIMEOUT, CT_GMAPS_TIMEOUT and CT_OSRM_TIMEOUT)
+	KitchensAPITimeout time.Duration
+	GoogleMapsTimeout  time.Duration
+	OSRMTimeout        time.Duration
+	// Number of calls that can be made to the directions provider at the same time, across all requests
+	// (CT_DIRECTIONS_WORKERS)
+	DirectionsWorkers int
+	// Number of calls to the directions provider that can wait for a worker. Requests are rejected
+	// when there is no room for their calls (CT_DIRECTIONS_QUEUE_SIZE)
+	DirectionsQueueSize int
+	// Number of directions results that are cached. 0 disables the cache (CT_DIRECTIONS_CACHE_SIZE)
+	DirectionsCacheSize int
+	// How long directions results are cached (CT_DIRECTIONS_CACHE_TTL)
+	DirectionsCacheTTL time.Duration
+	// How long starting addresses that could not be found are cached (CT_DIRECTIONS_CACHE_NEGATIVE_TTL)
+	DirectionsCacheNegativeTTL time.Duration
+	// How kitchens and routes are ranked, unless a request asks for something else (CT_RANKING_STRATEGY)
+	RankingStrategy RankingStrategy
+	// Weights of the "weighted" ranking strategy, per second of drive time and per meter of drive distance
+	// (CT_RANKING_TIME_WEIGHT and CT_RANKING_DISTANCE_WEIGHT)
+	RankingTimeWeight     float64
+	RankingDistanceWeight float64
+	// What happens to the calls to the directions provider that are still in progress when the latency budget
+	// of a request runs out, either "cancel" or "finish" (CT_OUTSTANDING_CALLS)
+	OutstandingCalls string
+	// Whether drive times are estimated from the straight-line distance when the directions provider fails
+	// for every kitchen (CT_ESTIMATE_FALLBACK)
+	EstimateFallback bool
+	// How much longer roads are assumed to be than the straight-line distance (CT_ESTIMATE_CIRCUITY)
+	EstimateCircuity float64
+	// Average speeds used to estimate drive times, by distance from the start (CT_ESTIMATE_SPEED_PROFILE)
+	EstimateSpeedProfile []SpeedBand
+	// Number of addresses of a batch request that are looked up at the same time (CT_BATCH_CONCURRENCY)
+	BatchConcurrency int
+	// Largest number of addresses in a batch request. 0 means no limit (CT_BATCH_MAX_ITEMS)
+	BatchMaxItems int
+	// Directory where jobs are kept, so they survive a restart (CT_JOBS_DIR)
+	JobsDir string
+	// Number of addresses of each job that are looked up at the same time (CT_JOBS_CONCURRENCY)
+	JobsConcurrency int
+	// Largest number of addresses in a job. 0 means no limit (CT_JOBS_MAX_ITEMS)
+	JobsMaxItems int
+	// How long finished jobs and their results are kept before they are deleted. 0 means they are kept
+	// forever (CT_JOBS_RETENTION)
+	JobsRetention time.Duration
+	// How failed requests to upstream APIs are retried (CT_RETRY_MAX_ATTEMPTS, CT_RETRY_INITIAL_BACKOFF,
+	// CT_RETRY_MAX_BACKOFF, CT_RETRY_MAX_RETRY_AFTER, CT_RETRY_JITTER and CT_RETRY_STATUSES)
+	Retry RetryPolicy
+	// When the circuit breaker of each upstream API opens and closes again (CT_BREAKER_FAILURE_THRESHOLD,
+	// CT_BREAKER_OPEN_TIMEOUT and CT_BREAKER_HALF_OPEN_SUCCESSES)
+	CircuitBreaker CircuitBreakerPolicy
+}
+
+func DefaultConfig() Config {
+	return Config{
+		KitchensAPIURL:             "https://api.staging.clustertruck.com/api/kitchens",
+		KitchenCacheTTL:            24 * time.Hour,
+		KitchenRefreshInterval:     time.Hour,
+		KitchenEligibility:         EligibilityActiveOnly,
+		DirectionsProvider:         DirectionsProviderGoogle,
+		GoogleMapsURL:              "https://maps.googleapis.com",
+		OSRMURL:                    "http://localhost:5000",
+		RoutingMode:                RoutingModeDirections,
+		RequestTimeout:             10 * time.Second,
+		KitchensAPITimeout:         10 * time.Second,
+		GoogleMapsTimeout:          5 * time.Second,
+		OSRMTimeout:                5 * time.Second,
+		DirectionsWorkers:          20,
+		DirectionsQueueSize:        500,
+		DirectionsCacheSize:        10000,
+		DirectionsCacheTTL:         time.Hour,
+		DirectionsCacheNegativeTTL: time.Minute,
+		RankingStrategy:            RankingShortestTime,
+		RankingTimeWeight:          1,
+		RankingDistanceWeight:      0.05,
+		OutstandingCalls:           OutstandingCallsCancel,
+		EstimateFallback:           true,
+		EstimateCircuity:           1.3,
+		EstimateSpeedProfile:       DefaultSpeedProfile(),
+		BatchConcurrency:           4,
+		BatchMaxItems:              10000,
+		JobsDir:                    "/var/lib/clustertruck/jobs",
+		JobsConcurrency:            4,
+		JobsMaxItems:               1000000,
+		JobsRetention:              7 * 24 * time.Hour,
+		Retry:                      DefaultRetryPolicy(),
+		CircuitBreaker:             DefaultCircuitBreakerPolicy(),
+	}
+}
+
+// Starts from the default configuration, and overrides any value that's set in the environment
+func LoadConfigFromEnv() (Config, error) {
+	config := DefaultConfig()
+
+	config.KitchensAPIURL = stringFromEnv("CT_KITCHENS_API_URL", config.KitchensAPIURL)
+
+	var err error
+	config.KitchenCacheTTL, err = durationFromEnv("CT_KITCHEN_CACHE_TTL", config.KitchenCacheTTL)
+	if err != nil {
+		return config, err
+	}
+	config.KitchenRefreshInterval, err = durationFromEnv("CT_KITCHEN_REFRESH_INTERVAL",
+		config.KitchenRefreshInterval)
+	if err != nil {
+		return config, err
+	}
+
+	if value := os.Getenv("CT_KITCHEN_ELIGIBILITY"); value != "" {
+		config.KitchenEligibility, err = parseEligibilityPolicy(value)
+		if err != nil {
+			return config, errors.New(fmt.Sprintf("CT_KITCHEN_ELIGIBILITY is invalid: %s", err.Error()))
+		}
+	}
+
+	config.DirectionsProvider = stringFromEnv("CT_DIRECTIONS_PROVIDER", config.DirectionsProvider)
+	if config.DirectionsProvider != DirectionsProviderGoogle && config.DirectionsProvider != DirectionsProviderOSRM {
+		return config, errors.New(fmt.Sprintf("CT_DIRECTIONS_PROVIDER must be %s or %s, but was \"%s\"",
+			DirectionsProviderGoogle, DirectionsProviderOSRM, config.DirectionsProvider))
+	}
+
+	config.GoogleMapsAPIKey = stringFromEnv("CT_GMAPS_API_KEY", config.GoogleMapsAPIKey)
+	config.GoogleMapsURL = strings.TrimSuffix(stringFromEnv("CT_GMAPS_URL", config.GoogleMapsURL), "/")
+	config.OSRMURL = strings.TrimSuffix(stringFromEnv("CT_OSRM_URL", config.OSRMURL), "/")
+
+	config.RoutingMode = stringFromEnv("CT_ROUTING_MODE", config.RoutingMode)
+	if config.RoutingMode != RoutingModeDirections && config.RoutingMode != RoutingModeDistanceMatrix {
+		return config, errors.New(fmt.Sprintf("CT_ROUTING_MODE must be %s or %s, but was \"%s\"",
+			RoutingModeDirections, RoutingModeDistanceMatrix, config.RoutingMode))
+	}
+
+	config.PrefilterTopK, err = intFromEnv("CT_PREFILTER_TOP_K", config.PrefilterTopK)
+	if err != nil {
+		return config, err
+	}
+	config.PrefilterRadiusMiles, err = floatFromEnv("CT_PREFILTER_RADIUS_MILES", config.PrefilterRadiusMiles)
+	if err != nil {
+		return config, err
+	}
+
+	config.RequestTimeout, err = durationFromEnv("CT_REQUEST_TIMEOUT", config.RequestTimeout)
+	if err != nil {
+		return config, err
+	}
+	config.KitchensAPITimeout, err = durationFromEnv("CT_KITCHENS_API_TIMEOUT", config.KitchensAPITimeout)
+	if err != nil {
+		return config, err
+	}
+	config.GoogleMapsTimeout, err = durationFromEnv("CT_GMAPS_TIMEOUT", config.GoogleMapsTimeout)
+	if err != nil {
+		return config, err
+	}
+	config.OSRMTimeout, err = durationFromEnv("CT_OSRM_TIMEOUT", config.OSRMTimeout)
+	if err != nil {
+		return config, err
+	}
+
+	config.DirectionsWorkers, err = intFromEnv("CT_DIRECTIONS_WORKERS", config.DirectionsWorkers)
+	if err != nil {
+		return config, err
+	}
+	if config.DirectionsWorkers == 0 {
+		return config, errors.New("CT_DIRECTIONS_WORKERS must be at least 1")
+	}
+	config.DirectionsQueueSize, err = intFromEnv("CT_DIRECTIONS_QUEUE_SIZE", config.DirectionsQueueSize)
+	if err != nil {
+		return config, err
+	}
+
+	config.DirectionsCacheSize, err = intFromEnv("CT_DIRECTIONS_CACHE_SIZE", config.DirectionsCacheSize)
+	if err != nil {
+		return config, err
+	}
+	config.DirectionsCacheTTL, err = durationFromEnv("CT_DIRECTIONS_CACHE_TTL", config.DirectionsCacheTTL)
+	if err != nil {
+		return config, err
+	}
+	config.DirectionsCacheNegativeTTL, err = durationFromEnv("CT_DIRECTIONS_CACHE_NEGATIVE_TTL",
+		config.DirectionsCacheNegativeTTL)
+	if err != nil {
+		return config, err
+	}
+
+	if value := os.Getenv("CT_RANKING_STRATEGY"); value != "" {
+		config.RankingStrategy, err = parseRankingStrategy(value)
+		if err != nil {
+			return config, errors.New(fmt.Sprintf("CT_RANKING_STRATEGY is invalid: %s", err.Error()))
+		}
+	}
+	config.RankingTimeWeight, err = floatFromEnv("CT_RANKING_TIME_WEIGHT", config.RankingTimeWeight)
+	if err != nil {
+		return config, err
+	}
+	config.RankingDistanceWeight, err = floatFromEnv("CT_RANKING_DISTANCE_WEIGHT", config.RankingDistanceWeight)
+	if err != nil {
+		return config, err
+	}
+
+	if value := os.Getenv("CT_OUTSTANDING_CALLS"); value != "" {
+		config.OutstandingCalls, err = parseOutstandingCallsPolicy(value)
+		if err != nil {
+			return config, errors.New(fmt.Sprintf("CT_OUTSTANDING_CALLS is invalid: %s", err.Error()))
+		}
+	}
+
+	config.EstimateFallback, err = boolFromEnv("CT_ESTIMATE_FALLBACK", config.EstimateFallback)
+	if err != nil {
+		return config, err
+	}
+	config.EstimateCircuity, err = floatFromEnv("CT_ESTIMATE_CIRCUITY", config.EstimateCircuity)
+	if err != nil {
+		return config, err
+	}
+	if config.EstimateCircuity < 1 {
+		return config, errors.New(fmt.Sprintf("CT_ESTIMATE_CIRCUITY must be at least 1, but was %g",
+			config.EstimateCircuity))
+	}
+	if value := os.Getenv("CT_ESTIMATE_SPEED_PROFILE"); value != "" {
+		config.EstimateSpeedProfile, err = parseSpeedProfile(value)
+		if err != nil {
+			return config, errors.New(fmt.Sprintf("CT_ESTIMATE_SPEED_PROFILE is invalid: %s", err.Error()))
+		}
+	}
+
+	config.BatchConcurrency, err = intFromEnv("CT_BATCH_CONCURRENCY", config.BatchConcurrency)
+	if err != nil {
+		return config, err
+	}
+	if config.BatchConcurrency == 0 {
+		return config, errors.New("CT_BATCH_CONCURRENCY must be at least 1")
+	}
+	config.BatchMaxItems, err = intFromEnv("CT_BATCH_MAX_ITEMS", config.BatchMaxItems)
+	if err != nil {
+		return config, err
+	}
+
+	config.JobsDir = stringFromEnv("CT_JOBS_DIR", config.JobsDir)
+	config.JobsConcurrency, err = intFromEnv("CT_JOBS_CONCURRENCY", config.JobsConcurrency)
+	if err != nil {
+		return config, err
+	}
+	if config.JobsConcurrency == 0 {
+		return config, errors.New("CT_JOBS_CONCURRENCY must be at least 1")
+	}
+	config.JobsMaxItems, err = intFromEnv("CT_JOBS_MAX_ITEMS", config.JobsMaxItems)
+	if err != nil {
+		return config, err
+	}
+	config.JobsRetention, err = durationFromEnv("CT_JOBS_RETENTION", config.JobsRetention)
+	if err != nil {
+		return config, err
+	}
+
+	config.Retry, err = loadRetryPolicyFromEnv(config.Retry)
+	if err != nil {
+		return config, err
+	}
+
+	config.CircuitBreaker, err = loadCircuitBreakerPolicyFromEnv(config.CircuitBreaker)
+	if err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
+
+func loadRetryPolicyFromEnv(policy RetryPolicy) (RetryPolicy, error) {
+	var err error
+	policy.MaxAttempts, err = intFromEnv("CT_RETRY_MAX_ATTEMPTS", policy.MaxAttempts)
+	if err != nil {
+		return policy, err
+	}
+	if policy.MaxAttempts == 0 {
+		return policy, errors.New("CT_RETRY_MAX_ATTEMPTS must be at least 1")
+	}
+
+	policy.InitialBackoff, err = durationFromEnv("CT_RETRY_INITIAL_BACKOFF", policy.InitialBackoff)
+	if err != nil {
+		return policy, err
+	}
+	policy.MaxBackoff, err = durationFromEnv("CT_RETRY_MAX_BACKOFF", policy.MaxBackoff)
+	if err != nil {
+		return policy, err
+	}
+	policy.MaxRetryAfter, err = durationFromEnv("CT_RETRY_MAX_RETRY_AFTER", policy.MaxRetryAfter)
+	if err != nil {
+		return policy, err
+	}
+
+	policy.Jitter, err = floatFromEnv("CT_RETRY_JITTER", policy.Jitter)
+	if err != nil {
+		return policy, err
+	}
+	if policy.Jitter > 1 {
+		return policy, errors.New(fmt.Sprintf("CT_RETRY_JITTER must be between 0 and 1, but was %g", policy.Jitter))
+	}
+
+	if value := os.Getenv("CT_RETRY_STATUSES"); value != "" {
+		policy.RetryableStatuses, err = parseRetryableStatuses(value)
+		if err != nil {
+			return policy, errors.New(fmt.Sprintf("CT_RETRY_STATUSES is invalid: %s", err.Error()))
+		}
+	}
+
+	return policy, nil
+}
+
+func loadCircuitBreakerPolicyFromEnv(policy CircuitBreakerPolicy) (CircuitBreakerPolicy, error) {
+	var err error
+	policy.FailureThreshold, err = intFromEnv("CT_BREAKER_FAILURE_THRESHOLD", policy.FailureThreshold)
+	if err != nil {
+		return policy, err
+	}
+
+	policy.OpenTimeout, err = durationFromEnv("CT_BREAKER_OPEN_TIMEOUT", policy.OpenTimeout)
+	if err != nil {
+		return policy, err
+	}
+
+	policy.HalfOpenSuccesses, err = intFromEnv("CT_BREAKER_HALF_OPEN_SUCCESSES", policy.HalfOpenSuccesses)
+	if err != nil {
+		return policy, err
+	}
+	if policy.HalfOpenSuccesses == 0 {
+		return policy, errors.New("CT_BREAKER_HALF_OPEN_SUCCESSES must be at least 1")
+	}
+
+	return policy, nil
+}
+
+func stringFromEnv(name string, defaultValue string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	return value
+}
+
+// Durations use Go's duration format, such as "24h" or "90s"
+func durationFromEnv(name string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return defaultValue, errors.New(fmt.Sprintf("%s must be a positive duration such as \"24h\", but was \"%s\"",
+			name, value))
+	}
+
+	return duration, nil
+}
+
+func intFromEnv(name string, defaultValue int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		return defaultValue, errors.New(fmt.Sprintf("%s must be a positive whole number, but was \"%s\"",
+			name, value))
+	}
+
+	return number, nil
+}
+
+func boolFromEnv(name string, defaultValue bool) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	boolean, err := strconv.ParseBool(value)
+	if err != nil {
+		return defaultValue, errors.New(fmt.Sprintf("%s must be true or false, but was \"%s\"", name, value))
+	}
+
+	return boolean, nil
+}
+
+func floatFromEnv(name string, defaultValue float64) (float64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return defaultValue, errors.New(fmt.Sprintf("%s must be a positive number, but was \"%s\"", name, value))
+	}
+
+	return number, nil
+}
@@ -0,0 +1,166 @@
+package clustertruck
+
+import (
+	"testing"
+	"net/http"
+	"bytes"
+	"strings"
+	"time"
+	"context"
+	"net/http/httptest"
+	"io/ioutil"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+)
+
+// Same as createClientWithRoutesToEveryKitchen, but requests for directions to Denver never get a response
+func createClientWithoutAnswerFromDenver() *MockClient {
+	clientWithRoutes := createClientWithRoutesToEveryKitchen()
+	return &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			if strings.Contains(req.URL.String(), "Denver") {
+				<-req.Context().Done()
+				return nil, req.Context().Err()
+			}
+			return clientWithRoutes.Do(req)
+		},
+	}
+}
+
+// Same as createClientWithoutAnswerFromDenver, but also returns a channel that is closed once every other kitchen
+// has answered, so a test can run out of time right after that, instead of after some wall-clock time
+func createClientWithOnlyDenverPending() (*MockClient, <-chan struct{}) {
+	client := createClientWithoutAnswerFromDenver()
+	doFunc := client.DoFunc
+	othersAnswered := make(chan struct{})
+	var answers int32
+	client.DoFunc = func(req *http.Request) (*http.Response, error) {
+		res, err := doFunc(req)
+		if strings.Contains(req.URL.Path, "directions") && atomic.AddInt32(&answers, 1) == 5 {
+			close(othersAnswered)
+		}
+		return res, err
+	}
+
+	return client, othersAnswered
+}
+
+// A context whose deadline passes when the test expires it
+type expiringContext struct {
+	context.Context
+	done       chan struct{}
+	expireOnce sync.Once
+}
+
+func newExpiringContext() *expiringContext {
+	return &expiringContext{Context: context.Background(), done: make(chan struct{})}
+}
+
+func (c *expiringContext) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *expiringContext) Err() error {
+	select {
+	case <-c.done:
+		return context.DeadlineExceeded
+	default:
+		return nil
+	}
+}
+
+func (c *expiringContext) expire() {
+	c.expireOnce.Do(func() { close(c.done) })
+}
+
+// Expires the context once the channel is closed
+func (c *expiringContext) expireAfter(ch <-chan struct{}) {
+	go func() {
+		<-ch
+		c.expire()
+	}()
+}
+
+func TestFindDriveTimeReturnsPendingKitchensAfterDeadline(t *testing.T) {
+	client, othersAnswered := createClientWithOnlyDenverPending()
+	service := createDriveTimeServiceForTest(client, "2017-12-04 12:00")
+	service.config.GoogleMapsTimeout = 0
+
+	ctx := newExpiringContext()
+	ctx.expireAfter(othersAnswered)
+	_, err := service.findDriveTimeToClosestClusterTruckKitchen(ctx,
+		RequestPayload{StartingAddress: "startingAddress"})
+
+	apiError := err.(*APIError)
+	assertResult(t, ErrorCodeRequestTimeout, apiError.Code)
+	assertResult(t, http.StatusGatewayTimeout, apiError.StatusCode())
+	assertResult(t, "the request took too long to complete, 1 of the 6 kitchens did not answer in time",
+		apiError.Message)
+	pendingKitchens := apiError.Parameters["pending_kitchens"].([]PendingKitchen)
+	assertResult(t, 1, len(pendingKitchens))
+	assertResult(t, "Denver", pendingKitchens[0].Name)
+}
+
+func TestFindDriveTimeSkipsKitchensAfterUpstreamTimeout(t *testing.T) {
+	config := DefaultConfig()
+	config.KitchenEligibility = EligibilityIncludeAll
+	config.GoogleMapsTimeout = 20 * time.Millisecond
+	service := NewDriveTimeService(createClientWithoutAnswerFromDenver(), config)
+
+	closestClusterTruckInfo, err := service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{StartingAddress: "startingAddress"})
+	assertResult(t, nil, err)
+	assertResult(t, "Downtown Columbus", closestClusterTruckInfo.LocationName)
+
+	var denver *ExcludedKitchen
+	for i := range closestClusterTruckInfo.ExcludedKitchens {
+		if closestClusterTruckInfo.ExcludedKitchens[i].Name == "Denver" {
+			denver = &closestClusterTruckInfo.ExcludedKitchens[i]
+		}
+	}
+	assertResult(t, exclusionReasonUpstreamError, denver.Reason)
+	assertResult(t, ErrorCodeUpstreamTimeout, denver.Error.Code)
+}
+
+func TestKitchenStoreStopsWaitingWhenContextIsDone(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	client := &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			<-release
+			return createHttpResponseForTest(http.StatusOK, bytes.NewBufferString("[]")), nil
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := NewKitchenStore(client, DefaultConfig().KitchensAPIURL, time.Hour, 0).Kitchens(ctx)
+	assertResult(t, ErrorCodeRequestCanceled, errorCode(err))
+}
+
+func TestAPIReturnsGatewayTimeoutWithPendingKitchens(t *testing.T) {
+	config := DefaultConfig()
+	config.KitchenEligibility = EligibilityIncludeAll
+	config.RequestTimeout = time.Hour
+	client, othersAnswered := createClientWithOnlyDenverPending()
+	api := SetupAPI(client, config)
+	recorder := httptest.NewRecorder()
+
+	ctx := newExpiringContext()
+	ctx.expireAfter(othersAnswered)
+	request := httptest.NewRequest("POST", "/api/drive-time",
+		noopCloser{bytes.NewBufferString(`{"address": "Martinsville, IN"}`)}).WithContext(ctx)
+	request.Header.Add("Access-Key", "JVvlYlqTBwhs2yu8")
+
+	api.ServeHTTP(recorder, request)
+
+	assertResult(t, http.StatusGatewayTimeout, recorder.Code)
+
+	result, _ := ioutil.ReadAll(recorder.Result().Body)
+	var response HTTPError
+	json.Unmarshal(result, &response)
+	assertResult(t, ErrorCodeRequestTimeout, response.Code)
+	pendingKitchens := response.Parameters["pending_kitchens"].([]interface{})
+	assertResult(t, "Denver", pendingKitchens[0].(map[string]interface{})["name"].(string))
+}
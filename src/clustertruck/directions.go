@@ -5,23 +5,44 @@ import (
 	"net/http"
 	"io/ioutil"
 	"encoding/json"
-	"os"
 	"sync"
 	"math"
 	"fmt"
+	"errors"
+	"context"
+	"time"
 )
 
-// Contains data returned from a call to the GMaps Directions API
-// The GMaps Directions API returns a lot more data, but we ignore the unused portions.
-type GMapsDirections struct {
-	Routes []Route `json:"routes"`
-	Status string  `json:"status"`
+// Names of the supported directions providers, used to select one in the configuration
+const (
+	DirectionsProviderGoogle = "google"
+	DirectionsProviderOSRM   = "osrm"
+)
+
+// Gets driving routes between two places. Routes are returned in a provider neutral format,
+// so the rest of the service doesn't need to know which provider is used.
+type DirectionsProvider interface {
+	// Name of the provider, such as "google" or "osrm"
+	Name() string
+	GetDirections(ctx context.Context, origin Waypoint, destination Waypoint, options TravelOptions) ([]Route,
+		error)
+}
+
+// A place that directions start or end at. Providers use whichever representation they support.
+type Waypoint struct {
+	Address string
+	// GMaps place ID. Only used if there is no address
+	PlaceID string
+	// Nil if the coordinates are not known
+	Coordinates *Coordinates
 }
 
 type Route struct {
 	// A leg represents a section of the route, between two waypoints
 	// For a route with no waypoints (i.e. only start and end points), there will only be 1 leg
 	Legs []Leg `json:"legs"`
+	// Short description of the route, such as the main roads it uses
+	Summary string `json:"summary"`
 }
 
 type Leg struct {
@@ -29,6 +50,18 @@ type Leg struct {
 	Distance MeasurementValues `json:"distance"`
 	// Display value is in hours and minutes. Internal representation is in SECONDS
 	Duration MeasurementValues `json:"duration"`
+	// Same as the duration, but taking traffic into account. Only set if a departure time was given,
+	// and the provider supports traffic
+	DurationInTraffic *MeasurementValues `json:"duration_in_traffic,omitempty"`
+	// Turn by turn instructions. Not every provider returns these
+	Steps []Step `json:"steps,omitempty"`
+}
+
+type Step struct {
+	// Instructions for the step, formatted as HTML
+	Instructions string            `json:"html_instructions"`
+	Distance     MeasurementValues `json:"distance"`
+	Duration     MeasurementValues `json:"duration"`
 }
 
 // Contains data about a measurement, such as distance or time.
@@ -39,89 +72,195 @@ type MeasurementValues struct {
 	Value int `json:"value"`
 }
 
-func getGoogleMapsDirections(httpClient HttpClient, origin string, destination string,
-	kitchenId string, output chan<- *KitchenIDDirectionsPair, waitGroup *sync.WaitGroup) {
+// Contains data returned from a call to the GMaps Directions API
+// The GMaps Directions API returns a lot more data, but we ignore the unused portions.
+type GMapsDirections struct {
+	Routes []Route `json:"routes"`
+	Status string  `json:"status"`
+}
 
-	defer waitGroup.Done()
+// Gets directions from the GMaps Directions API
+type GoogleDirectionsProvider struct {
+	httpClient HttpClient
+	baseURL    string
+	apiKey     string
+	timeout    time.Duration
+}
+
+func NewGoogleDirectionsProvider(httpClient HttpClient, config Config) *GoogleDirectionsProvider {
+	return &GoogleDirectionsProvider{
+		httpClient: httpClient,
+		baseURL:    config.GoogleMapsURL,
+		apiKey:     config.GoogleMapsAPIKey,
+		timeout:    config.GoogleMapsTimeout,
+	}
+}
+
+// Selects the directions provider set in the configuration
+func NewDirectionsProvider(httpClient HttpClient, config Config) DirectionsProvider {
+	if config.DirectionsProvider == DirectionsProviderOSRM {
+		return NewOSRMDirectionsProvider(httpClient, config)
+	}
+
+	return NewGoogleDirectionsProvider(httpClient, config)
+}
+
+func (p *GoogleDirectionsProvider) Name() string {
+	return DirectionsProviderGoogle
+}
+
+func (p *GoogleDirectionsProvider) GetDirections(ctx context.Context, origin Waypoint, destination Waypoint,
+	options TravelOptions) ([]Route, error) {
 
-	apiKey := os.Getenv("CT_GMAPS_API_KEY")
-	requestUrl := url.URL{
-		Scheme: "https",
-		Path:   "maps.googleapis.com/maps/api/directions/json",
+	requestUrl, err := url.Parse(p.baseURL + "/maps/api/directions/json")
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("There was an error creating a request to get direction info: %s",
+			err.Error()))
 	}
 	parameters := url.Values{}
-	parameters.Add("key", apiKey)
-	parameters.Add("origin", origin)
-	parameters.Add("destination", destination)
+	parameters.Add("key", p.apiKey)
+	parameters.Add("origin", googleMapsLocation(origin))
+	parameters.Add("destination", googleMapsLocation(destination))
 	parameters.Add("alternatives", "true")
+	addGoogleMapsTravelOptions(parameters, options)
 	requestUrl.RawQuery = parameters.Encode()
 
 	req, err := http.NewRequest("GET", requestUrl.String(), nil)
 	if err != nil {
-		output <- &KitchenIDDirectionsPair{
-			Error: fmt.Sprintf("There was an error creating a request to get direction info: %s", err.Error()),
-		}
-		return
+		return nil, errors.New(fmt.Sprintf("There was an error creating a request to get direction info: %s",
+			err.Error()))
 	}
 
-	res, err := httpClient.Do(req)
-	defer res.Body.Close()
+	ctx, cancel := contextWithUpstreamTimeout(ctx, p.timeout)
+	defer cancel()
+	res, err := p.httpClient.Do(req.WithContext(ctx))
 	if err != nil {
-		output <- &KitchenIDDirectionsPair{
-			Error: fmt.Sprintf("There was an error performing a request to the GMaps Directions API: %s",
-				err.Error()),
-		}
-		return
+		return nil, upstreamTransportError(upstreamGoogleDirections, "There was an error performing a request to the GMaps "+
+			"Directions API", err)
+	}
+	defer res.Body.Close()
+
+	if isUpstreamFailureStatus(res.StatusCode) {
+		return nil, upstreamHTTPStatusError(upstreamGoogleDirections, res.StatusCode)
 	}
 
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		output <- &KitchenIDDirectionsPair{
-			Error: fmt.Sprintf("There was an error reading the response from the GMaps Directions API: %s",
-				err.Error()),
-		}
-		return
+		return nil, upstreamRequestError(upstreamGoogleDirections, "There was an error reading the response from the GMaps "+
+			"Directions API", err)
 	}
 
 	var directions GMapsDirections
 	err = json.Unmarshal(body, &directions)
 	if err != nil {
+		return nil, upstreamRequestError(upstreamGoogleDirections, "There was an error deserializing the response from the "+
+			"GMaps Directions API", err)
+	}
+
+	if directions.Status != "OK" {
+		return nil, googleMapsStatusError(upstreamGoogleDirections, directions.Status,
+			fmt.Sprintf("Status of GMaps Directions API response was %s", directions.Status))
+	}
+
+	return directions.Routes, nil
+}
+
+func addGoogleMapsTravelOptions(parameters url.Values, options TravelOptions) {
+	if options.usesTraffic() {
+		parameters.Add("departure_time", options.googleMapsDepartureTime())
+		parameters.Add("traffic_model", options.TrafficModel)
+	}
+}
+
+// GMaps APIs accept an address, a place ID prefixed with "place_id:", or coordinates in "lat,lng" format
+func googleMapsLocation(waypoint Waypoint) string {
+	if waypoint.Address == "" && waypoint.PlaceID != "" {
+		return "place_id:" + waypoint.PlaceID
+	}
+	if waypoint.Address == "" && waypoint.Coordinates != nil {
+		return fmt.Sprintf("%f,%f", waypoint.Coordinates.Lat, waypoint.Coordinates.Lng)
+	}
+
+	return waypoint.Address
+}
+
+// Gets directions from the given provider, keeps them in the cache, and sends them to the output channel.
+// If the context is done before the directions are found, the context error is sent instead.
+func getDirections(ctx context.Context, provider DirectionsProvider, cache *DirectionsCache, origin Waypoint,
+	kitchen Kitchen, options TravelOptions, output chan<- *KitchenIDDirectionsPair, waitGroup *sync.WaitGroup) {
+
+	defer waitGroup.Done()
+
+	// The call may have waited in the queue of the worker pool for longer than the user was willing to wait
+	if ctx.Err() != nil {
 		output <- &KitchenIDDirectionsPair{
-			Error: fmt.Sprintf("There was an error deserializing the response from the GMaps Directions API: %s",
-				err.Error()),
+			ID:    kitchen.ID,
+			Error: contextError(ctx),
 		}
 		return
 	}
 
-	if directions.Status != "OK" {
+	location := kitchen.Location
+	startedAt := time.Now()
+	routes, err := provider.GetDirections(ctx, origin,
+		Waypoint{Address: kitchen.Address, Coordinates: &location}, options)
+	latency := time.Since(startedAt)
+	cacheKey := newDirectionsCacheKey(RoutingModeDirections, provider.Name(), origin, kitchen.ID, options)
+	if ctx.Err() == nil {
+		cache.Add(cacheKey, routes, err)
+		if staleRoutes, stale := fallBackToStaleDirections(cache, cacheKey, err); stale {
+			output <- &KitchenIDDirectionsPair{
+				ID:      kitchen.ID,
+				Routes:  staleRoutes,
+				Latency: latency,
+				Stale:   true,
+			}
+			return
+		}
+	}
+	if err != nil {
 		output <- &KitchenIDDirectionsPair{
-			Error: fmt.Sprintf("Status of GMaps Directions API response was %s", directions.Status),
+			ID:      kitchen.ID,
+			Error:   errorOrContextError(ctx, err),
+			Latency: latency,
 		}
 		return
 	}
 
 	output <- &KitchenIDDirectionsPair{
-		ID:         kitchenId,
-		Directions: &directions,
+		ID:      kitchen.ID,
+		Routes:  routes,
+		Latency: latency,
 	}
 }
 
-func findShortestRouteByDriveTime(routes []Route) *Route {
-	shortestDriveTimeRoute := Route{
-		Legs: []Leg{
-			{
-				Duration: MeasurementValues{
-					Value: math.MaxInt32,
-				},
-			},
-		},
+// Formats a duration in seconds the way the GMaps Directions API does, such as "1 hour 5 mins"
+func formatDuration(seconds int) string {
+	minutes := int(math.Floor(float64(seconds)/60 + 0.5))
+	hours := minutes / 60
+	minutes = minutes % 60
+
+	text := ""
+	if hours == 1 {
+		text = "1 hour"
+	} else if hours > 1 {
+		text = fmt.Sprintf("%d hours", hours)
 	}
-	for _, route := range routes {
-		driveTime := route.Legs[0].Duration.Value
-		if driveTime < shortestDriveTimeRoute.Legs[0].Duration.Value {
-			shortestDriveTimeRoute = route
-		}
+
+	if hours > 0 && minutes == 0 {
+		return text
+	} else if hours > 0 {
+		text += " "
 	}
 
-	return &shortestDriveTimeRoute
+	if minutes == 1 {
+		return text + "1 min"
+	}
+
+	return text + fmt.Sprintf("%d mins", minutes)
+}
+
+// Formats a distance in meters in miles, such as "20.5 mi"
+func formatDistance(meters int) string {
+	return fmt.Sprintf("%.1f mi", float64(meters)/1609.344)
 }
@@ -0,0 +1,290 @@
+package clustertruck
+
+import (
+	"container/list"
+	"sync"
+	"time"
+	"strings"
+	"fmt"
+)
+
+// Traffic changes quickly, so results for users leaving "now" are not kept for longer than this
+const directionsCacheTrafficTTL = 5 * time.Minute
+
+// Values of the "cache" metadata of responses
+const (
+	cacheStatusHit     = "hit"
+	cacheStatusMiss    = "miss"
+	cacheStatusPartial = "partial"
+)
+
+// Keeps the results of calls to the directions provider, so users asking from the same starting address
+// don't wait for the same calls again. Once the cache is full, the least recently used results are removed.
+//
+// Starting addresses that could not be found are kept as well, for a shorter time, so the provider isn't asked
+// about the same invalid address over and over. Other errors are never kept, since they are likely to be temporary.
+//
+// Expired routes stay in the cache until they are replaced or removed, so they can still be served while the
+// circuit breaker of the directions provider is open.
+type DirectionsCache struct {
+	maxEntries  int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	mutex       sync.Mutex
+	// Most recently used entries are at the front
+	entries *list.List
+	keys    map[directionsCacheKey]*list.Element
+	now     func() time.Time
+
+	// Metrics
+	hits      int64
+	misses    int64
+	evictions int64
+	staleHits int64
+}
+
+// Identifies the result of a single call to the directions provider
+type directionsCacheKey struct {
+	// RoutingModeDirections or RoutingModeDistanceMatrix. Distance matrix results don't have steps,
+	// so they can't be used for directions
+	RoutingMode string
+	Provider    string
+	// Normalized starting address, or the place ID or coordinates if there is no address
+	Origin    string
+	KitchenID string
+	// Empty if traffic isn't taken into account
+	TravelOptions string
+}
+
+type directionsCacheEntry struct {
+	key       directionsCacheKey
+	routes    []Route
+	err       error
+	expiresAt time.Time
+}
+
+// Reports the state of the directions cache
+type DirectionsCacheMetrics struct {
+	Entries   int   `json:"entries"`
+	Capacity  int   `json:"capacity"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	// Number of expired routes served because the circuit breaker of the directions provider was open
+	StaleHits int64 `json:"stale_hits"`
+}
+
+// Keeps at most maxEntries results, for the given time. A maxEntries of 0 disables the cache.
+func NewDirectionsCache(maxEntries int, ttl time.Duration, negativeTTL time.Duration) *DirectionsCache {
+	return &DirectionsCache{
+		maxEntries:  maxEntries,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     list.New(),
+		keys:        make(map[directionsCacheKey]*list.Element),
+		now:         time.Now,
+	}
+}
+
+func newDirectionsCacheKey(routingMode string, provider string, origin Waypoint, kitchenId string,
+	options TravelOptions) directionsCacheKey {
+
+	return directionsCacheKey{
+		RoutingMode:   routingMode,
+		Provider:      provider,
+		Origin:        normalizeOrigin(origin),
+		KitchenID:     kitchenId,
+		TravelOptions: travelOptionsCacheKey(options),
+	}
+}
+
+// Addresses are compared without case, and with whitespace collapsed, so "123 Main St" and " 123  main st"
+// share results
+func normalizeOrigin(origin Waypoint) string {
+	if origin.Address == "" && origin.PlaceID != "" {
+		return "place_id:" + origin.PlaceID
+	}
+	if origin.Address == "" && origin.Coordinates != nil {
+		return fmt.Sprintf("%.5f,%.5f", origin.Coordinates.Lat, origin.Coordinates.Lng)
+	}
+
+	address := strings.ToLower(strings.Join(strings.Fields(origin.Address), " "))
+	return strings.TrimRight(strings.Replace(address, " ,", ",", -1), ".")
+}
+
+func travelOptionsCacheKey(options TravelOptions) string {
+	if !options.usesTraffic() {
+		return ""
+	}
+	if options.DepartNow {
+		return fmt.Sprintf("%s/%s", departureTimeNow, options.TrafficModel)
+	}
+
+	return fmt.Sprintf("%d/%s", options.DepartureTime.Unix(), options.TrafficModel)
+}
+
+// Returns the cached routes or error, and whether there was an unexpired entry for the key
+func (c *DirectionsCache) Get(key directionsCacheKey) ([]Route, error, bool) {
+	if c.maxEntries == 0 {
+		return nil, nil, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, found := c.keys[key]
+	if !found || c.now().After(element.Value.(*directionsCacheEntry).expiresAt) {
+		c.misses++
+		return nil, nil, false
+	}
+
+	c.hits++
+	c.entries.MoveToFront(element)
+	entry := element.Value.(*directionsCacheEntry)
+	return entry.routes, entry.err, true
+}
+
+// Returns the cached routes for the key even if they expired, and whether there were any. Cached errors are
+// not returned.
+func (c *DirectionsCache) GetStale(key directionsCacheKey) ([]Route, bool) {
+	if c.maxEntries == 0 {
+		return nil, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, found := c.keys[key]
+	if !found || element.Value.(*directionsCacheEntry).err != nil {
+		return nil, false
+	}
+
+	c.staleHits++
+	return element.Value.(*directionsCacheEntry).routes, true
+}
+
+// Keeps the result of a call to the directions provider. Errors are only kept if the starting address
+// could not be found.
+func (c *DirectionsCache) Add(key directionsCacheKey, routes []Route, err error) {
+	if c.maxEntries == 0 {
+		return
+	}
+
+	ttl := c.ttl
+	if err != nil {
+		if errorCode(err) != ErrorCodeAddressNotFound {
+			return
+		}
+		ttl = c.negativeTTL
+	}
+	if strings.HasPrefix(key.TravelOptions, departureTimeNow) && ttl > directionsCacheTrafficTTL {
+		ttl = directionsCacheTrafficTTL
+	}
+	if ttl == 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry := &directionsCacheEntry{
+		key:       key,
+		routes:    routes,
+		err:       err,
+		expiresAt: c.now().Add(ttl),
+	}
+	if element, found := c.keys[key]; found {
+		element.Value = entry
+		c.entries.MoveToFront(element)
+		return
+	}
+
+	c.keys[key] = c.entries.PushFront(entry)
+	for c.entries.Len() > c.maxEntries {
+		oldest := c.entries.Back()
+		c.entries.Remove(oldest)
+		delete(c.keys, oldest.Value.(*directionsCacheEntry).key)
+		c.evictions++
+	}
+}
+
+// Removes the entries of the given starting point and kitchen. The starting point is matched the same way it's
+// added, so it can be an address, a place ID or coordinates. An empty starting point or kitchen ID matches every
+// starting point or kitchen. Returns the number of entries removed.
+func (c *DirectionsCache) Purge(origin Waypoint, kitchenId string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	anyOrigin := origin == Waypoint{}
+	normalizedOrigin := normalizeOrigin(origin)
+	purged := 0
+	for key, element := range c.keys {
+		if (anyOrigin || key.Origin == normalizedOrigin) && (kitchenId == "" || key.KitchenID == kitchenId) {
+			c.entries.Remove(element)
+			delete(c.keys, key)
+			purged++
+		}
+	}
+
+	return purged
+}
+
+func (c *DirectionsCache) Metrics() DirectionsCacheMetrics {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return DirectionsCacheMetrics{
+		Entries:   c.entries.Len(),
+		Capacity:  c.maxEntries,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		StaleHits: c.staleHits,
+	}
+}
+
+// Summarizes how many of the kitchens were found in the cache, for the metadata of a response
+func cacheStatus(hits int, misses int) string {
+	if misses == 0 {
+		return cacheStatusHit
+	} else if hits == 0 {
+		return cacheStatusMiss
+	}
+
+	return cacheStatusPartial
+}
+
+// Used when the directions provider did not answer because its circuit breaker is open. Returns the routes
+// last cached for the key instead of the error, even if they expired, and whether they were used.
+func fallBackToStaleDirections(cache *DirectionsCache, key directionsCacheKey, err error) ([]Route, bool) {
+	if errorCode(err) != ErrorCodeUpstreamCircuitOpen {
+		return nil, false
+	}
+
+	return cache.GetStale(key)
+}
+
+// Sends the cached directions to each kitchen to the output channel, and returns the kitchens that
+// are not cached
+func sendCachedDirections(cache *DirectionsCache, routingMode string, provider string, origin Waypoint,
+	options TravelOptions, kitchens map[string]Kitchen,
+	output chan<- *KitchenIDDirectionsPair) map[string]Kitchen {
+
+	uncachedKitchens := make(map[string]Kitchen)
+	for kitchenId, kitchen := range kitchens {
+		routes, err, found := cache.Get(newDirectionsCacheKey(routingMode, provider, origin, kitchenId, options))
+		if !found {
+			uncachedKitchens[kitchenId] = kitchen
+			continue
+		}
+
+		output <- &KitchenIDDirectionsPair{
+			ID:     kitchenId,
+			Routes: routes,
+			Error:  err,
+			Cached: true,
+		}
+	}
+
+	return uncachedKitchens
+}
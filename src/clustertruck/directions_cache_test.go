@@ -0,0 +1,189 @@
+package clustertruck
+
+import (
+	"testing"
+	"time"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"context"
+	"io/ioutil"
+	"encoding/json"
+	"os"
+)
+
+func createDirectionsCacheForTest(maxEntries int, now *time.Time) *DirectionsCache {
+	cache := NewDirectionsCache(maxEntries, time.Hour, time.Minute)
+	cache.now = func() time.Time { return *now }
+
+	return cache
+}
+
+func createDirectionsCacheKeyForTest(address string, kitchenId string) directionsCacheKey {
+	return newDirectionsCacheKey(RoutingModeDirections, DirectionsProviderGoogle, Waypoint{Address: address},
+		kitchenId, TravelOptions{})
+}
+
+// Counts the calls made to the directions provider
+func createCountingClientWithRoutesToEveryKitchen(directionsCalls *int32) *MockClient {
+	client := createClientWithRoutesToEveryKitchen()
+	doFunc := client.DoFunc
+	client.DoFunc = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "directions") {
+			atomic.AddInt32(directionsCalls, 1)
+		}
+		return doFunc(req)
+	}
+
+	return client
+}
+
+func TestDirectionsCacheRemovesLeastRecentlyUsedEntries(t *testing.T) {
+	now := time.Now()
+	cache := createDirectionsCacheForTest(2, &now)
+	routes := []Route{{Summary: "I-65"}}
+
+	cache.Add(createDirectionsCacheKeyForTest("a", "1"), routes, nil)
+	cache.Add(createDirectionsCacheKeyForTest("a", "2"), routes, nil)
+	cache.Get(createDirectionsCacheKeyForTest("a", "1"))
+	cache.Add(createDirectionsCacheKeyForTest("a", "3"), routes, nil)
+
+	_, _, found := cache.Get(createDirectionsCacheKeyForTest("a", "1"))
+	assertResult(t, true, found)
+	_, _, found = cache.Get(createDirectionsCacheKeyForTest("a", "2"))
+	assertResult(t, false, found)
+	_, _, found = cache.Get(createDirectionsCacheKeyForTest("a", "3"))
+	assertResult(t, true, found)
+
+	metrics := cache.Metrics()
+	assertResult(t, 2, metrics.Entries)
+	assertResult(t, int64(1), metrics.Evictions)
+	assertResult(t, int64(3), metrics.Hits)
+	assertResult(t, int64(1), metrics.Misses)
+}
+
+func TestDirectionsCacheExpiresEntries(t *testing.T) {
+	now := time.Now()
+	cache := createDirectionsCacheForTest(10, &now)
+	cache.Add(createDirectionsCacheKeyForTest("a", "1"), []Route{{Summary: "I-65"}}, nil)
+
+	now = now.Add(59 * time.Minute)
+	routes, _, found := cache.Get(createDirectionsCacheKeyForTest("a", "1"))
+	assertResult(t, true, found)
+	assertResult(t, "I-65", routes[0].Summary)
+
+	now = now.Add(2 * time.Minute)
+	_, _, found = cache.Get(createDirectionsCacheKeyForTest("a", "1"))
+	assertResult(t, false, found)
+}
+
+func TestDirectionsCacheKeepsAddressesThatCannotBeFoundForAShortTime(t *testing.T) {
+	now := time.Now()
+	cache := createDirectionsCacheForTest(10, &now)
+	cache.Add(createDirectionsCacheKeyForTest("nowhere", "1"), nil,
+		newAPIError(ErrorCodeAddressNotFound, "not found"))
+	cache.Add(createDirectionsCacheKeyForTest("nowhere", "2"), nil,
+		newAPIError(ErrorCodeUpstreamUnavailable, "unavailable"))
+
+	_, err, found := cache.Get(createDirectionsCacheKeyForTest("nowhere", "1"))
+	assertResult(t, true, found)
+	assertResult(t, ErrorCodeAddressNotFound, errorCode(err))
+	_, _, found = cache.Get(createDirectionsCacheKeyForTest("nowhere", "2"))
+	assertResult(t, false, found)
+
+	now = now.Add(2 * time.Minute)
+	_, _, found = cache.Get(createDirectionsCacheKeyForTest("nowhere", "1"))
+	assertResult(t, false, found)
+}
+
+func TestDirectionsCacheKeysAreNormalized(t *testing.T) {
+	assertResult(t, createDirectionsCacheKeyForTest("123 main st, indianapolis, in", "1"),
+		createDirectionsCacheKeyForTest("  123 Main  St , Indianapolis, IN.", "1"))
+
+	now := newDirectionsCacheKey(RoutingModeDirections, DirectionsProviderGoogle, Waypoint{Address: "a"}, "1",
+		TravelOptions{DepartNow: true, TrafficModel: TrafficModelBestGuess})
+	withoutTraffic := createDirectionsCacheKeyForTest("a", "1")
+	assertResult(t, false, now == withoutTraffic)
+}
+
+func TestDirectionsCachePurgesMatchingEntries(t *testing.T) {
+	now := time.Now()
+	cache := createDirectionsCacheForTest(10, &now)
+	cache.Add(createDirectionsCacheKeyForTest("a", "1"), []Route{}, nil)
+	cache.Add(createDirectionsCacheKeyForTest("a", "2"), []Route{}, nil)
+	cache.Add(createDirectionsCacheKeyForTest("b", "1"), []Route{}, nil)
+
+	assertResult(t, 1, cache.Purge(Waypoint{Address: "A "}, "2"))
+	assertResult(t, 2, cache.Purge(Waypoint{}, "1"))
+	assertResult(t, 0, cache.Metrics().Entries)
+
+	// Starting points without an address are purged by the same key they were added with
+	location := Coordinates{Lat: 39.4278244, Lng: -86.4283333}
+	cache.Add(newDirectionsCacheKey(RoutingModeDirections, DirectionsProviderGoogle, Waypoint{Coordinates: &location},
+		"1", TravelOptions{}), []Route{}, nil)
+	cache.Add(newDirectionsCacheKey(RoutingModeDirections, DirectionsProviderGoogle,
+		Waypoint{PlaceID: "ChIJ1ZpXWxmFbIgRb1m7Y3cmM3E"}, "1", TravelOptions{}), []Route{}, nil)
+	assertResult(t, 1, cache.Purge(Waypoint{Coordinates: &Coordinates{Lat: 39.42782, Lng: -86.42833}}, ""))
+	assertResult(t, 1, cache.Purge(Waypoint{PlaceID: "ChIJ1ZpXWxmFbIgRb1m7Y3cmM3E"}, ""))
+	assertResult(t, 0, cache.Metrics().Entries)
+}
+
+func TestFindDriveTimeUsesCachedDirections(t *testing.T) {
+	var directionsCalls int32
+	service := createDriveTimeServiceForTest(createCountingClientWithRoutesToEveryKitchen(&directionsCalls),
+		"2017-12-04 12:00")
+
+	first, err := service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{StartingAddress: "Martinsville, IN"})
+	assertResult(t, nil, err)
+	assertResult(t, cacheStatusMiss, first.Metadata.Cache)
+	assertResult(t, 6, first.Metadata.CacheMisses)
+	assertResult(t, int32(6), atomic.LoadInt32(&directionsCalls))
+
+	second, err := service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{StartingAddress: " martinsville,  IN "})
+	assertResult(t, nil, err)
+	assertResult(t, cacheStatusHit, second.Metadata.Cache)
+	assertResult(t, 6, second.Metadata.CacheHits)
+	assertResult(t, 0, second.Metadata.DirectionsCalls)
+	assertResult(t, int32(6), atomic.LoadInt32(&directionsCalls))
+	assertResult(t, first.DriveTime, second.DriveTime)
+	assertResult(t, first.LocationName, second.LocationName)
+}
+
+func TestAdminEndpointPurgesDirectionsCache(t *testing.T) {
+	os.Setenv("CT_ADMIN_ACCESS_KEY", "admin")
+	defer os.Unsetenv("CT_ADMIN_ACCESS_KEY")
+
+	api := SetupAPI(createClientWithRoutesToEveryKitchen(), DefaultConfig())
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("DELETE", "/api/admin/directions-cache", nil)
+	request.Header.Add("Admin-Access-Key", "wrong")
+	api.ServeHTTP(recorder, request)
+	assertResult(t, http.StatusUnauthorized, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest("DELETE", "/api/admin/directions-cache?kitchen_id=1", nil)
+	request.Header.Add("Admin-Access-Key", "admin")
+	api.ServeHTTP(recorder, request)
+	assertResult(t, http.StatusOK, recorder.Code)
+
+	result, _ := ioutil.ReadAll(recorder.Result().Body)
+	var response map[string]int
+	json.Unmarshal(result, &response)
+	assertResult(t, 0, response["purged"])
+
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest("DELETE", "/api/admin/directions-cache?location=39.43,-86.43", nil)
+	request.Header.Add("Admin-Access-Key", "admin")
+	api.ServeHTTP(recorder, request)
+	assertResult(t, http.StatusOK, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest("DELETE", "/api/admin/directions-cache?address=a&place_id=b", nil)
+	request.Header.Add("Admin-Access-Key", "admin")
+	api.ServeHTTP(recorder, request)
+	assertResult(t, http.StatusBadRequest, recorder.Code)
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"bytes"
 	"sync"
+	"context"
 )
 
 func TestGetGoogleMapsDirectionsWithSingleRoute(t *testing.T) {
@@ -15,15 +16,11 @@ func TestGetGoogleMapsDirectionsWithSingleRoute(t *testing.T) {
 		},
 	}
 
-	kitchenDirectionsPair := make(chan *KitchenIDDirectionsPair, 1)
-	var waitGroup sync.WaitGroup
-	waitGroup.Add(1)
-	getGoogleMapsDirections(client, "origin", "destination", "kitchenId",
-		kitchenDirectionsPair, &waitGroup)
-	close(kitchenDirectionsPair)
+	routes, _ := NewGoogleDirectionsProvider(client, DefaultConfig()).
+		GetDirections(context.Background(), Waypoint{Address: "origin"}, Waypoint{Address: "destination"}, TravelOptions{})
 
 	expected := "54.2 mi"
-	actual := (<-kitchenDirectionsPair).Directions.Routes[0].Legs[0].Distance.Text
+	actual := routes[0].Legs[0].Distance.Text
 	assertResult(t, expected, actual)
 }
 
@@ -36,20 +33,15 @@ func TestGetGoogleMapsDirectionsWithMultipleRoutes(t *testing.T) {
 		},
 	}
 
-	kitchenDirectionsPair := make(chan *KitchenIDDirectionsPair, 1)
-	var waitGroup sync.WaitGroup
-	waitGroup.Add(1)
-	getGoogleMapsDirections(client, "origin", "destination", "kitchenId",
-		kitchenDirectionsPair, &waitGroup)
-	close(kitchenDirectionsPair)
+	routes, _ := NewGoogleDirectionsProvider(client, DefaultConfig()).
+		GetDirections(context.Background(), Waypoint{Address: "origin"}, Waypoint{Address: "destination"}, TravelOptions{})
 
-	directions := (<-kitchenDirectionsPair).Directions
 	expected := 3
-	actual := len(directions.Routes)
+	actual := len(routes)
 	assertResult(t, expected, actual)
 
 	expected = 4854
-	actual = directions.Routes[1].Legs[0].Duration.Value
+	actual = routes[1].Legs[0].Duration.Value
 	assertResult(t, expected, actual)
 }
 
@@ -60,15 +52,62 @@ func TestGetGoogleMapsDirectionsError(t *testing.T) {
 		},
 	}
 
+	_, err := NewGoogleDirectionsProvider(client, DefaultConfig()).
+		GetDirections(context.Background(), Waypoint{Address: "origin"}, Waypoint{Address: "destination"}, TravelOptions{})
+
+	expected := "There was an error deserializing the response from the GMaps Directions API: " +
+		"invalid character 'i' looking for beginning of value"
+	assertResult(t, expected, err.Error())
+}
+
+func TestGetGoogleMapsDirectionsWithCoordinates(t *testing.T) {
+	mockGmapsResponseData := readMockFile("directions_response_single_route.json")
+	var requestedOrigin string
+	client := &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			requestedOrigin = req.URL.Query().Get("origin")
+			return createHttpResponseForTest(http.StatusOK, bytes.NewBuffer(mockGmapsResponseData)), nil
+		},
+	}
+
+	NewGoogleDirectionsProvider(client, DefaultConfig()).GetDirections(context.Background(),
+		Waypoint{Coordinates: &Coordinates{Lat: 39.4278244, Lng: -86.4283333}}, Waypoint{Address: "destination"},
+		TravelOptions{})
+
+	assertResult(t, "39.427824,-86.428333", requestedOrigin)
+}
+
+func TestGetDirectionsAddsKitchenIdToErrors(t *testing.T) {
+	client := &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			mockGmapsResponseData := readMockFile("directions_response_no_route.json")
+			return createHttpResponseForTest(http.StatusOK, bytes.NewBuffer(mockGmapsResponseData)), nil
+		},
+	}
+
 	kitchenDirectionsPair := make(chan *KitchenIDDirectionsPair, 1)
 	var waitGroup sync.WaitGroup
 	waitGroup.Add(1)
-	getGoogleMapsDirections(client, "origin", "destination", "kitchenId",
+	getDirections(context.Background(), NewGoogleDirectionsProvider(client, DefaultConfig()), NewDirectionsCache(0, 0, 0),
+		Waypoint{Address: "origin"}, Kitchen{ID: "kitchenId", Address: "destination"}, TravelOptions{},
 		kitchenDirectionsPair, &waitGroup)
 	close(kitchenDirectionsPair)
 
-	expected := "There was an error deserializing the response from the GMaps Directions API: " +
-		"invalid character 'i' looking for beginning of value"
-	actual := (<-kitchenDirectionsPair).Error
-	assertResult(t, expected, actual)
+	pair := <-kitchenDirectionsPair
+	assertResult(t, "kitchenId", pair.ID)
+	assertResult(t, "Status of GMaps Directions API response was ZERO_RESULTS", pair.Error.Error())
+	assertResult(t, ErrorCodeNoRoute, errorCode(pair.Error))
+}
+
+func TestFormatDuration(t *testing.T) {
+	assertResult(t, "1 min", formatDuration(50))
+	assertResult(t, "21 mins", formatDuration(1260))
+	assertResult(t, "1 hour", formatDuration(3600))
+	assertResult(t, "1 hour 5 mins", formatDuration(3900))
+	assertResult(t, "2 hours 46 mins", formatDuration(9960))
+}
+
+func TestFormatDistance(t *testing.T) {
+	assertResult(t, "96.2 mi", formatDistance(154775))
+	assertResult(t, "0.0 mi", formatDistance(0))
 }
@@ -0,0 +1,226 @@
+package clustertruck
+
+import (
+	"net/url"
+	"net/http"
+	"io/ioutil"
+	"encoding/json"
+	"strings"
+	"sort"
+	"errors"
+	"fmt"
+	"context"
+	"time"
+)
+
+// Ways of finding the drive time to each kitchen, used to select one in the configuration
+const (
+	// One directions call per kitchen
+	RoutingModeDirections = "directions"
+	// A distance matrix call for up to 25 kitchens at a time, falling back to directions for the closest kitchen
+	// when route details are requested
+	RoutingModeDistanceMatrix = "distance_matrix"
+)
+
+// Gets drive times and distances from one place to many places with a single request.
+// Directions providers that can do this implement this interface as well.
+type DistanceMatrixProvider interface {
+	// Returns one element per destination, in the same order as the destinations
+	GetDistanceMatrix(ctx context.Context, origin Waypoint, destinations []Waypoint,
+		options TravelOptions) ([]DistanceMatrixElement, error)
+}
+
+// Drive time and distance to a single destination
+type DistanceMatrixElement struct {
+	// Nil if there is an error
+	Leg *Leg
+	// An error is added in case there is any
+	Error error
+}
+
+// Contains data returned from a call to the GMaps Distance Matrix API
+// The GMaps Distance Matrix API returns a lot more data, but we ignore the unused portions.
+type GMapsDistanceMatrix struct {
+	Rows   []GMapsDistanceMatrixRow `json:"rows"`
+	Status string                   `json:"status"`
+}
+
+// One row per origin
+type GMapsDistanceMatrixRow struct {
+	// One element per destination
+	Elements []GMapsDistanceMatrixElement `json:"elements"`
+}
+
+type GMapsDistanceMatrixElement struct {
+	Distance          MeasurementValues  `json:"distance"`
+	Duration          MeasurementValues  `json:"duration"`
+	DurationInTraffic *MeasurementValues `json:"duration_in_traffic"`
+	Status            string             `json:"status"`
+}
+
+// Most destinations the GMaps Distance Matrix API accepts in a single request. With a single origin, this also
+// keeps each request under its limit of 100 elements.
+const maxDistanceMatrixDestinations = 25
+
+// Number of requests made to the GMaps Distance Matrix API to get the drive times to this many destinations
+func distanceMatrixRequests(destinations int) int {
+	return (destinations + maxDistanceMatrixDestinations - 1) / maxDistanceMatrixDestinations
+}
+
+// Sends the destinations in chunks of up to maxDistanceMatrixDestinations, one after the other, and merges
+// the elements of every chunk in order. Fails if any of the chunks fails.
+func (p *GoogleDirectionsProvider) GetDistanceMatrix(ctx context.Context, origin Waypoint,
+	destinations []Waypoint, options TravelOptions) ([]DistanceMatrixElement, error) {
+
+	elements := make([]DistanceMatrixElement, 0, len(destinations))
+	for start := 0; start < len(destinations); start += maxDistanceMatrixDestinations {
+		end := start + maxDistanceMatrixDestinations
+		if end > len(destinations) {
+			end = len(destinations)
+		}
+
+		chunkElements, err := p.getDistanceMatrixChunk(ctx, origin, destinations[start:end], options)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, chunkElements...)
+	}
+
+	return elements, nil
+}
+
+func (p *GoogleDirectionsProvider) getDistanceMatrixChunk(ctx context.Context, origin Waypoint,
+	destinations []Waypoint, options TravelOptions) ([]DistanceMatrixElement, error) {
+
+	requestUrl, err := url.Parse(p.baseURL + "/maps/api/distancematrix/json")
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("There was an error creating a request to get distance matrix "+
+			"info: %s", err.Error()))
+	}
+	destinationLocations := make([]string, len(destinations))
+	for i, destination := range destinations {
+		destinationLocations[i] = googleMapsLocation(destination)
+	}
+	parameters := url.Values{}
+	parameters.Add("key", p.apiKey)
+	parameters.Add("origins", googleMapsLocation(origin))
+	parameters.Add("destinations", strings.Join(destinationLocations, "|"))
+	addGoogleMapsTravelOptions(parameters, options)
+	requestUrl.RawQuery = parameters.Encode()
+
+	req, err := http.NewRequest("GET", requestUrl.String(), nil)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("There was an error creating a request to get distance matrix "+
+			"info: %s", err.Error()))
+	}
+
+	ctx, cancel := contextWithUpstreamTimeout(ctx, p.timeout)
+	defer cancel()
+	res, err := p.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, upstreamTransportError(upstreamGoogleDistanceMatrix, "There was an error performing a request to the "+
+			"GMaps Distance Matrix API", err)
+	}
+	defer res.Body.Close()
+
+	if isUpstreamFailureStatus(res.StatusCode) {
+		return nil, upstreamHTTPStatusError(upstreamGoogleDistanceMatrix, res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, upstreamRequestError(upstreamGoogleDistanceMatrix, "There was an error reading the response from the "+
+			"GMaps Distance Matrix API", err)
+	}
+
+	var distanceMatrix GMapsDistanceMatrix
+	err = json.Unmarshal(body, &distanceMatrix)
+	if err != nil {
+		return nil, upstreamRequestError(upstreamGoogleDistanceMatrix, "There was an error deserializing the response from "+
+			"the GMaps Distance Matrix API", err)
+	}
+
+	if distanceMatrix.Status != "OK" {
+		return nil, googleMapsStatusError(upstreamGoogleDistanceMatrix, distanceMatrix.Status,
+			fmt.Sprintf("Status of GMaps Distance Matrix API response was %s", distanceMatrix.Status))
+	}
+	if len(distanceMatrix.Rows) != 1 || len(distanceMatrix.Rows[0].Elements) != len(destinations) {
+		return nil, &APIError{
+			Code: ErrorCodeUpstreamBadResponse,
+			Message: fmt.Sprintf("GMaps Distance Matrix API returned an unexpected number of elements, "+
+				"expected %d", len(destinations)),
+			Upstream: upstreamGoogleDistanceMatrix,
+		}
+	}
+
+	elements := make([]DistanceMatrixElement, len(destinations))
+	for i, element := range distanceMatrix.Rows[0].Elements {
+		if element.Status != "OK" {
+			elements[i].Error = googleMapsStatusError(upstreamGoogleDistanceMatrix, element.Status,
+				fmt.Sprintf("Status of GMaps Distance Matrix API element was %s", element.Status))
+			continue
+		}
+		elements[i].Leg = &Leg{
+			Distance:          element.Distance,
+			Duration:          element.Duration,
+			DurationInTraffic: element.DurationInTraffic,
+		}
+	}
+
+	return elements, nil
+}
+
+// Gets drive times to every kitchen with distance matrix calls, keeps them in the cache, and sends them
+// to the output channel as single route directions, so they can be ranked the same way as directions.
+func getDistanceMatrixForKitchens(ctx context.Context, kitchens map[string]Kitchen, provider DistanceMatrixProvider,
+	providerName string, cache *DirectionsCache, origin Waypoint, options TravelOptions,
+	allPossibleDirections chan *KitchenIDDirectionsPair) {
+
+	defer close(allPossibleDirections)
+
+	kitchenIds := make([]string, 0, len(kitchens))
+	for kitchenId := range kitchens {
+		kitchenIds = append(kitchenIds, kitchenId)
+	}
+	sort.Strings(kitchenIds)
+
+	destinations := make([]Waypoint, len(kitchenIds))
+	for i, kitchenId := range kitchenIds {
+		location := kitchens[kitchenId].Location
+		destinations[i] = Waypoint{Address: kitchens[kitchenId].Address, Coordinates: &location}
+	}
+
+	startedAt := time.Now()
+	elements, err := provider.GetDistanceMatrix(ctx, origin, destinations, options)
+	latency := time.Since(startedAt)
+	if err != nil {
+		err = errorOrContextError(ctx, err)
+	}
+	for i, kitchenId := range kitchenIds {
+		var kitchenIdDirectionsPair *KitchenIDDirectionsPair
+		if err != nil {
+			kitchenIdDirectionsPair = &KitchenIDDirectionsPair{ID: kitchenId, Error: err}
+		} else if elements[i].Leg == nil {
+			kitchenIdDirectionsPair = &KitchenIDDirectionsPair{ID: kitchenId, Error: elements[i].Error}
+		} else {
+			kitchenIdDirectionsPair = &KitchenIDDirectionsPair{
+				ID:     kitchenId,
+				Routes: []Route{{Legs: []Leg{*elements[i].Leg}}},
+			}
+		}
+		kitchenIdDirectionsPair.Latency = latency
+		if ctx.Err() == nil {
+			cacheKey := newDirectionsCacheKey(RoutingModeDistanceMatrix, providerName, origin, kitchenId, options)
+			cache.Add(cacheKey, kitchenIdDirectionsPair.Routes, kitchenIdDirectionsPair.Error)
+			if staleRoutes, stale := fallBackToStaleDirections(cache, cacheKey, kitchenIdDirectionsPair.Error); stale {
+				kitchenIdDirectionsPair = &KitchenIDDirectionsPair{
+					ID:      kitchenId,
+					Routes:  staleRoutes,
+					Latency: latency,
+					Stale:   true,
+				}
+			}
+		}
+		allPossibleDirections <- kitchenIdDirectionsPair
+	}
+}
@@ -0,0 +1,169 @@
+package clustertruck
+
+import (
+	"testing"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+	"context"
+	"fmt"
+	"bytes"
+)
+
+// Fakes the ClusterTruck Kitchens API and the GMaps APIs, counting the calls made to each endpoint
+type fakeUpstreamServer struct {
+	*httptest.Server
+	distanceMatrixCalls int32
+	directionsCalls     int32
+	// Destinations requested in the last distance matrix call
+	matrixDestinations atomic.Value
+}
+
+func newFakeUpstreamServer() *fakeUpstreamServer {
+	fake := &fakeUpstreamServer{}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/api/kitchens":
+			response.Write(readMockFile("kitchen_response.json"))
+		case "/maps/api/geocode/json":
+			response.Write(readMockFile("geocode_response.json"))
+		case "/maps/api/distancematrix/json":
+			atomic.AddInt32(&fake.distanceMatrixCalls, 1)
+			fake.matrixDestinations.Store(request.URL.Query().Get("destinations"))
+			response.Write(readMockFile("distance_matrix_response.json"))
+		case "/maps/api/directions/json":
+			atomic.AddInt32(&fake.directionsCalls, 1)
+			response.Write(readMockFile("directions_response_single_route.json"))
+		default:
+			response.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	return fake
+}
+
+func createDistanceMatrixServiceForTest(fake *fakeUpstreamServer) *DriveTimeService {
+	config := DefaultConfig()
+	config.KitchensAPIURL = fake.URL + "/api/kitchens"
+	config.GoogleMapsURL = fake.URL
+	config.RoutingMode = RoutingModeDistanceMatrix
+	config.KitchenEligibility = EligibilityIncludeAll
+
+	service := NewDriveTimeService(&http.Client{}, config)
+	// Monday at noon, when every kitchen with hours is open
+	now := time.Date(2017, 12, 4, 17, 0, 0, 0, time.UTC)
+	service.now = func() time.Time { return now }
+
+	return service
+}
+
+func TestFindDriveTimeWithDistanceMatrix(t *testing.T) {
+	fake := newFakeUpstreamServer()
+	defer fake.Close()
+
+	closestClusterTruckInfo, err := createDistanceMatrixServiceForTest(fake).
+		findDriveTimeToClosestClusterTruckKitchen(context.Background(), RequestPayload{StartingAddress: "Martinsville, IN"})
+	assertResult(t, nil, err)
+	assertResult(t, "Downtown Indy", closestClusterTruckInfo.LocationName)
+	assertResult(t, 1802, closestClusterTruckInfo.DriveTime.Value)
+	assertResult(t, "18.7 mi", closestClusterTruckInfo.DriveDistance.Text)
+	assertResult(t, true, closestClusterTruckInfo.Route == nil)
+	assertResult(t, "distance_matrix", closestClusterTruckInfo.Metadata.RoutingMode)
+	assertResult(t, 1, closestClusterTruckInfo.Metadata.DirectionsCalls)
+	assertResult(t, 5, closestClusterTruckInfo.Metadata.DirectionsCallsSaved)
+
+	assertResult(t, int32(1), atomic.LoadInt32(&fake.distanceMatrixCalls))
+	assertResult(t, int32(0), atomic.LoadInt32(&fake.directionsCalls))
+	destinations := fake.matrixDestinations.Load().(string)
+	assertResult(t, 6, len(strings.Split(destinations, "|")))
+	assertResult(t, true, strings.HasPrefix(destinations, "729 N. Pennsylvania St., Indianapolis, IN, 46204|"))
+}
+
+func TestFindDriveTimeWithDistanceMatrixAndRouteDetails(t *testing.T) {
+	fake := newFakeUpstreamServer()
+	defer fake.Close()
+
+	closestClusterTruckInfo, _ := createDistanceMatrixServiceForTest(fake).
+		findDriveTimeToClosestClusterTruckKitchen(context.Background(), RequestPayload{
+			StartingAddress: "Martinsville, IN",
+			RouteDetails:    true,
+		})
+	assertResult(t, "Downtown Indy", closestClusterTruckInfo.LocationName)
+	assertResult(t, 1802, closestClusterTruckInfo.DriveTime.Value)
+	assertResult(t, "IN-37 N", closestClusterTruckInfo.Route.Summary)
+	assertResult(t, "Head <b>northeast</b>", closestClusterTruckInfo.Route.Steps[0].Instructions)
+	assertResult(t, 2, closestClusterTruckInfo.Metadata.DirectionsCalls)
+
+	assertResult(t, int32(1), atomic.LoadInt32(&fake.distanceMatrixCalls))
+	assertResult(t, int32(1), atomic.LoadInt32(&fake.directionsCalls))
+}
+
+func TestGetDistanceMatrixWithElementError(t *testing.T) {
+	fake := newFakeUpstreamServer()
+	defer fake.Close()
+
+	config := DefaultConfig()
+	config.GoogleMapsURL = fake.URL
+	destinations := make([]Waypoint, 6)
+	elements, err := NewGoogleDirectionsProvider(&http.Client{}, config).
+		GetDistanceMatrix(context.Background(), Waypoint{Address: "Martinsville, IN"}, destinations, TravelOptions{})
+	assertResult(t, nil, err)
+	assertResult(t, 1867, elements[3].Leg.Duration.Value)
+	assertResult(t, true, elements[5].Leg == nil)
+	assertResult(t, "Status of GMaps Distance Matrix API element was ZERO_RESULTS", elements[5].Error.Error())
+}
+
+func TestGetDistanceMatrixSendsDestinationsInChunks(t *testing.T) {
+	var chunkSizes []int
+	client := &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			// Each destination is a number, which is returned as its drive time
+			destinations := strings.Split(req.URL.Query().Get("destinations"), "|")
+			chunkSizes = append(chunkSizes, len(destinations))
+			elements := make([]string, len(destinations))
+			for i, destination := range destinations {
+				elements[i] = fmt.Sprintf(`{"status": "OK", "duration": {"value": %s}}`, destination)
+			}
+			body := fmt.Sprintf(`{"status": "OK", "rows": [{"elements": [%s]}]}`, strings.Join(elements, ","))
+			return &http.Response{StatusCode: http.StatusOK, Body: noopCloser{strings.NewReader(body)}}, nil
+		},
+	}
+
+	destinations := make([]Waypoint, 60)
+	for i := range destinations {
+		destinations[i] = Waypoint{Address: fmt.Sprintf("%d", i)}
+	}
+	elements, err := NewGoogleDirectionsProvider(client, DefaultConfig()).
+		GetDistanceMatrix(context.Background(), Waypoint{Address: "Martinsville, IN"}, destinations, TravelOptions{})
+	assertResult(t, nil, err)
+	assertResult(t, "[25 25 10]", fmt.Sprint(chunkSizes))
+	assertResult(t, 60, len(elements))
+	for i, element := range elements {
+		assertResult(t, i, element.Leg.Duration.Value)
+	}
+	assertResult(t, 3, distanceMatrixRequests(60))
+}
+
+func TestFindDriveTimeWithDistanceMatrixToSingleKitchenSavesNoCalls(t *testing.T) {
+	client := createClientWithRoutesToEveryKitchenFrom("geocode_response_downtown_indy.json")
+	doFunc := client.DoFunc
+	client.DoFunc = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "distancematrix") {
+			body := `{"status": "OK", "rows": [{"elements": [{"status": "OK", "duration": {"value": 300}}]}]}`
+			return createHttpResponseForTest(http.StatusOK, bytes.NewBufferString(body)), nil
+		}
+		return doFunc(req)
+	}
+	service := createDriveTimeServiceForTest(client, "2017-12-04 12:00")
+	service.config.RoutingMode = RoutingModeDistanceMatrix
+
+	// Only Downtown Indy delivers there, and its route details take a second call
+	closestClusterTruckInfo, err := service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{StartingAddress: "startingAddress", DeliveryAreaOnly: true, RouteDetails: true})
+	assertResult(t, nil, err)
+	assertResult(t, "Downtown Indy", closestClusterTruckInfo.LocationName)
+	assertResult(t, 2, closestClusterTruckInfo.Metadata.DirectionsCalls)
+	assertResult(t, 0, closestClusterTruckInfo.Metadata.DirectionsCallsSaved)
+}
@@ -1,30 +1,260 @@
 package clustertruck
 
 import (
-	"math"
 	"sync"
+	"time"
+	"log"
+	"fmt"
+	"context"
+	"sort"
+	"encoding/json"
 	"errors"
+	"regexp"
+	"strings"
+	"math"
 )
 
+// GMaps place IDs are made of letters, digits, dashes and underscores
+var placeIdPattern = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
 // Represents the request sent by the user
 type RequestPayload struct {
-	// The address given by the user
+	// The address given by the user. Exactly one of the address, location and place ID must be given
 	StartingAddress string `json:"address"`
+	// Coordinates of the starting point, such as the GPS location of a phone
+	Location *RequestLocation `json:"location"`
+	// GMaps place ID of the starting point
+	PlaceID string `json:"place_id"`
+	// Only consider kitchens with a delivery area that contains the starting address
+	DeliveryAreaOnly bool `json:"delivery_area_only"`
+	// Which kitchens to consider, based on whether they are active or online. Uses the server's default if empty
+	Eligibility string `json:"eligibility"`
+	// Include the summary and turn by turn steps of the route to the closest kitchen
+	RouteDetails bool `json:"route_details"`
+	// When the user leaves, either "now" or an RFC 3339 timestamp. Drive times take traffic into account if set
+	DepartureTime string `json:"departure_time"`
+	// Either "best_guess" (default), "pessimistic" or "optimistic". Requires a departure time
+	TrafficModel string `json:"traffic_model"`
+	// Also return up to this many kitchens, ranked from closest to furthest. 0 means only the closest kitchen
+	// is returned
+	Limit int `json:"limit"`
+	// How kitchens and routes are ranked. Uses the server's default if empty
+	Ranking string `json:"ranking"`
+	// Explain why each kitchen was or was not selected
+	Explain bool `json:"explain"`
+	// Return the closest kitchen among those that answered within this many milliseconds, instead of waiting
+	// for every kitchen. 0 means every kitchen is waited for
+	MaxLatencyMillis int `json:"max_latency_ms"`
+}
+
+// Coordinates given by the user. Both are pointers, so a missing coordinate can be told apart from 0.
+type RequestLocation struct {
+	Lat *float64 `json:"lat"`
+	Lng *float64 `json:"lng"`
+}
+
+func newRequestLocation(coordinates Coordinates) *RequestLocation {
+	return &RequestLocation{Lat: &coordinates.Lat, Lng: &coordinates.Lng}
+}
+
+// Checks that both coordinates are given, and that they are on the map
+func (l RequestLocation) validate() error {
+	if l.Lat == nil {
+		return errors.New("location.lat must be given")
+	}
+	if l.Lng == nil {
+		return errors.New("location.lng must be given")
+	}
+
+	if math.IsNaN(*l.Lat) || *l.Lat < -90 || *l.Lat > 90 {
+		return errors.New(fmt.Sprintf("location.lat must be between -90 and 90, but was %g", *l.Lat))
+	}
+	if math.IsNaN(*l.Lng) || *l.Lng < -180 || *l.Lng > 180 {
+		return errors.New(fmt.Sprintf("location.lng must be between -180 and 180, but was %g", *l.Lng))
+	}
+
+	return nil
+}
+
+// Coordinates of the starting point of the request, or nil if it has none. Only valid after the request
+// was validated.
+func (p RequestPayload) coordinates() *Coordinates {
+	if p.Location == nil {
+		return nil
+	}
+
+	return &Coordinates{Lat: *p.Location.Lat, Lng: *p.Location.Lng}
+}
+
+// Checks the starting point and the optional properties of the request
+func (p *RequestPayload) validate() error {
+	err := p.validateStartingPoint()
+	if err != nil {
+		return err
+	}
+
+	if p.Eligibility != "" {
+		_, err := parseEligibilityPolicy(p.Eligibility)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.Ranking != "" {
+		_, err := parseRankingStrategy(p.Ranking)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.Limit < 0 {
+		return errors.New(fmt.Sprintf("limit must be a positive number, but was %d", p.Limit))
+	}
+
+	if p.MaxLatencyMillis < 0 {
+		return errors.New(fmt.Sprintf("max_latency_ms must be a positive number, but was %d", p.MaxLatencyMillis))
+	}
+
+	return validateTravelOptions(p.DepartureTime, p.TrafficModel, time.Now())
+}
+
+func (p *RequestPayload) validateStartingPoint() error {
+	startingPoints := 0
+	for _, given := range []bool{strings.TrimSpace(p.StartingAddress) != "", p.Location != nil, p.PlaceID != ""} {
+		if given {
+			startingPoints++
+		}
+	}
+	if startingPoints == 0 {
+		return errors.New("one of address, location or place_id must be given")
+	} else if startingPoints > 1 {
+		return errors.New("only one of address, location or place_id can be given")
+	}
+
+	if p.Location != nil {
+		err := p.Location.validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.PlaceID != "" && !placeIdPattern.MatchString(p.PlaceID) {
+		return errors.New(fmt.Sprintf("place_id \"%s\" is not a valid GMaps place ID", p.PlaceID))
+	}
+
+	return nil
+}
+
+// Describes the starting point for logs, in the format GMaps APIs accept
+func (p RequestPayload) startingPoint() string {
+	return googleMapsLocation(Waypoint{Address: p.StartingAddress, PlaceID: p.PlaceID, Coordinates: p.coordinates()})
+}
+
+// Requests with the same key have the same result. Starting addresses are normalized the same way as in the
+// directions cache.
+func (p RequestPayload) coalescingKey() string {
+	p.StartingAddress = normalizeOrigin(Waypoint{Address: p.StartingAddress})
+	key, _ := json.Marshal(p)
+
+	return string(key)
 }
 
 type ClosestClusterTruck struct {
-	// Drive time to the closest ClusterTruck Kitchen
+	// Drive time to the closest ClusterTruck Kitchen, in normal traffic conditions
 	DriveTime ResponseMeasurementValues `json:"drive_time"`
+	// Drive time to the closest ClusterTruck Kitchen, taking traffic into account.
+	// Only set if a departure time was given, and the directions provider supports traffic
+	DriveTimeInTraffic *ResponseMeasurementValues `json:"drive_time_in_traffic,omitempty"`
 	// Drive distance to the closest ClusterTruck Kitchen, based on the drive time given above
 	DriveDistance ResponseMeasurementValues `json:"drive_distance"`
 	// Name of the ClusterTruck Kitchen
 	LocationName string `json:"location_name"`
-	// Address input by the user
+	// Address input by the user. If the user gave a location or place ID instead, the address found for it
 	StartAddress string `json:"start_address"`
+	// The starting point, with both its address and coordinates. Not set if it could not be located
+	StartLocation *StartLocation `json:"start_location,omitempty"`
 	// Address of the ClusterTruck Kitchen
 	DestinationAddress string `json:"destination_address"`
+	// Either "open" or "closed", depending on whether the kitchen is open when the user arrives
+	KitchenStatus string `json:"kitchen_status"`
+	// When the user is expected to arrive at the kitchen, in the kitchen's timezone
+	EstimatedArrivalTime *time.Time `json:"estimated_arrival_time,omitempty"`
+	// Next time the kitchen opens after the user arrives. Only set if the kitchen is closed on arrival
+	NextOpeningTime *time.Time `json:"next_opening_time,omitempty"`
+	// Whether the starting address is inside one of the kitchen's delivery areas.
+	// Not set if the starting address could not be geocoded.
+	InDeliveryArea *bool `json:"in_delivery_area,omitempty"`
+	// Name of the delivery area that contains the starting address
+	DeliveryAreaName string `json:"delivery_area_name,omitempty"`
+	// Kitchens that were not considered, such as inactive kitchens
+	ExcludedKitchens []ExcludedKitchen `json:"excluded_kitchens,omitempty"`
+	// Summary and steps of the route to the kitchen. Only set if route details were requested
+	Route *RouteDetails `json:"route,omitempty"`
+	// Kitchens ranked from closest to furthest, starting with the kitchen above. Only set if a limit was given
+	Kitchens []RankedKitchen `json:"kitchens,omitempty"`
+	// Every kitchen that was considered, and why it was or was not selected. Only set if an explanation
+	// was requested
+	Explanation []KitchenExplanation `json:"explanation,omitempty"`
+	// Whether some kitchens did not answer within max_latency_ms, in which case the closest kitchen is the
+	// closest of those that answered
+	Partial bool `json:"partial"`
+	// Kitchens that did not answer within max_latency_ms
+	PendingKitchens []PendingKitchen `json:"pending_kitchens,omitempty"`
+	// Whether the drive times were estimated from the straight-line distance, because the directions provider
+	// failed for every kitchen
+	Estimated bool `json:"estimated"`
+	// Tells how far estimated drive times can be trusted, and why they were estimated. Only set if estimated
+	ConfidenceNote string `json:"confidence_note,omitempty"`
+	// Information about how the response was found
+	Metadata ResponseMetadata `json:"metadata"`
+}
+
+// One of the kitchens returned when a limit is given
+type RankedKitchen struct {
+	// Starts at 1 for the closest kitchen
+	Rank               int                        `json:"rank"`
+	ID                 string                     `json:"id"`
+	LocationName       string                     `json:"location_name"`
+	DestinationAddress string                     `json:"destination_address"`
+	DriveTime          ResponseMeasurementValues  `json:"drive_time"`
+	DriveTimeInTraffic *ResponseMeasurementValues `json:"drive_time_in_traffic,omitempty"`
+	DriveDistance      ResponseMeasurementValues  `json:"drive_distance"`
+	// Either "open" or "closed", depending on whether the kitchen is open when the user arrives
+	KitchenStatus string `json:"kitchen_status"`
+}
+
+type RouteDetails struct {
+	Summary string `json:"summary"`
+	Steps   []Step `json:"steps"`
 }
 
+type ResponseMetadata struct {
+	// Either "directions" or "distance_matrix"
+	RoutingMode string `json:"routing_mode"`
+	// Strategy used to rank kitchens and routes, such as "shortest_time"
+	Ranking RankingStrategy `json:"ranking"`
+	// Number of calls made to the directions provider
+	DirectionsCalls int `json:"directions_calls"`
+	// Number of calls saved, compared to making one directions call per eligible kitchen
+	DirectionsCallsSaved int `json:"directions_calls_saved"`
+	// Either "hit" if the drive time to every kitchen was cached, "miss" if none of them were,
+	// or "partial"
+	Cache string `json:"cache"`
+	// Number of kitchens whose drive time was, or was not, cached
+	CacheHits   int `json:"cache_hits"`
+	CacheMisses int `json:"cache_misses"`
+	// Number of kitchens whose drive time is an expired cached one, because the circuit breaker of the
+	// directions provider is open
+	StaleResults int `json:"stale_results"`
+	// Whether the response was shared with an identical request that was made at the same time
+	Coalesced bool `json:"coalesced"`
+}
+
+const (
+	kitchenStatusOpen   = "open"
+	kitchenStatusClosed = "closed"
+)
+
 type ResponseMeasurementValues struct {
 	// Display value of the measured value
 	Text string `json:"text"`
@@ -34,88 +264,589 @@ type ResponseMeasurementValues struct {
 	Unit string `json:"value_unit"`
 }
 
+// Where the user starts from, located from the address, place ID or coordinates of the request
+type StartLocation struct {
+	// Formatted address found by the GMaps Geocoding API. Not set if no address was found for the coordinates
+	Address string `json:"address,omitempty"`
+	// The coordinates of the request if given, and otherwise the ones found by the GMaps Geocoding API
+	Location Coordinates `json:"location"`
+	PlaceID  string      `json:"place_id,omitempty"`
+}
+
+// A kitchen that did not answer before the deadline of the request
+type PendingKitchen struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
 type KitchenIDDirectionsPair struct {
-	ID         string
-	Directions *GMapsDirections
+	ID     string
+	Routes []Route
 	// An error is added in case there is any
-	Error      string
+	Error error
+	// How long the call to the directions provider took. Shared by every kitchen of a distance matrix call
+	Latency time.Duration
+	// Whether the directions came from the directions cache, in which case no call was made
+	Cached bool
+	// Whether the directions are expired routes from the directions cache, used because the circuit breaker
+	// of the directions provider is open
+	Stale bool
+}
+
+// Finds drive times to ClusterTruck kitchens. A single service is shared by all requests,
+// so kitchen information is only fetched when the kitchen store needs to refresh it.
+type DriveTimeService struct {
+	config             Config
+	kitchenStore       *KitchenStore
+	geocoder           *GoogleGeocoder
+	directionsProvider DirectionsProvider
+	// Shared by every request, so the number of concurrent calls to the directions provider is bounded
+	directionsPool  *DirectionsWorkerPool
+	directionsCache *DirectionsCache
+	// Identical requests made at the same time share a single lookup
+	lookups *callGroup
+	// Wraps the HTTP client of every upstream API, and reports the state of their circuit breakers
+	circuitBreakers *CircuitBreakingHttpClient
+	// Used as the departure time of the user
+	now func() time.Time
+}
+
+func NewDriveTimeService(httpClient HttpClient, config Config) *DriveTimeService {
+	// The circuit breakers wrap the retries, so a call that fails after every retry only counts as one failure
+	circuitBreakers := newCircuitBreakingHttpClientForConfig(httpClient, config)
+	httpClient = circuitBreakers
+	kitchenStore := NewKitchenStore(httpClient, config.KitchensAPIURL, config.KitchenCacheTTL,
+		config.KitchensAPITimeout)
+	directionsCache := NewDirectionsCache(config.DirectionsCacheSize, config.DirectionsCacheTTL,
+		config.DirectionsCacheNegativeTTL)
+
+	return &DriveTimeService{
+		config:             config,
+		kitchenStore:       kitchenStore,
+		geocoder:           NewGoogleGeocoder(httpClient, config),
+		directionsProvider: newCoalescingDirectionsProvider(NewDirectionsProvider(httpClient, config)),
+		directionsPool:     NewDirectionsWorkerPool(config.DirectionsWorkers, config.DirectionsQueueSize),
+		directionsCache:    directionsCache,
+		lookups:            newCallGroup(),
+		circuitBreakers:    circuitBreakers,
+		now:                time.Now,
+	}
+}
+
+// Refreshes the kitchens in the background every CT_KITCHEN_REFRESH_INTERVAL, until the service is closed.
+// Nothing is scheduled until then, so services made for a single test or lookup don't leave tickers behind.
+func (s *DriveTimeService) StartRefreshingKitchens() {
+	if s.config.KitchenRefreshInterval > 0 {
+		s.kitchenStore.StartRefreshing(s.config.KitchenRefreshInterval)
+	}
 }
 
-func findDriveTimeToClosestClusterTruckKitchen(httpClient HttpClient,
-	startingAddress string) (*ClosestClusterTruck, error) {
+// Stops the scheduled kitchen refreshes, and the workers of the service once the calls they were given are done
+func (s *DriveTimeService) Close() {
+	s.kitchenStore.Close()
+	s.directionsPool.Close()
+}
+
+// Identical requests made at the same time share a single lookup. Each request still stops waiting when
+// its own context is done, and the lookup is only canceled once none of the requests are waiting for it.
+// A request that stops waiting while the lookup goes on gets the kitchens that had not answered yet, the same
+// way the lookup itself reports them.
+func (s *DriveTimeService) findDriveTimeToClosestClusterTruckKitchen(ctx context.Context,
+	requestPayload RequestPayload) (*ClosestClusterTruck, error) {
+
+	result, err, coalesced, tracker := s.lookups.doWithState(ctx, requestPayload.coalescingKey(),
+		func() interface{} {
+			return newLookupTracker()
+		},
+		func(ctx context.Context, tracker interface{}) (interface{}, error) {
+			return s.lookUpDriveTimeToClosestClusterTruckKitchen(ctx, requestPayload, tracker.(*lookupTracker), nil)
+		})
+	code := errorCode(err)
+	if ctx.Err() != nil && (code == ErrorCodeRequestTimeout || code == ErrorCodeRequestCanceled) &&
+		!hasPendingKitchens(err) {
+		err = tracker.(*lookupTracker).pendingKitchensError(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The result is shared, so it's copied before it's changed for this request
+	closestClusterTruck := *result.(*ClosestClusterTruck)
+	if requestPayload.StartingAddress != "" {
+		closestClusterTruck.StartAddress = requestPayload.StartingAddress
+	}
+	closestClusterTruck.Metadata.Coalesced = coalesced
+
+	return &closestClusterTruck, nil
+}
 
-	kitchens, err := getClusterTruckKitchenInfo(httpClient)
+// Finds the closest kitchen like findDriveTimeToClosestClusterTruckKitchen, and calls progress each time the
+// directions to a kitchen arrive. Progress is only reported to this request, so the lookup isn't shared with
+// identical requests, but calls to the directions provider still are.
+func (s *DriveTimeService) streamDriveTimeToClosestClusterTruckKitchen(ctx context.Context,
+	requestPayload RequestPayload, progress func(DriveTimeProgress)) (*ClosestClusterTruck, error) {
+
+	return s.lookUpDriveTimeToClosestClusterTruckKitchen(ctx, requestPayload, nil, progress)
+}
+
+// Every call to an upstream API is made with the given context, so they are all canceled when it's done.
+// If the tracker is not nil, it's told which kitchens directions are asked for, and which of them answered.
+// If progress is not nil, it's called each time the directions to a kitchen arrive.
+func (s *DriveTimeService) lookUpDriveTimeToClosestClusterTruckKitchen(ctx context.Context,
+	requestPayload RequestPayload, tracker *lookupTracker,
+	progress func(DriveTimeProgress)) (*ClosestClusterTruck, error) {
+
+	startedAt := time.Now()
+	startingAddress := requestPayload.StartingAddress
+	kitchens, err := s.kitchenStore.Kitchens(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	eligibility := s.config.KitchenEligibility
+	if requestPayload.Eligibility != "" {
+		eligibility = EligibilityPolicy(requestPayload.Eligibility)
+	}
+	kitchens, excludedKitchens := filterEligibleKitchens(kitchens, eligibility)
+	if len(kitchens) == 0 {
+		return nil, newAPIError(ErrorCodeNoKitchens,
+			fmt.Sprintf("none of the ClusterTruck kitchens are eligible under the %s policy", eligibility))
+	}
+
+	// The starting point is only located when something needs it, since it takes a call to the Geocoding API
+	var geocodedOrigin *GeocodingResult
+	locatedFirst := s.locatesStartingPointFirst(requestPayload)
+	if locatedFirst {
+		geocodedOrigin, err = s.locateStartingPoint(ctx, requestPayload)
+		if err != nil {
+			if requestPayload.DeliveryAreaOnly {
+				return nil, wrapError(err, "your starting address could not be located to check delivery areas")
+			}
+			log.Printf("Delivery areas will not be checked for \"%s\": %s\n", requestPayload.startingPoint(),
+				err.Error())
+		}
+	}
+
+	if requestPayload.DeliveryAreaOnly {
+		var kitchensNotDelivering []ExcludedKitchen
+		kitchens, kitchensNotDelivering = findKitchensDeliveringTo(kitchens, geocodedOrigin.Geometry.Location)
+		excludedKitchens = append(excludedKitchens, kitchensNotDelivering...)
+		sortExcludedKitchens(excludedKitchens)
+		if len(kitchens) == 0 {
+			return nil, newAPIError(ErrorCodeNoKitchens,
+				"none of the ClusterTruck kitchens deliver to your starting address")
+		}
+	}
+
+	numberOfCandidates := len(kitchens)
+	if geocodedOrigin != nil {
+		var kitchensTooFar []ExcludedKitchen
+		kitchens, kitchensTooFar = prefilterKitchensByDistance(kitchens, geocodedOrigin.Geometry.Location,
+			s.config.PrefilterTopK, s.config.PrefilterRadiusMiles*metersPerMile)
+		excludedKitchens = append(excludedKitchens, kitchensTooFar...)
+		sortExcludedKitchens(excludedKitchens)
+		if len(kitchens) == 0 {
+			return nil, newAPIError(ErrorCodeNoKitchens, fmt.Sprintf("none of the ClusterTruck kitchens are "+
+				"within %g miles of your starting address", s.config.PrefilterRadiusMiles))
+		}
+	}
+
+	origin := Waypoint{
+		Address:     requestPayload.StartingAddress,
+		PlaceID:     requestPayload.PlaceID,
+		Coordinates: requestPayload.coordinates(),
+	}
+	if geocodedOrigin != nil {
+		origin.Coordinates = &geocodedOrigin.Geometry.Location
+	}
+
+	options := requestPayload.travelOptions()
+	departureTime := options.departureTime(s.now())
+	ranker := s.ranker(requestPayload)
 	kitchenIdToRouteMap := make(map[string]*Route)
+	kitchenIdToErrorMap := make(map[string]error)
+	kitchenIdToDirectionsMap := make(map[string]*KitchenIDDirectionsPair)
 	allPossibleDirections := make(chan *KitchenIDDirectionsPair, len(kitchens))
 
-	getDirectionsConcurrently(kitchens, httpClient, startingAddress, allPossibleDirections)
+	metadata := ResponseMetadata{RoutingMode: RoutingModeDirections, Ranking: ranker.Name()}
+	matrixProvider, supportsDistanceMatrix := s.directionsProvider.(DistanceMatrixProvider)
+	if s.config.RoutingMode == RoutingModeDistanceMatrix && supportsDistanceMatrix {
+		metadata.RoutingMode = RoutingModeDistanceMatrix
+	}
+
+	// Only the kitchens that aren't cached are sent to the directions provider
+	providerName := s.directionsProvider.Name()
+	uncachedKitchens := sendCachedDirections(s.directionsCache, metadata.RoutingMode, providerName, origin, options,
+		kitchens, allPossibleDirections)
+	metadata.CacheHits = len(kitchens) - len(uncachedKitchens)
+	metadata.CacheMisses = len(uncachedKitchens)
+	metadata.Cache = cacheStatus(metadata.CacheHits, metadata.CacheMisses)
+
+	// With a latency budget, the calls may outlive the request, depending on the outstanding calls policy
+	callsCtx := ctx
+	if requestPayload.MaxLatencyMillis > 0 {
+		var cancelCalls context.CancelFunc
+		callsCtx, cancelCalls = directionsCallsContext(ctx, s.config.OutstandingCalls,
+			s.config.RequestTimeout)
+		defer cancelCalls()
+	}
 
-	closestKitchenData, directionsToClosestKitchen, err :=
-		findClosestKitchenAndRoute(allPossibleDirections, kitchenIdToRouteMap, kitchens)
+	// Asked before any call is made, so a request that stops waiting as soon as a call starts still gets the
+	// kitchens that have not answered
+	if tracker != nil {
+		tracker.ask(kitchens)
+	}
+	if len(uncachedKitchens) == 0 {
+		close(allPossibleDirections)
+	} else if metadata.RoutingMode == RoutingModeDistanceMatrix {
+		metadata.DirectionsCalls = distanceMatrixRequests(len(uncachedKitchens))
+		err = s.directionsPool.submit([]func(){
+			func() {
+				getDistanceMatrixForKitchens(callsCtx, uncachedKitchens, matrixProvider, providerName,
+					s.directionsCache, origin, options, allPossibleDirections)
+			},
+		})
+	} else {
+		metadata.DirectionsCalls = len(uncachedKitchens)
+		err = getDirectionsConcurrently(callsCtx, s.directionsPool, s.directionsCache, uncachedKitchens,
+			s.directionsProvider, origin, options, allPossibleDirections)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return &ClosestClusterTruck{
-		DriveTime: ResponseMeasurementValues{
-			Text:  directionsToClosestKitchen.Duration.Text,
-			Value: directionsToClosestKitchen.Duration.Value,
-			Unit:  "seconds",
-		},
-		DriveDistance: ResponseMeasurementValues{
-			Text:  directionsToClosestKitchen.Distance.Text,
-			Value: directionsToClosestKitchen.Distance.Value,
-			Unit:  "meters",
-		},
+	var onDirections func(*KitchenIDDirectionsPair)
+	if progress != nil || tracker != nil {
+		onDirections = func(kitchenIdDirectionsPair *KitchenIDDirectionsPair) {
+			if tracker != nil {
+				tracker.answer(kitchenIdDirectionsPair.ID)
+			}
+			if progress != nil {
+				progress(newDriveTimeProgress(kitchenIdDirectionsPair, kitchenIdToRouteMap,
+					kitchenIdToDirectionsMap, kitchens, departureTime, ranker))
+			}
+		}
+	}
+
+	directions := allPossibleDirections
+	if requestPayload.MaxLatencyMillis > 0 {
+		deadline := startedAt.Add(time.Duration(requestPayload.MaxLatencyMillis) * time.Millisecond)
+		directions = limitDirectionsToDeadline(ctx, allPossibleDirections, deadline)
+	}
+
+	closestKitchenData, directionsToClosestKitchen, err := findClosestKitchenAndRoute(directions,
+		kitchenIdToRouteMap, kitchenIdToErrorMap, kitchenIdToDirectionsMap, kitchens, departureTime, ranker,
+		onDirections)
+	pendingKitchens := findPendingKitchens(kitchenIdToErrorMap, kitchens)
+	if ctx.Err() != nil {
+		pendingKitchens = append(pendingKitchens, findUnansweredKitchens(kitchenIdToDirectionsMap, kitchens)...)
+	}
+	if len(pendingKitchens) > 0 {
+		return nil, pendingKitchensError(ctx, pendingKitchens, len(kitchens))
+	}
+	// Estimating needs the coordinates of the starting address, which are located now if nothing needed them before
+	if err != nil && s.config.EstimateFallback && !locatedFirst && isEstimatableError(err) {
+		var locateError error
+		geocodedOrigin, locateError = s.locateStartingPoint(ctx, requestPayload)
+		if locateError != nil {
+			log.Printf("Drive times will not be estimated from \"%s\": %s\n", requestPayload.startingPoint(),
+				locateError.Error())
+		}
+	}
+	estimated := err != nil && s.config.EstimateFallback && geocodedOrigin != nil && isEstimatableError(err)
+	var confidenceNote string
+	if estimated {
+		log.Printf("Estimating drive times from \"%s\": %s\n", requestPayload.startingPoint(), err.Error())
+		estimateRoutesToKitchens(geocodedOrigin.Geometry.Location, kitchenIdToErrorMap, kitchenIdToRouteMap,
+			kitchens, s.config.EstimateCircuity, s.config.EstimateSpeedProfile)
+		estimateError := err
+		closestKitchenData, directionsToClosestKitchen, err = findClosestKitchen(kitchenIdToRouteMap,
+			kitchenIdToErrorMap, kitchens, departureTime, ranker)
+		if err == nil {
+			confidenceNote = estimateConfidenceNote(directionsToClosestKitchen, s.config.EstimateCircuity,
+				estimateError)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Only kitchens that did not answer within the latency budget are left
+	unansweredKitchens := findUnansweredKitchens(kitchenIdToDirectionsMap, kitchens)
+	for _, kitchenIdDirectionsPair := range kitchenIdToDirectionsMap {
+		if kitchenIdDirectionsPair.Stale {
+			metadata.StaleResults++
+		}
+	}
+	excludedKitchens = append(excludedKitchens, findKitchensWithoutRoutes(kitchenIdToErrorMap, kitchens)...)
+	sortExcludedKitchens(excludedKitchens)
+
+	var routeDetails *RouteDetails
+	// Estimated routes have no steps
+	if requestPayload.RouteDetails && !estimated {
+		routeToClosestKitchen := kitchenIdToRouteMap[closestKitchenData.ID]
+		if metadata.RoutingMode == RoutingModeDistanceMatrix {
+			// The distance matrix only has drive times and distances, so directions are only requested
+			// for the closest kitchen
+			var cached bool
+			routeToClosestKitchen, cached, err = s.getRouteToKitchen(ctx, origin, closestKitchenData, options,
+				ranker)
+			if !cached {
+				metadata.DirectionsCalls++
+			}
+		}
+		if err != nil {
+			log.Printf("Route details to kitchen %s could not be found: %s\n", closestKitchenData.ID, err.Error())
+		} else {
+			routeDetails = &RouteDetails{
+				Summary: routeToClosestKitchen.Summary,
+				Steps:   routeToClosestKitchen.Legs[0].Steps,
+			}
+		}
+	}
+	// The distance matrix and the route details can take more calls than there are kitchens, such as for a
+	// single kitchen, in which case nothing was saved
+	metadata.DirectionsCallsSaved = numberOfCandidates - metadata.DirectionsCalls
+	if metadata.DirectionsCallsSaved < 0 {
+		metadata.DirectionsCallsSaved = 0
+	}
+
+	var startLocation *StartLocation
+	if geocodedOrigin != nil {
+		startLocation = &StartLocation{
+			Address:  geocodedOrigin.FormattedAddress,
+			Location: geocodedOrigin.Geometry.Location,
+			PlaceID:  geocodedOrigin.PlaceID,
+		}
+		if startingAddress == "" {
+			startingAddress = geocodedOrigin.FormattedAddress
+		}
+	}
+
+	closestClusterTruck := &ClosestClusterTruck{
+		DriveTime:          driveTime(directionsToClosestKitchen),
+		DriveTimeInTraffic: driveTimeInTraffic(directionsToClosestKitchen),
+		DriveDistance:      driveDistance(directionsToClosestKitchen),
 		LocationName:       closestKitchenData.Name,
 		StartAddress:       startingAddress,
+		StartLocation:      startLocation,
 		DestinationAddress: closestKitchenData.Address,
-	}, nil
+		ExcludedKitchens:   excludedKitchens,
+		Route:              routeDetails,
+		Partial:            len(unansweredKitchens) > 0,
+		PendingKitchens:    unansweredKitchens,
+		Estimated:          estimated,
+		ConfidenceNote:     confidenceNote,
+		Metadata:           metadata,
+	}
+	setKitchenStatusOnArrival(closestClusterTruck, closestKitchenData, directionsToClosestKitchen, departureTime)
+	if geocodedOrigin != nil {
+		setDeliveryArea(closestClusterTruck, closestKitchenData, geocodedOrigin.Geometry.Location)
+	}
+	if requestPayload.Limit > 0 {
+		closestClusterTruck.Kitchens = rankKitchens(kitchenIdToRouteMap, kitchens, departureTime, ranker,
+			requestPayload.Limit)
+	}
+	if requestPayload.Explain {
+		closestClusterTruck.Explanation = explainKitchens(kitchenIdToRouteMap, kitchenIdToDirectionsMap, kitchens,
+			excludedKitchens, unansweredKitchens, departureTime, ranker)
+	}
+
+	return closestClusterTruck, nil
+}
+
+// Whether the starting point is located before directions are asked for. It is needed to check delivery areas,
+// to prefilter kitchens by distance, and by the OSRM provider, which only takes coordinates. Requests without an
+// address also need it, since the address of the response comes from it. Estimates need it as well, but only
+// once directions have failed.
+func (s *DriveTimeService) locatesStartingPointFirst(requestPayload RequestPayload) bool {
+	return requestPayload.DeliveryAreaOnly || requestPayload.StartingAddress == "" || s.config.PrefilterTopK > 0 ||
+		s.config.PrefilterRadiusMiles > 0 || s.config.DirectionsProvider == DirectionsProviderOSRM
+}
+
+// Finds the coordinates and address of the starting point of the request. The coordinates of the request are
+// always used as they are, so only the address is looked up for them, and they are returned even if no address
+// is found.
+func (s *DriveTimeService) locateStartingPoint(ctx context.Context, requestPayload RequestPayload) (
+	*GeocodingResult, error) {
+
+	if coordinates := requestPayload.coordinates(); coordinates != nil {
+		startingPoint := &GeocodingResult{Geometry: GeocodingGeometry{Location: *coordinates}}
+		address, err := s.geocoder.ReverseGeocode(ctx, *coordinates)
+		if err != nil {
+			log.Printf("No address was found for %s: %s\n", requestPayload.startingPoint(), err.Error())
+			return startingPoint, nil
+		}
+		startingPoint.FormattedAddress = address.FormattedAddress
+		startingPoint.PlaceID = address.PlaceID
+		return startingPoint, nil
+	}
+
+	if requestPayload.PlaceID != "" {
+		return s.geocoder.GeocodePlaceID(ctx, requestPayload.PlaceID)
+	}
+
+	return s.geocoder.Geocode(ctx, requestPayload.StartingAddress)
+}
+
+// Reports the state of the service, for monitoring
+func (s *DriveTimeService) Metrics() ServiceMetrics {
+	return ServiceMetrics{
+		DirectionsPool:  s.directionsPool.Metrics(),
+		DirectionsCache: s.directionsCache.Metrics(),
+		CircuitBreakers: s.circuitBreakers.Status(),
+	}
+}
+
+// Reports whether the service can answer requests, for load balancers and monitoring. The service is
+// degraded while a circuit breaker isn't closed, or the kitchens couldn't be refreshed.
+func (s *DriveTimeService) Health() HealthStatus {
+	health := HealthStatus{
+		Status:          healthStatusOK,
+		Kitchens:        s.kitchenStore.Status(),
+		CircuitBreakers: s.circuitBreakers.Status(),
+	}
+	if health.Kitchens.LastRefreshError != "" {
+		health.Status = healthStatusDegraded
+	}
+	for _, circuitBreaker := range health.CircuitBreakers {
+		if circuitBreaker.State != circuitBreakerClosed {
+			health.Status = healthStatusDegraded
+		}
+	}
+
+	return health
+}
+
+// Gets the best route to a single kitchen, and whether it was cached
+func (s *DriveTimeService) getRouteToKitchen(ctx context.Context, origin Waypoint, kitchen *Kitchen,
+	options TravelOptions, ranker Ranker) (*Route, bool, error) {
+
+	cacheKey := newDirectionsCacheKey(RoutingModeDirections, s.directionsProvider.Name(), origin, kitchen.ID,
+		options)
+	routes, err, cached := s.directionsCache.Get(cacheKey)
+	if !cached {
+		location := kitchen.Location
+		routes, err = s.directionsProvider.GetDirections(ctx, origin,
+			Waypoint{Address: kitchen.Address, Coordinates: &location}, options)
+		if ctx.Err() == nil {
+			s.directionsCache.Add(cacheKey, routes, err)
+			if staleRoutes, stale := fallBackToStaleDirections(s.directionsCache, cacheKey, err); stale {
+				routes, err = staleRoutes, nil
+			}
+		}
+	}
+	if err != nil {
+		return nil, cached, err
+	}
+	if len(routes) == 0 {
+		return nil, cached, newAPIError(ErrorCodeNoRoute, "no routes were found to the kitchen")
+	}
+
+	return findBestRoute(routes, ranker), cached, nil
 }
 
-// This function makes concurrent calls to the GMaps Directions API,
-// to avoid having to wait for the previous call to the GMaps
-// Directions API.
+// Uses the ranking strategy of the request, or the server's default
+func (s *DriveTimeService) ranker(requestPayload RequestPayload) Ranker {
+	strategy := s.config.RankingStrategy
+	if requestPayload.Ranking != "" {
+		strategy = RankingStrategy(requestPayload.Ranking)
+	}
+
+	return newRanker(strategy, s.config)
+}
+
+// Removes cached directions from the given starting address to the given kitchen. Empty values match
+// every address or kitchen. Returns the number of entries removed.
+func (s *DriveTimeService) PurgeDirectionsCache(origin Waypoint, kitchenId string) int {
+	return s.directionsCache.Purge(origin, kitchenId)
+}
+
+// This function makes concurrent calls to the directions provider,
+// to avoid having to wait for the previous call to the directions
+// provider.
 //
 // Without this optimization, subsequent calls take ~1000ms to complete.
 // With this optimization, subsequent calls take ~250ms to complete,
 // which is about a 400% improvement (i.e. 4 times more calls can be
 // processed in the same amount of time).
-func getDirectionsConcurrently(kitchens map[string]Kitchen, httpClient HttpClient, startingAddress string,
-	allPossibleDirections chan *KitchenIDDirectionsPair) {
+//
+// The calls are made by the worker pool, which limits how many calls are made at once across all requests.
+// An error is returned if the pool is too busy to queue the calls. Otherwise this returns right away, and
+// the channel is closed once every call is done, so answers can be read as they arrive.
+func getDirectionsConcurrently(ctx context.Context, pool *DirectionsWorkerPool, cache *DirectionsCache,
+	kitchens map[string]Kitchen, provider DirectionsProvider, origin Waypoint, options TravelOptions,
+	allPossibleDirections chan *KitchenIDDirectionsPair) error {
 
 	var waitGroup sync.WaitGroup
-	waitGroup.Add(len(kitchens))
-
+	tasks := make([]func(), 0, len(kitchens))
 	for _, kitchen := range kitchens {
-		go getGoogleMapsDirections(httpClient, startingAddress, kitchen.Address,
-			kitchen.ID, allPossibleDirections, &waitGroup)
+		kitchen := kitchen
+		tasks = append(tasks, func() {
+			getDirections(ctx, provider, cache, origin, kitchen, options, allPossibleDirections, &waitGroup)
+		})
+	}
+
+	waitGroup.Add(len(tasks))
+	err := pool.submit(tasks)
+	if err != nil {
+		return err
 	}
 
-	waitGroup.Wait()
-	close(allPossibleDirections)
+	go func() {
+		waitGroup.Wait()
+		close(allPossibleDirections)
+	}()
+
+	return nil
 }
 
+// Finds the closest kitchen that is open when the user arrives, where the closest kitchen is the one ranked first
+// by the ranker. If none of the kitchens are open on arrival, the closest kitchen is returned regardless,
+// so the user can be told when it opens.
+//
+// Errors for kitchens that directions could not be found to are added to kitchenIdToErrorMap, and every
+// answer of the directions provider is added to kitchenIdToDirectionsMap. If onDirections is not nil, it's called
+// with each answer once it has been added.
 func findClosestKitchenAndRoute(allPossibleDirections chan *KitchenIDDirectionsPair,
-	kitchenIdToRouteMap map[string]*Route, kitchens map[string]Kitchen) (*Kitchen, *Leg, error) {
+	kitchenIdToRouteMap map[string]*Route, kitchenIdToErrorMap map[string]error,
+	kitchenIdToDirectionsMap map[string]*KitchenIDDirectionsPair, kitchens map[string]Kitchen,
+	departureTime time.Time, ranker Ranker, onDirections func(*KitchenIDDirectionsPair)) (*Kitchen, *Leg, error) {
 
 	for kitchenIdDirectionsPair := range allPossibleDirections {
-		if kitchenIdDirectionsPair.Error == "" {
-			numberOfRoutes := len(kitchenIdDirectionsPair.Directions.Routes)
+		kitchenIdToDirectionsMap[kitchenIdDirectionsPair.ID] = kitchenIdDirectionsPair
+		if kitchenIdDirectionsPair.Error != nil {
+			kitchenIdToErrorMap[kitchenIdDirectionsPair.ID] = kitchenIdDirectionsPair.Error
+		} else {
+			numberOfRoutes := len(kitchenIdDirectionsPair.Routes)
 			if numberOfRoutes > 1 {
-				shortestDriveTimeRoute := findShortestRouteByDriveTime(kitchenIdDirectionsPair.Directions.Routes)
-				kitchenIdToRouteMap[kitchenIdDirectionsPair.ID] = shortestDriveTimeRoute
+				kitchenIdToRouteMap[kitchenIdDirectionsPair.ID] = findBestRoute(kitchenIdDirectionsPair.Routes, ranker)
 			} else if numberOfRoutes == 1 {
-				kitchenIdToRouteMap[kitchenIdDirectionsPair.ID] = &kitchenIdDirectionsPair.Directions.Routes[0]
+				kitchenIdToRouteMap[kitchenIdDirectionsPair.ID] = &kitchenIdDirectionsPair.Routes[0]
 			}
 		}
+		if onDirections != nil {
+			onDirections(kitchenIdDirectionsPair)
+		}
+	}
+
+	return findClosestKitchen(kitchenIdToRouteMap, kitchenIdToErrorMap, kitchens, departureTime, ranker)
+}
+
+// Picks the closest kitchen among the kitchens that routes were found to, preferring kitchens that are open
+// on arrival. If there are no routes, the errors explain why.
+func findClosestKitchen(kitchenIdToRouteMap map[string]*Route, kitchenIdToErrorMap map[string]error,
+	kitchens map[string]Kitchen, departureTime time.Time, ranker Ranker) (*Kitchen, *Leg, error) {
+
+	if len(kitchenIdToRouteMap) == 0 {
+		return nil, nil, noRoutesFoundError(kitchenIdToErrorMap)
 	}
 
-	closestKitchenId, err := findClosestClusterTruckByDriveTime(kitchenIdToRouteMap)
+	openKitchenIdToRouteMap := findKitchensOpenOnArrival(kitchenIdToRouteMap, kitchens, departureTime)
+	if len(openKitchenIdToRouteMap) == 0 {
+		openKitchenIdToRouteMap = kitchenIdToRouteMap
+	}
+
+	closestKitchenId, err := findClosestClusterTruck(openKitchenIdToRouteMap, ranker)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -126,20 +857,269 @@ func findClosestKitchenAndRoute(allPossibleDirections chan *KitchenIDDirectionsP
 	return &closestKitchenData, &directionsToClosestKitchen, nil
 }
 
-func findClosestClusterTruckByDriveTime(kitchenIdToRouteMap map[string]*Route) (string, error) {
+func findClosestClusterTruck(kitchenIdToRouteMap map[string]*Route, ranker Ranker) (string, error) {
 	if len(kitchenIdToRouteMap) == 0 {
-		return "", errors.New("no routes were found from your starting address")
+		return "", newAPIError(ErrorCodeNoRoute, "no routes were found from your starting address")
 	}
 
-	shortestDriveTime := math.MaxInt32
-	closestKitchenId := ""
-	for kitchenId, directions := range kitchenIdToRouteMap {
-		driveTime := directions.Legs[0].Duration.Value
-		if driveTime < shortestDriveTime {
-			shortestDriveTime = driveTime
-			closestKitchenId = kitchenId
+	return sortKitchens(kitchenIdToRouteMap, ranker)[0], nil
+}
+
+// Ranks up to limit kitchens the same way the closest kitchen is found: kitchens that are open when the user
+// arrives come first, followed by the closed ones, both sorted by the ranker.
+func rankKitchens(kitchenIdToRouteMap map[string]*Route, kitchens map[string]Kitchen, departureTime time.Time,
+	ranker Ranker, limit int) []RankedKitchen {
+
+	kitchenIds, openKitchenIdToRouteMap := sortKitchensOpenFirst(kitchenIdToRouteMap, kitchens, departureTime,
+		ranker)
+	if len(kitchenIds) > limit {
+		kitchenIds = kitchenIds[:limit]
+	}
+
+	rankedKitchens := make([]RankedKitchen, len(kitchenIds))
+	for i, kitchenId := range kitchenIds {
+		leg := &kitchenIdToRouteMap[kitchenId].Legs[0]
+		kitchenStatus := kitchenStatusClosed
+		if _, isOpen := openKitchenIdToRouteMap[kitchenId]; isOpen {
+			kitchenStatus = kitchenStatusOpen
+		}
+		rankedKitchens[i] = RankedKitchen{
+			Rank:               i + 1,
+			ID:                 kitchenId,
+			LocationName:       kitchens[kitchenId].Name,
+			DestinationAddress: kitchens[kitchenId].Address,
+			DriveTime:          driveTime(leg),
+			DriveTimeInTraffic: driveTimeInTraffic(leg),
+			DriveDistance:      driveDistance(leg),
+			KitchenStatus:      kitchenStatus,
 		}
 	}
 
-	return closestKitchenId, nil
+	return rankedKitchens
+}
+
+// Sorts kitchen IDs with the kitchens that are open when the user arrives first, followed by the closed ones,
+// both sorted by the ranker. The open kitchens are returned as well.
+func sortKitchensOpenFirst(kitchenIdToRouteMap map[string]*Route, kitchens map[string]Kitchen,
+	departureTime time.Time, ranker Ranker) ([]string, map[string]*Route) {
+
+	openKitchenIdToRouteMap := findKitchensOpenOnArrival(kitchenIdToRouteMap, kitchens, departureTime)
+	closedKitchenIdToRouteMap := make(map[string]*Route)
+	for kitchenId, route := range kitchenIdToRouteMap {
+		if _, isOpen := openKitchenIdToRouteMap[kitchenId]; !isOpen {
+			closedKitchenIdToRouteMap[kitchenId] = route
+		}
+	}
+
+	kitchenIds := append(sortKitchens(openKitchenIdToRouteMap, ranker),
+		sortKitchens(closedKitchenIdToRouteMap, ranker)...)
+	return kitchenIds, openKitchenIdToRouteMap
+}
+
+func driveTime(leg *Leg) ResponseMeasurementValues {
+	return ResponseMeasurementValues{
+		Text:  leg.Duration.Text,
+		Value: leg.Duration.Value,
+		Unit:  "seconds",
+	}
+}
+
+// Nil if the leg has no duration in traffic
+func driveTimeInTraffic(leg *Leg) *ResponseMeasurementValues {
+	if leg.DurationInTraffic == nil {
+		return nil
+	}
+
+	return &ResponseMeasurementValues{
+		Text:  leg.DurationInTraffic.Text,
+		Value: leg.DurationInTraffic.Value,
+		Unit:  "seconds",
+	}
+}
+
+func driveDistance(leg *Leg) ResponseMeasurementValues {
+	return ResponseMeasurementValues{
+		Text:  leg.Distance.Text,
+		Value: leg.Distance.Value,
+		Unit:  "meters",
+	}
+}
+
+func findKitchensOpenOnArrival(kitchenIdToRouteMap map[string]*Route, kitchens map[string]Kitchen,
+	departureTime time.Time) map[string]*Route {
+
+	openKitchenIdToRouteMap := make(map[string]*Route)
+	for kitchenId, route := range kitchenIdToRouteMap {
+		kitchen := kitchens[kitchenId]
+		isOpen, err := kitchen.IsOpenAt(estimateArrivalTime(departureTime, &route.Legs[0]))
+		if err != nil {
+			log.Printf("Treating kitchen %s as closed: %s\n", kitchenId, err.Error())
+		}
+		if isOpen {
+			openKitchenIdToRouteMap[kitchenId] = route
+		}
+	}
+
+	return openKitchenIdToRouteMap
+}
+
+func estimateArrivalTime(departureTime time.Time, leg *Leg) time.Time {
+	return departureTime.Add(time.Duration(leg.DriveDuration().Value) * time.Second)
+}
+
+func setKitchenStatusOnArrival(closestClusterTruck *ClosestClusterTruck, kitchen *Kitchen, leg *Leg,
+	departureTime time.Time) {
+
+	arrivalTime := estimateArrivalTime(departureTime, leg)
+	if location, err := kitchen.loadLocation(); err == nil {
+		arrivalTime = arrivalTime.In(location)
+	}
+	closestClusterTruck.EstimatedArrivalTime = &arrivalTime
+
+	isOpen, _ := kitchen.IsOpenAt(arrivalTime)
+	if isOpen {
+		closestClusterTruck.KitchenStatus = kitchenStatusOpen
+		return
+	}
+
+	closestClusterTruck.KitchenStatus = kitchenStatusClosed
+	nextOpeningTime, found, _ := kitchen.NextOpeningAt(arrivalTime)
+	if found {
+		closestClusterTruck.NextOpeningTime = &nextOpeningTime
+	}
+}
+
+// Lists the kitchens that did not answer before the request's context was done, sorted by ID
+func findPendingKitchens(kitchenIdToErrorMap map[string]error, kitchens map[string]Kitchen) []PendingKitchen {
+	var pendingKitchens []PendingKitchen
+	for kitchenId, err := range kitchenIdToErrorMap {
+		code := errorCode(err)
+		if code == ErrorCodeRequestTimeout || code == ErrorCodeRequestCanceled {
+			pendingKitchens = append(pendingKitchens, PendingKitchen{ID: kitchenId, Name: kitchens[kitchenId].Name})
+		}
+	}
+	sort.Slice(pendingKitchens, func(i, j int) bool {
+		return pendingKitchens[i].ID < pendingKitchens[j].ID
+	})
+
+	return pendingKitchens
+}
+
+// Keeps track of the kitchens a lookup is waiting for, so requests that stop waiting for a shared lookup
+// can tell which kitchens did not answer in time
+type lookupTracker struct {
+	mutex sync.Mutex
+	// Not set until directions are asked for
+	kitchens map[string]Kitchen
+	answered map[string]bool
+}
+
+func newLookupTracker() *lookupTracker {
+	return &lookupTracker{answered: make(map[string]bool)}
+}
+
+func (t *lookupTracker) ask(kitchens map[string]Kitchen) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.kitchens = kitchens
+}
+
+func (t *lookupTracker) answer(kitchenId string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.answered[kitchenId] = true
+}
+
+// The error of a request that stopped waiting, listing the kitchens that have not answered yet. If the lookup
+// had not asked for directions yet, there are no kitchens to list.
+func (t *lookupTracker) pendingKitchensError(ctx context.Context) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.kitchens == nil {
+		return contextError(ctx)
+	}
+
+	var pendingKitchens []PendingKitchen
+	for kitchenId, kitchen := range t.kitchens {
+		if !t.answered[kitchenId] {
+			pendingKitchens = append(pendingKitchens, PendingKitchen{ID: kitchenId, Name: kitchen.Name})
+		}
+	}
+	sort.Slice(pendingKitchens, func(i, j int) bool {
+		return pendingKitchens[i].ID < pendingKitchens[j].ID
+	})
+
+	return pendingKitchensError(ctx, pendingKitchens, len(t.kitchens))
+}
+
+func hasPendingKitchens(err error) bool {
+	apiError, ok := err.(*APIError)
+	if !ok {
+		return false
+	}
+	_, found := apiError.Parameters["pending_kitchens"]
+
+	return found
+}
+
+func pendingKitchensError(ctx context.Context, pendingKitchens []PendingKitchen, numberOfKitchens int) error {
+	apiError := contextError(ctx)
+	apiError.Message = fmt.Sprintf("%s, %d of the %d kitchens did not answer in time", apiError.Message,
+		len(pendingKitchens), numberOfKitchens)
+	apiError.Parameters = map[string]interface{}{
+		"pending_kitchens": pendingKitchens,
+	}
+
+	return apiError
+}
+
+// Lists the kitchens that directions could not be found to, along with the code and public message of the error
+func findKitchensWithoutRoutes(kitchenIdToErrorMap map[string]error, kitchens map[string]Kitchen) []ExcludedKitchen {
+	var excludedKitchens []ExcludedKitchen
+	for kitchenId, err := range kitchenIdToErrorMap {
+		reason := exclusionReasonUpstreamError
+		if errorCode(err) == ErrorCodeNoRoute {
+			reason = exclusionReasonNoRoute
+		}
+		excludedKitchens = append(excludedKitchens, ExcludedKitchen{
+			ID:     kitchenId,
+			Name:   kitchens[kitchenId].Name,
+			Reason: reason,
+			Error:  publicError(err),
+		})
+	}
+
+	return excludedKitchens
+}
+
+func findKitchensDeliveringTo(kitchens map[string]Kitchen,
+	point Coordinates) (map[string]Kitchen, []ExcludedKitchen) {
+
+	deliveringKitchens := make(map[string]Kitchen)
+	var excludedKitchens []ExcludedKitchen
+	for kitchenId, kitchen := range kitchens {
+		if kitchen.DeliveryAreaContaining(point) != nil {
+			deliveringKitchens[kitchenId] = kitchen
+		} else {
+			excludedKitchens = append(excludedKitchens, ExcludedKitchen{
+				ID:     kitchen.ID,
+				Name:   kitchen.Name,
+				Reason: exclusionReasonOutsideDeliveryArea,
+			})
+		}
+	}
+
+	return deliveringKitchens, excludedKitchens
+}
+
+func setDeliveryArea(closestClusterTruck *ClosestClusterTruck, kitchen *Kitchen, point Coordinates) {
+	deliveryArea := kitchen.DeliveryAreaContaining(point)
+	inDeliveryArea := deliveryArea != nil
+	closestClusterTruck.InDeliveryArea = &inDeliveryArea
+	if inDeliveryArea {
+		closestClusterTruck.DeliveryAreaName = deliveryArea.Name
+	}
 }
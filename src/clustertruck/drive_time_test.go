@@ -5,12 +5,27 @@ import (
 	"net/http"
 	"bytes"
 	"strings"
+	"time"
+	"context"
+	"sync"
+	"math"
+	"encoding/json"
+	"sync/atomic"
 )
 
-func TestFindDriveTimeToClosestClusterTruckKitchen(t *testing.T) {
-	client := &MockClient{
+// Routes to Columbus are the shortest, followed by Bloomington, Kansas City, Cleveland, Denver and Indianapolis.
+// The starting address is geocoded to Martinsville, IN, which is outside every delivery area.
+func createClientWithRoutesToEveryKitchen() *MockClient {
+	return createClientWithRoutesToEveryKitchenFrom("geocode_response.json")
+}
+
+func createClientWithRoutesToEveryKitchenFrom(geocodeResponseFile string) *MockClient {
+	return &MockClient{
 		DoFunc: func(req *http.Request) (*http.Response, error) {
-			if strings.Contains(req.URL.String(), "Indianapolis") {
+			if strings.Contains(req.URL.String(), "geocode") {
+				mockGeocodeResponse := readMockFile(geocodeResponseFile)
+				return createHttpResponseForTest(http.StatusOK, bytes.NewBuffer(mockGeocodeResponse)), nil
+			} else if strings.Contains(req.URL.String(), "Indianapolis") {
 				mockGmapsResponseData := readMockFile("directions_response_multiple_routes_simplified_1.json")
 				return createHttpResponseForTest(http.StatusOK, bytes.NewBuffer(mockGmapsResponseData)), nil
 			} else if strings.Contains(req.URL.String(), "Bloomington") {
@@ -39,13 +54,89 @@ func TestFindDriveTimeToClosestClusterTruckKitchen(t *testing.T) {
 			}
 		},
 	}
+}
+
+// Creates a service where the user departs at the given time in Indianapolis
+func createDriveTimeServiceForTest(client HttpClient, departureTime string) *DriveTimeService {
+	location, _ := time.LoadLocation("America/New_York")
+	now, err := time.ParseInLocation("2006-01-02 15:04", departureTime, location)
+	if err != nil {
+		panic(err)
+	}
 
-	closestClusterTruckInfo, _ := findDriveTimeToClosestClusterTruckKitchen(client, "startingAddress")
+	// Most kitchens in the test data are inactive, so they are all included unless a test asks otherwise
+	config := DefaultConfig()
+	config.KitchenEligibility = EligibilityIncludeAll
+	service := NewDriveTimeService(client, config)
+	service.now = func() time.Time { return now }
+
+	return service
+}
+
+func TestFindDriveTimeToClosestClusterTruckKitchen(t *testing.T) {
+	client := createClientWithRoutesToEveryKitchen()
+
+	// Monday at noon, when every kitchen with hours is open
+	closestClusterTruckInfo, _ := createDriveTimeServiceForTest(client, "2017-12-04 12:00").
+		findDriveTimeToClosestClusterTruckKitchen(context.Background(), RequestPayload{StartingAddress: "startingAddress"})
 	assertResult(t, "21 mins", closestClusterTruckInfo.DriveTime.Text)
 	assertResult(t, 2001, closestClusterTruckInfo.DriveTime.Value)
 	assertResult(t, "96.2 mi", closestClusterTruckInfo.DriveDistance.Text)
 	assertResult(t, 154775, closestClusterTruckInfo.DriveDistance.Value)
 	assertResult(t, "342 East Long Street, Columbus, OH, 43215", closestClusterTruckInfo.DestinationAddress)
+	assertResult(t, "open", closestClusterTruckInfo.KitchenStatus)
+	assertResult(t, "2017-12-04T12:33:21-05:00", closestClusterTruckInfo.EstimatedArrivalTime.Format(time.RFC3339))
+	// Nothing needed the starting address to be located
+	assertResult(t, true, closestClusterTruckInfo.InDeliveryArea == nil)
+	assertResult(t, true, closestClusterTruckInfo.StartLocation == nil)
+}
+
+func TestFindDriveTimeOnlyGeocodesWhenTheStartingPointIsNeeded(t *testing.T) {
+	var geocodingCalls int32
+	client := createClientWithRoutesToEveryKitchen()
+	doFunc := client.DoFunc
+	client.DoFunc = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "geocode") {
+			atomic.AddInt32(&geocodingCalls, 1)
+		}
+		return doFunc(req)
+	}
+	service := createDriveTimeServiceForTest(client, "2017-12-04 12:00")
+
+	_, err := service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{StartingAddress: "startingAddress"})
+	assertResult(t, nil, err)
+	assertResult(t, int32(0), atomic.LoadInt32(&geocodingCalls))
+
+	service.config.PrefilterTopK = 3
+	closestClusterTruckInfo, err := service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{StartingAddress: "anotherAddress"})
+	assertResult(t, nil, err)
+	assertResult(t, int32(1), atomic.LoadInt32(&geocodingCalls))
+	assertResult(t, false, *closestClusterTruckInfo.InDeliveryArea)
+}
+
+func TestFindDriveTimeToClosestClusterTruckKitchenOpenOnArrival(t *testing.T) {
+	client := createClientWithRoutesToEveryKitchen()
+
+	// Kitchens in the eastern timezone close at 22:00 on Mondays, but Denver is 2 hours behind
+	closestClusterTruckInfo, _ := createDriveTimeServiceForTest(client, "2017-12-04 21:30").
+		findDriveTimeToClosestClusterTruckKitchen(context.Background(), RequestPayload{StartingAddress: "startingAddress"})
+	assertResult(t, "Denver", closestClusterTruckInfo.LocationName)
+	assertResult(t, 5560, closestClusterTruckInfo.DriveTime.Value)
+	assertResult(t, "open", closestClusterTruckInfo.KitchenStatus)
+	assertResult(t, "2017-12-04T21:02:40-07:00", closestClusterTruckInfo.EstimatedArrivalTime.Format(time.RFC3339))
+	assertResult(t, true, closestClusterTruckInfo.NextOpeningTime == nil)
+}
+
+func TestFindDriveTimeToClosestClusterTruckKitchenWhenAllKitchensAreClosed(t *testing.T) {
+	client := createClientWithRoutesToEveryKitchen()
+
+	closestClusterTruckInfo, _ := createDriveTimeServiceForTest(client, "2017-12-04 23:30").
+		findDriveTimeToClosestClusterTruckKitchen(context.Background(), RequestPayload{StartingAddress: "startingAddress"})
+	assertResult(t, "Downtown Columbus", closestClusterTruckInfo.LocationName)
+	assertResult(t, "closed", closestClusterTruckInfo.KitchenStatus)
+	assertResult(t, "2017-12-05T08:00:00-05:00", closestClusterTruckInfo.NextOpeningTime.Format(time.RFC3339))
 }
 
 func TestFindDriveTimeToClosestClusterWhenNoRoutesAreFound(t *testing.T) {
@@ -61,6 +152,175 @@ func TestFindDriveTimeToClosestClusterWhenNoRoutesAreFound(t *testing.T) {
 		},
 	}
 
-	_, err := findDriveTimeToClosestClusterTruckKitchen(client, "startingAddress")
+	_, err := NewDriveTimeService(client, DefaultConfig()).
+		findDriveTimeToClosestClusterTruckKitchen(context.Background(), RequestPayload{StartingAddress: "startingAddress"})
 	assertResult(t, "no routes were found from your starting address", err.Error())
+	assertResult(t, ErrorCodeNoRoute, errorCode(err))
+}
+
+func TestFindDriveTimeToClosestClusterTruckKitchenInDeliveryAreaOnly(t *testing.T) {
+	client := createClientWithRoutesToEveryKitchenFrom("geocode_response_downtown_indy.json")
+
+	closestClusterTruckInfo, _ := createDriveTimeServiceForTest(client, "2017-12-04 12:00").
+		findDriveTimeToClosestClusterTruckKitchen(context.Background(), RequestPayload{
+			StartingAddress:  "startingAddress",
+			DeliveryAreaOnly: true,
+		})
+	assertResult(t, "Downtown Indy", closestClusterTruckInfo.LocationName)
+	assertResult(t, true, *closestClusterTruckInfo.InDeliveryArea)
+	assertResult(t, "downtown-indy-polygon", closestClusterTruckInfo.DeliveryAreaName)
+}
+
+func TestFindDriveTimeToClosestClusterTruckKitchenWhenNoKitchenDelivers(t *testing.T) {
+	client := createClientWithRoutesToEveryKitchen()
+
+	_, err := createDriveTimeServiceForTest(client, "2017-12-04 12:00").
+		findDriveTimeToClosestClusterTruckKitchen(context.Background(), RequestPayload{
+			StartingAddress:  "startingAddress",
+			DeliveryAreaOnly: true,
+		})
+	assertResult(t, "none of the ClusterTruck kitchens deliver to your starting address", err.Error())
+}
+
+func TestFindDriveTimeToClosestClusterTruckKitchenWithEligibilityPolicy(t *testing.T) {
+	client := createClientWithRoutesToEveryKitchen()
+	service := createDriveTimeServiceForTest(client, "2017-12-04 12:00")
+
+	closestClusterTruckInfo, _ := service.findDriveTimeToClosestClusterTruckKitchen(context.Background(), RequestPayload{
+		StartingAddress: "startingAddress",
+		Eligibility:     "active_only",
+	})
+	assertResult(t, "Bloomington", closestClusterTruckInfo.LocationName)
+	assertResult(t, 4, len(closestClusterTruckInfo.ExcludedKitchens))
+	assertResult(t, "Denver", closestClusterTruckInfo.ExcludedKitchens[0].Name)
+	assertResult(t, "inactive", closestClusterTruckInfo.ExcludedKitchens[0].Reason)
+
+	closestClusterTruckInfo, _ = service.findDriveTimeToClosestClusterTruckKitchen(context.Background(), RequestPayload{
+		StartingAddress: "startingAddress",
+		Eligibility:     "online_only",
+	})
+	assertResult(t, "Downtown Columbus", closestClusterTruckInfo.LocationName)
+	assertResult(t, 1, len(closestClusterTruckInfo.ExcludedKitchens))
+	assertResult(t, "Kansas City", closestClusterTruckInfo.ExcludedKitchens[0].Name)
+	assertResult(t, "offline", closestClusterTruckInfo.ExcludedKitchens[0].Reason)
+}
+
+func TestFindDriveTimeToClosestClusterTruckKitchenWithPrefilter(t *testing.T) {
+	client := createClientWithRoutesToEveryKitchen()
+	service := createDriveTimeServiceForTest(client, "2017-12-04 12:00")
+	service.config.PrefilterTopK = 3
+
+	closestClusterTruckInfo, _ := service.findDriveTimeToClosestClusterTruckKitchen(context.Background(), RequestPayload{
+		StartingAddress: "startingAddress",
+	})
+	assertResult(t, "Downtown Columbus", closestClusterTruckInfo.LocationName)
+	assertResult(t, 3, closestClusterTruckInfo.Metadata.DirectionsCalls)
+	assertResult(t, 3, closestClusterTruckInfo.Metadata.DirectionsCallsSaved)
+	assertResult(t, 3, len(closestClusterTruckInfo.ExcludedKitchens))
+}
+
+func TestFindDriveTimeToClosestClusterTruckKitchenWithLimit(t *testing.T) {
+	client := createClientWithRoutesToEveryKitchen()
+
+	// Kansas City is closer than Cleveland, but closed when the user arrives, so it's ranked last
+	closestClusterTruckInfo, _ := createDriveTimeServiceForTest(client, "2017-12-04 12:00").
+		findDriveTimeToClosestClusterTruckKitchen(context.Background(), RequestPayload{
+			StartingAddress: "startingAddress",
+			Limit:           10,
+		})
+	kitchens := closestClusterTruckInfo.Kitchens
+	assertResult(t, 6, len(kitchens))
+	assertResult(t, closestClusterTruckInfo.LocationName, kitchens[0].LocationName)
+	assertResult(t, 1, kitchens[0].Rank)
+	assertResult(t, 2001, kitchens[0].DriveTime.Value)
+	assertResult(t, 154775, kitchens[0].DriveDistance.Value)
+	assertResult(t, "342 East Long Street, Columbus, OH, 43215", kitchens[0].DestinationAddress)
+	assertResult(t, "Bloomington", kitchens[1].LocationName)
+	assertResult(t, "Cleveland", kitchens[2].LocationName)
+	assertResult(t, "Kansas City", kitchens[5].LocationName)
+	assertResult(t, kitchenStatusClosed, kitchens[5].KitchenStatus)
+	assertResult(t, 6, kitchens[5].Rank)
+
+	closestClusterTruckInfo, _ = createDriveTimeServiceForTest(client, "2017-12-04 12:00").
+		findDriveTimeToClosestClusterTruckKitchen(context.Background(), RequestPayload{
+			StartingAddress: "startingAddress",
+			Limit:           2,
+		})
+	assertResult(t, 2, len(closestClusterTruckInfo.Kitchens))
+}
+
+func TestRequestPayloadWithStartingPoints(t *testing.T) {
+	location := Coordinates{Lat: 39.4278244, Lng: -86.4283333}
+
+	assertResult(t, nil, (&RequestPayload{Location: newRequestLocation(location)}).validate())
+	assertResult(t, nil, (&RequestPayload{PlaceID: "ChIJ1ZpXWxmFbIgRb1m7Y3cmM3E"}).validate())
+	assertResult(t, "one of address, location or place_id must be given",
+		(&RequestPayload{StartingAddress: "  "}).validate().Error())
+	assertResult(t, "only one of address, location or place_id can be given",
+		(&RequestPayload{StartingAddress: "Martinsville, IN", Location: newRequestLocation(location)}).validate().Error())
+	assertResult(t, "location.lat must be between -90 and 90, but was 139.4",
+		(&RequestPayload{Location: newRequestLocation(Coordinates{Lat: 139.4, Lng: -86.4})}).validate().Error())
+	assertResult(t, "location.lng must be between -180 and 180, but was NaN",
+		(&RequestPayload{Location: newRequestLocation(Coordinates{Lat: 39.4, Lng: math.NaN()})}).validate().Error())
+
+	// Missing coordinates are not taken for 0
+	var requestPayload RequestPayload
+	json.Unmarshal([]byte(`{"location": {}}`), &requestPayload)
+	assertResult(t, "location.lat must be given", requestPayload.validate().Error())
+	json.Unmarshal([]byte(`{"location": {"lat": 0}}`), &requestPayload)
+	assertResult(t, "location.lng must be given", requestPayload.validate().Error())
+	json.Unmarshal([]byte(`{"location": {"lat": 0, "lng": 0}}`), &requestPayload)
+	assertResult(t, nil, requestPayload.validate())
+	assertResult(t, "place_id \"not a place\" is not a valid GMaps place ID",
+		(&RequestPayload{PlaceID: "not a place"}).validate().Error())
+}
+
+func TestFindDriveTimeFromLocation(t *testing.T) {
+	var mutex sync.Mutex
+	var originsSent []string
+	client := createClientWithRoutesToEveryKitchen()
+	doFunc := client.DoFunc
+	client.DoFunc = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "directions") {
+			mutex.Lock()
+			originsSent = append(originsSent, req.URL.Query().Get("origin"))
+			mutex.Unlock()
+		}
+		return doFunc(req)
+	}
+	service := createDriveTimeServiceForTest(client, "2017-12-04 12:00")
+
+	location := Coordinates{Lat: 39.43, Lng: -86.43}
+	closestClusterTruckInfo, err := service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{Location: newRequestLocation(location)})
+	assertResult(t, nil, err)
+	assertResult(t, "Downtown Columbus", closestClusterTruckInfo.LocationName)
+	assertResult(t, "Martinsville, IN, USA", closestClusterTruckInfo.StartAddress)
+	assertResult(t, "Martinsville, IN, USA", closestClusterTruckInfo.StartLocation.Address)
+	assertResult(t, location, closestClusterTruckInfo.StartLocation.Location)
+	assertResult(t, "39.430000,-86.430000", originsSent[0])
+}
+
+func TestFindDriveTimeFromPlaceID(t *testing.T) {
+	var mutex sync.Mutex
+	var originsSent []string
+	client := createClientWithRoutesToEveryKitchen()
+	doFunc := client.DoFunc
+	client.DoFunc = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "directions") {
+			mutex.Lock()
+			originsSent = append(originsSent, req.URL.Query().Get("origin"))
+			mutex.Unlock()
+		}
+		return doFunc(req)
+	}
+	service := createDriveTimeServiceForTest(client, "2017-12-04 12:00")
+
+	closestClusterTruckInfo, err := service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{PlaceID: "ChIJ1ZpXWxmFbIgRb1m7Y3cmM3E"})
+	assertResult(t, nil, err)
+	assertResult(t, "Downtown Columbus", closestClusterTruckInfo.LocationName)
+	assertResult(t, "ChIJ1ZpXWxmFbIgRb1m7Y3cmM3E", closestClusterTruckInfo.StartLocation.PlaceID)
+	assertResult(t, 39.4278244, closestClusterTruckInfo.StartLocation.Location.Lat)
+	assertResult(t, "place_id:ChIJ1ZpXWxmFbIgRb1m7Y3cmM3E", originsSent[0])
 }
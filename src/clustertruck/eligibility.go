@@ -0,0 +1,96 @@
+package clustertruck
+
+import (
+	"sort"
+	"errors"
+	"fmt"
+)
+
+// Decides which kitchens users can be sent to, based on their active status and kitchen state
+type EligibilityPolicy string
+
+const (
+	// Only kitchens that have active set to true
+	EligibilityActiveOnly EligibilityPolicy = "active_only"
+	// Only kitchens that have kitchen_state set to "online"
+	EligibilityOnlineOnly EligibilityPolicy = "online_only"
+	// Every kitchen, regardless of whether it's active or online
+	EligibilityIncludeAll EligibilityPolicy = "include_all"
+)
+
+// Reasons a kitchen was not considered
+const (
+	exclusionReasonInactive            = "inactive"
+	exclusionReasonOffline             = "offline"
+	exclusionReasonOutsideDeliveryArea = "outside_delivery_area"
+	// The directions provider found no route to the kitchen
+	exclusionReasonNoRoute = "no_route"
+	// The directions provider failed, so it's unknown whether the kitchen is closer
+	exclusionReasonUpstreamError = "upstream_error"
+)
+
+// A kitchen that was not considered, and the reason why
+type ExcludedKitchen struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+	// Only set if directions to the kitchen could not be found
+	Error *HTTPError `json:"error,omitempty"`
+}
+
+func parseEligibilityPolicy(value string) (EligibilityPolicy, error) {
+	policy := EligibilityPolicy(value)
+	switch policy {
+	case EligibilityActiveOnly, EligibilityOnlineOnly, EligibilityIncludeAll:
+		return policy, nil
+	}
+
+	return "", errors.New(fmt.Sprintf("\"%s\" is not a valid eligibility policy, expected one of %s, %s or %s",
+		value, EligibilityActiveOnly, EligibilityOnlineOnly, EligibilityIncludeAll))
+}
+
+// Returns the reason the kitchen is excluded by the policy, or an empty string if it's eligible
+func (p EligibilityPolicy) exclusionReason(kitchen *Kitchen) string {
+	switch p {
+	case EligibilityActiveOnly:
+		if !kitchen.Active {
+			return exclusionReasonInactive
+		}
+	case EligibilityOnlineOnly:
+		if kitchen.KitchenState != "online" {
+			return exclusionReasonOffline
+		}
+	}
+
+	return ""
+}
+
+// Splits kitchens into the ones that are eligible under the policy, and the ones that are excluded
+func filterEligibleKitchens(kitchens map[string]Kitchen,
+	policy EligibilityPolicy) (map[string]Kitchen, []ExcludedKitchen) {
+
+	eligibleKitchens := make(map[string]Kitchen)
+	var excludedKitchens []ExcludedKitchen
+	for kitchenId, kitchen := range kitchens {
+		reason := policy.exclusionReason(&kitchen)
+		if reason == "" {
+			eligibleKitchens[kitchenId] = kitchen
+		} else {
+			excludedKitchens = append(excludedKitchens, ExcludedKitchen{
+				ID:     kitchen.ID,
+				Name:   kitchen.Name,
+				Reason: reason,
+			})
+		}
+	}
+	sortExcludedKitchens(excludedKitchens)
+
+	return eligibleKitchens, excludedKitchens
+}
+
+// Map iteration order is random, so excluded kitchens are sorted to keep responses stable
+func sortExcludedKitchens(excludedKitchens []ExcludedKitchen) {
+	sort.Slice(excludedKitchens, func(i, j int) bool {
+		return excludedKitchens[i].ID < excludedKitchens[j].ID
+	})
+}
@@ -0,0 +1,35 @@
+package clustertruck
+
+import "testing"
+
+func TestFilterEligibleKitchens(t *testing.T) {
+	kitchens := map[string]Kitchen{
+		"a": {ID: "a", Name: "Active and online", Active: true, KitchenState: "online"},
+		"b": {ID: "b", Name: "Inactive and online", Active: false, KitchenState: "online"},
+		"c": {ID: "c", Name: "Inactive and pending", Active: false, KitchenState: "pending"},
+	}
+
+	eligibleKitchens, excludedKitchens := filterEligibleKitchens(kitchens, EligibilityActiveOnly)
+	assertResult(t, 1, len(eligibleKitchens))
+	assertResult(t, 2, len(excludedKitchens))
+	assertResult(t, "b", excludedKitchens[0].ID)
+	assertResult(t, "inactive", excludedKitchens[0].Reason)
+
+	eligibleKitchens, excludedKitchens = filterEligibleKitchens(kitchens, EligibilityOnlineOnly)
+	assertResult(t, 2, len(eligibleKitchens))
+	assertResult(t, "c", excludedKitchens[0].ID)
+	assertResult(t, "offline", excludedKitchens[0].Reason)
+
+	eligibleKitchens, excludedKitchens = filterEligibleKitchens(kitchens, EligibilityIncludeAll)
+	assertResult(t, 3, len(eligibleKitchens))
+	assertResult(t, 0, len(excludedKitchens))
+}
+
+func TestParseEligibilityPolicy(t *testing.T) {
+	policy, _ := parseEligibilityPolicy("online_only")
+	assertResult(t, EligibilityOnlineOnly, policy)
+
+	_, err := parseEligibilityPolicy("everything")
+	assertResult(t, "\"everything\" is not a valid eligibility policy, expected one of active_only, "+
+		"online_only or include_all", err.Error())
+}
@@ -0,0 +1,299 @@
+package clustertruck
+
+import (
+	"net/http"
+	"net"
+	"net/url"
+	"fmt"
+	"errors"
+	"sort"
+	"context"
+	"time"
+)
+
+// Machine readable error codes, returned to users in the "code" of error responses
+const (
+	ErrorCodeInvalidRequest = "invalid_request"
+	ErrorCodeUnauthorized   = "unauthorized"
+	// The starting address could not be found by the upstream APIs
+	ErrorCodeAddressNotFound = "address_not_found"
+	// There is no route between the starting address and a kitchen
+	ErrorCodeNoRoute = "no_route"
+	// None of the kitchens could be considered, such as when none of them deliver to the starting address
+	ErrorCodeNoKitchens = "no_kitchens"
+	// The upstream API refused the request, such as when the API key is invalid
+	ErrorCodeUpstreamRejected = "upstream_rejected"
+	// The upstream API could not be reached, or returned a response that could not be understood
+	ErrorCodeUpstreamBadResponse = "upstream_bad_response"
+	// The upstream API is rate limiting us
+	ErrorCodeUpstreamOverQueryLimit = "upstream_over_query_limit"
+	// The upstream API had an error on its end
+	ErrorCodeUpstreamUnavailable = "upstream_unavailable"
+	ErrorCodeUpstreamTimeout     = "upstream_timeout"
+	// The upstream API failed too many times in a row, so it isn't called until its circuit breaker closes
+	ErrorCodeUpstreamCircuitOpen = "upstream_circuit_open"
+	// The request took longer than the server allows, or the user stopped waiting for it
+	ErrorCodeRequestTimeout  = "request_timeout"
+	ErrorCodeRequestCanceled = "request_canceled"
+	// Too many directions calls are queued, the user should try again after the Retry-After header
+	ErrorCodeServerBusy = "server_busy"
+	// There is no job with the ID the user asked for
+	ErrorCodeJobNotFound = "job_not_found"
+	// The endpoint doesn't support the HTTP method of the request
+	ErrorCodeMethodNotAllowed = "method_not_allowed"
+	ErrorCodeInternal         = "internal_error"
+)
+
+// Status used when the user closed the connection before a response was sent. Nobody reads it,
+// but it keeps these requests apart from failures in the logs.
+const statusClientClosedRequest = 499
+
+// Names of the upstream APIs, used in errors
+const (
+	upstreamKitchensAPI          = "ClusterTruck Kitchens API"
+	upstreamGoogleDirections     = "GMaps Directions API"
+	upstreamGoogleDistanceMatrix = "GMaps Distance Matrix API"
+	upstreamGoogleGeocoding      = "GMaps Geocoding API"
+	upstreamOSRM                 = "OSRM server"
+)
+
+// An error with a machine readable code, which decides the HTTP status returned to the user
+type APIError struct {
+	Code    string
+	Message string
+	// Name of the upstream API the error came from. Empty if the error didn't come from an upstream API
+	Upstream string
+	// Status reported by the upstream API, such as ZERO_RESULTS or an HTTP status code
+	UpstreamStatus string
+	// Extra details returned to the user in the "parameters" of the error response
+	Parameters map[string]interface{}
+	// When the user should try again, sent in the Retry-After header. 0 if the user shouldn't be told
+	RetryAfter time.Duration
+}
+
+func newAPIError(code string, message string) *APIError {
+	return &APIError{
+		Code:    code,
+		Message: message,
+	}
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// HTTP status to return to the user for this error
+func (e *APIError) StatusCode() int {
+	switch e.Code {
+	case ErrorCodeInvalidRequest:
+		return http.StatusBadRequest
+	case ErrorCodeUnauthorized:
+		return http.StatusUnauthorized
+	case ErrorCodeAddressNotFound, ErrorCodeNoRoute, ErrorCodeNoKitchens, ErrorCodeJobNotFound:
+		return http.StatusNotFound
+	case ErrorCodeMethodNotAllowed:
+		return http.StatusMethodNotAllowed
+	case ErrorCodeUpstreamRejected, ErrorCodeUpstreamBadResponse:
+		return http.StatusBadGateway
+	case ErrorCodeUpstreamOverQueryLimit, ErrorCodeUpstreamUnavailable, ErrorCodeUpstreamCircuitOpen,
+		ErrorCodeServerBusy:
+		return http.StatusServiceUnavailable
+	case ErrorCodeUpstreamTimeout, ErrorCodeRequestTimeout:
+		return http.StatusGatewayTimeout
+	case ErrorCodeRequestCanceled:
+		return statusClientClosedRequest
+	}
+
+	return http.StatusInternalServerError
+}
+
+// Whether the error is a problem with an upstream API, rather than with what the user asked for
+func (e *APIError) isUpstreamFailure() bool {
+	return e.StatusCode() >= http.StatusInternalServerError
+}
+
+// Returns the code of the error, or the internal error code if it is not an APIError
+func errorCode(err error) string {
+	if apiError, ok := err.(*APIError); ok {
+		return apiError.Code
+	}
+
+	return ErrorCodeInternal
+}
+
+// The message of an error that can be returned to users. The messages of APIErrors are written by the service,
+// while other errors may come from anywhere and could have the URL of an upstream request, or the GMaps API key
+// in it, so a fixed message is given instead.
+func publicErrorMessage(err error) string {
+	if apiError, ok := err.(*APIError); ok {
+		return apiError.Message
+	}
+
+	return "an unexpected error occurred"
+}
+
+// The code and the message of an error, for the errors that are part of a response rather than the response itself
+func publicError(err error) *HTTPError {
+	return &HTTPError{
+		Code:    errorCode(err),
+		Message: publicErrorMessage(err),
+	}
+}
+
+// Used when the context of the incoming request is done, which is why whatever was in progress failed
+func contextError(ctx context.Context) *APIError {
+	if ctx.Err() == context.DeadlineExceeded {
+		return newAPIError(ErrorCodeRequestTimeout, "the request took too long to complete")
+	}
+
+	return newAPIError(ErrorCodeRequestCanceled, "the request was canceled")
+}
+
+// Returns the context error if the context is done, which is the real reason for the error.
+// Otherwise the error is returned as it is.
+func errorOrContextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return contextError(ctx)
+	}
+
+	return err
+}
+
+// Adds context to the message of an error, keeping its code
+func wrapError(err error, message string) error {
+	apiError, ok := err.(*APIError)
+	if !ok {
+		return errors.New(fmt.Sprintf("%s: %s", message, err.Error()))
+	}
+
+	wrappedError := *apiError
+	wrappedError.Message = fmt.Sprintf("%s: %s", message, apiError.Message)
+	return &wrappedError
+}
+
+// Explains why no routes were found from the starting address, given the error for each kitchen.
+//
+// Failures of the directions provider are reported first, since the user can't do anything about them.
+// If every kitchen failed because the starting address wasn't found, that is reported next.
+// Otherwise, there simply is no route to any of the kitchens.
+func noRoutesFoundError(kitchenIdToErrorMap map[string]error) error {
+	kitchenIds := make([]string, 0, len(kitchenIdToErrorMap))
+	for kitchenId := range kitchenIdToErrorMap {
+		kitchenIds = append(kitchenIds, kitchenId)
+	}
+	sort.Strings(kitchenIds)
+
+	addressNotFound := len(kitchenIds) > 0
+	for _, kitchenId := range kitchenIds {
+		err := kitchenIdToErrorMap[kitchenId]
+		apiError, ok := err.(*APIError)
+		if !ok || apiError.isUpstreamFailure() {
+			return wrapError(err, "no routes were found from your starting address")
+		}
+		if apiError.Code != ErrorCodeAddressNotFound {
+			addressNotFound = false
+		}
+	}
+
+	if addressNotFound {
+		return wrapError(kitchenIdToErrorMap[kitchenIds[0]], "your starting address could not be found")
+	}
+
+	return newAPIError(ErrorCodeNoRoute, "no routes were found from your starting address")
+}
+
+// Used when the response of an upstream API could not be read or understood. The message is followed by the error.
+//
+// Errors of the HTTP client include the URL of the request, whose query has the GMaps API key, so only the
+// underlying error is kept, since the message is returned to users.
+func upstreamRequestError(upstream string, message string, err error) *APIError {
+	if urlError, ok := err.(*url.Error); ok {
+		err = urlError.Err
+	}
+
+	return &APIError{
+		Code:     ErrorCodeUpstreamBadResponse,
+		Message:  fmt.Sprintf("%s: %s", message, err.Error()),
+		Upstream: upstream,
+	}
+}
+
+// Used when a request to an upstream API could not be sent, or no response came back.
+// The code depends on whether the request timed out, or was never sent because the circuit breaker is open.
+func upstreamTransportError(upstream string, message string, err error) *APIError {
+	apiError := upstreamRequestError(upstream, message, err)
+	if circuitOpenError, ok := err.(*CircuitOpenError); ok {
+		apiError.Code = ErrorCodeUpstreamCircuitOpen
+		apiError.RetryAfter = circuitOpenError.RetryAfter
+	} else if netError, ok := err.(net.Error); ok && netError.Timeout() {
+		apiError.Code = ErrorCodeUpstreamTimeout
+	}
+
+	return apiError
+}
+
+// Whether the HTTP status means the upstream API failed, rather than answering with an error in the body
+func isUpstreamFailureStatus(statusCode int) bool {
+	return statusCode >= http.StatusInternalServerError || statusCode == http.StatusTooManyRequests
+}
+
+// Used when an upstream API responds with an HTTP status that isn't successful
+func upstreamHTTPStatusError(upstream string, statusCode int) *APIError {
+	code := ErrorCodeUpstreamRejected
+	if statusCode == http.StatusTooManyRequests {
+		code = ErrorCodeUpstreamOverQueryLimit
+	} else if statusCode == http.StatusGatewayTimeout {
+		code = ErrorCodeUpstreamTimeout
+	} else if statusCode >= http.StatusInternalServerError {
+		code = ErrorCodeUpstreamUnavailable
+	}
+
+	return &APIError{
+		Code:           code,
+		Message:        fmt.Sprintf("The %s responded with HTTP status %d", upstream, statusCode),
+		Upstream:       upstream,
+		UpstreamStatus: fmt.Sprintf("%d", statusCode),
+	}
+}
+
+// Used when a GMaps API responds with a status other than OK. See
+// https://developers.google.com/maps/documentation/directions/intro#StatusCodes
+func googleMapsStatusError(upstream string, status string, message string) *APIError {
+	code := ErrorCodeUpstreamRejected
+	switch status {
+	case "ZERO_RESULTS", "MAX_ROUTE_LENGTH_EXCEEDED":
+		code = ErrorCodeNoRoute
+		if upstream == upstreamGoogleGeocoding {
+			code = ErrorCodeAddressNotFound
+		}
+	case "NOT_FOUND":
+		code = ErrorCodeAddressNotFound
+	case "OVER_QUERY_LIMIT", "OVER_DAILY_LIMIT":
+		code = ErrorCodeUpstreamOverQueryLimit
+	case "UNKNOWN_ERROR":
+		code = ErrorCodeUpstreamUnavailable
+	}
+
+	return &APIError{
+		Code:           code,
+		Message:        message,
+		Upstream:       upstream,
+		UpstreamStatus: status,
+	}
+}
+
+// Used when an OSRM server responds with a code other than Ok. See
+// http://project-osrm.org/docs/v5.5.1/api/#responses
+func osrmCodeError(osrmCode string, message string) *APIError {
+	code := ErrorCodeUpstreamRejected
+	if osrmCode == "NoRoute" || osrmCode == "NoSegment" {
+		code = ErrorCodeNoRoute
+	}
+
+	return &APIError{
+		Code:           code,
+		Message:        message,
+		Upstream:       upstreamOSRM,
+		UpstreamStatus: osrmCode,
+	}
+}
@@ -0,0 +1,71 @@
+package clustertruck
+
+import (
+	"testing"
+	"net/http"
+	"errors"
+)
+
+func TestGoogleMapsStatusErrorCodes(t *testing.T) {
+	assertResult(t, ErrorCodeNoRoute, googleMapsStatusError(upstreamGoogleDirections, "ZERO_RESULTS", "").Code)
+	assertResult(t, ErrorCodeAddressNotFound,
+		googleMapsStatusError(upstreamGoogleGeocoding, "ZERO_RESULTS", "").Code)
+	assertResult(t, ErrorCodeAddressNotFound, googleMapsStatusError(upstreamGoogleDirections, "NOT_FOUND", "").Code)
+	assertResult(t, ErrorCodeUpstreamOverQueryLimit,
+		googleMapsStatusError(upstreamGoogleDirections, "OVER_QUERY_LIMIT", "").Code)
+	assertResult(t, ErrorCodeUpstreamRejected,
+		googleMapsStatusError(upstreamGoogleDirections, "REQUEST_DENIED", "").Code)
+}
+
+func TestAPIErrorStatusCodes(t *testing.T) {
+	assertResult(t, http.StatusBadRequest, newAPIError(ErrorCodeInvalidRequest, "").StatusCode())
+	assertResult(t, http.StatusNotFound, newAPIError(ErrorCodeNoRoute, "").StatusCode())
+	assertResult(t, http.StatusNotFound, newAPIError(ErrorCodeAddressNotFound, "").StatusCode())
+	assertResult(t, http.StatusBadGateway, newAPIError(ErrorCodeUpstreamRejected, "").StatusCode())
+	assertResult(t, http.StatusServiceUnavailable, newAPIError(ErrorCodeUpstreamOverQueryLimit, "").StatusCode())
+	assertResult(t, http.StatusGatewayTimeout, newAPIError(ErrorCodeUpstreamTimeout, "").StatusCode())
+	assertResult(t, http.StatusInternalServerError, newAPIError(ErrorCodeInternal, "").StatusCode())
+}
+
+func TestUpstreamHTTPStatusError(t *testing.T) {
+	err := upstreamHTTPStatusError(upstreamKitchensAPI, http.StatusServiceUnavailable)
+	assertResult(t, ErrorCodeUpstreamUnavailable, err.Code)
+	assertResult(t, "503", err.UpstreamStatus)
+	assertResult(t, "The ClusterTruck Kitchens API responded with HTTP status 503", err.Error())
+
+	assertResult(t, ErrorCodeUpstreamOverQueryLimit,
+		upstreamHTTPStatusError(upstreamKitchensAPI, http.StatusTooManyRequests).Code)
+	assertResult(t, ErrorCodeUpstreamRejected, upstreamHTTPStatusError(upstreamKitchensAPI, http.StatusForbidden).Code)
+}
+
+func TestNoRoutesFoundError(t *testing.T) {
+	noRoute := googleMapsStatusError(upstreamGoogleDirections, "ZERO_RESULTS", "no route")
+	notFound := googleMapsStatusError(upstreamGoogleDirections, "NOT_FOUND", "not found")
+	overQueryLimit := googleMapsStatusError(upstreamGoogleDirections, "OVER_QUERY_LIMIT", "over query limit")
+
+	err := noRoutesFoundError(map[string]error{"a": noRoute, "b": noRoute})
+	assertResult(t, ErrorCodeNoRoute, errorCode(err))
+	assertResult(t, "no routes were found from your starting address", err.Error())
+
+	err = noRoutesFoundError(map[string]error{"a": notFound, "b": notFound})
+	assertResult(t, ErrorCodeAddressNotFound, errorCode(err))
+	assertResult(t, "your starting address could not be found: not found", err.Error())
+
+	err = noRoutesFoundError(map[string]error{"a": noRoute, "b": overQueryLimit})
+	assertResult(t, ErrorCodeUpstreamOverQueryLimit, errorCode(err))
+	assertResult(t, "no routes were found from your starting address: over query limit", err.Error())
+
+	err = noRoutesFoundError(map[string]error{"a": errors.New("unexpected")})
+	assertResult(t, ErrorCodeInternal, errorCode(err))
+}
+
+func TestPublicError(t *testing.T) {
+	err := publicError(upstreamHTTPStatusError(upstreamKitchensAPI, http.StatusServiceUnavailable))
+	assertResult(t, ErrorCodeUpstreamUnavailable, err.Code)
+	assertResult(t, "The ClusterTruck Kitchens API responded with HTTP status 503", err.Message)
+
+	// Errors that aren't from the service could have anything in their message, such as the URL of a request
+	err = publicError(errors.New("Get https://maps.googleapis.com/maps/api/directions/json?key=secret: EOF"))
+	assertResult(t, ErrorCodeInternal, err.Code)
+	assertResult(t, "an unexpected error occurred", err.Message)
+}
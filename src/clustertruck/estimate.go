@@ -0,0 +1,139 @@
+package clustertruck
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Summary of the routes that are estimated rather than found by the directions provider
+const estimatedRouteSummary = "Estimated from the straight-line distance"
+
+// Average speed for the part of a trip up to a distance from the start. Short trips are mostly on slower
+// city streets, while long trips are mostly on highways.
+type SpeedBand struct {
+	// 0 for the last band, which covers the rest of the trip
+	UpToMiles    float64
+	MilesPerHour float64
+}
+
+// The first 5 miles at 25 mph, up to 20 miles at 45 mph, and the rest at 60 mph
+func DefaultSpeedProfile() []SpeedBand {
+	return []SpeedBand{
+		{UpToMiles: 5, MilesPerHour: 25},
+		{UpToMiles: 20, MilesPerHour: 45},
+		{MilesPerHour: 60},
+	}
+}
+
+// Speed profiles are written as "miles:mph" bands separated by commas, with only the speed given for the
+// last band, such as "5:25,20:45,60"
+func parseSpeedProfile(value string) ([]SpeedBand, error) {
+	var profile []SpeedBand
+	bands := strings.Split(value, ",")
+	for i, band := range bands {
+		isLastBand := i == len(bands)-1
+		parts := strings.Split(strings.TrimSpace(band), ":")
+		if isLastBand != (len(parts) == 1) {
+			return nil, errors.New(fmt.Sprintf("\"%s\" is not a valid speed profile, it must look like "+
+				"\"5:25,20:45,60\", with only the speed given for the last band", value))
+		}
+
+		var speedBand SpeedBand
+		var err error
+		if !isLastBand {
+			speedBand.UpToMiles, err = strconv.ParseFloat(parts[0], 64)
+			if err != nil || speedBand.UpToMiles <= 0 ||
+				(len(profile) > 0 && speedBand.UpToMiles <= profile[len(profile)-1].UpToMiles) {
+				return nil, errors.New(fmt.Sprintf("\"%s\" is not a valid distance, distances must be positive "+
+					"and increasing", parts[0]))
+			}
+		}
+		speedBand.MilesPerHour, err = strconv.ParseFloat(parts[len(parts)-1], 64)
+		if err != nil || speedBand.MilesPerHour <= 0 {
+			return nil, errors.New(fmt.Sprintf("\"%s\" is not a valid speed, it must be a positive number",
+				parts[len(parts)-1]))
+		}
+		profile = append(profile, speedBand)
+	}
+
+	return profile, nil
+}
+
+// Estimates the drive time, in seconds, of a trip of the given length, in meters
+func estimateDriveSeconds(meters float64, profile []SpeedBand) float64 {
+	seconds := 0.0
+	bandStart := 0.0
+	for _, band := range profile {
+		bandEnd := math.Inf(1)
+		if band.UpToMiles > 0 {
+			bandEnd = band.UpToMiles * metersPerMile
+		}
+
+		metersInBand := math.Min(meters, bandEnd) - bandStart
+		if metersInBand <= 0 {
+			break
+		}
+		seconds += metersInBand / (band.MilesPerHour * metersPerMile) * 3600
+		bandStart = bandEnd
+	}
+
+	return seconds
+}
+
+// Estimates a route from the great-circle distance, assuming roads are longer than a straight line by the
+// circuity factor. Estimated routes don't take traffic into account, and don't have steps.
+func estimateRoute(origin Coordinates, destination Coordinates, circuity float64, profile []SpeedBand) Route {
+	meters := haversineDistance(origin, destination) * circuity
+	seconds := estimateDriveSeconds(meters, profile)
+
+	return Route{
+		Legs: []Leg{
+			{
+				Distance: MeasurementValues{Text: formatDistance(int(meters)), Value: int(meters)},
+				Duration: MeasurementValues{Text: formatDuration(int(seconds)), Value: int(seconds)},
+			},
+		},
+		Summary: estimatedRouteSummary,
+	}
+}
+
+// Whether the error means the directions provider failed, rather than answering that there is no route
+func isEstimatableError(err error) bool {
+	apiError, ok := err.(*APIError)
+
+	return !ok || apiError.isUpstreamFailure()
+}
+
+// Estimates routes to the kitchens that directions could not be found to because the directions provider
+// failed. Estimated kitchens are removed from kitchenIdToErrorMap and added to kitchenIdToRouteMap.
+// Kitchens that have no route are left as they are.
+func estimateRoutesToKitchens(origin Coordinates, kitchenIdToErrorMap map[string]error,
+	kitchenIdToRouteMap map[string]*Route, kitchens map[string]Kitchen, circuity float64, profile []SpeedBand) {
+
+	for kitchenId, err := range kitchenIdToErrorMap {
+		if !isEstimatableError(err) {
+			continue
+		}
+
+		route := estimateRoute(origin, kitchens[kitchenId].Location, circuity, profile)
+		kitchenIdToRouteMap[kitchenId] = &route
+		delete(kitchenIdToErrorMap, kitchenId)
+	}
+}
+
+// Tells the user how far an estimated drive time can be trusted, and why it was estimated. Only the code of
+// the error is given, since its message can have details of the upstream request, such as its URL.
+func estimateConfidenceNote(leg *Leg, circuity float64, err error) string {
+	averageMilesPerHour := 0.0
+	if leg.Duration.Value > 0 {
+		averageMilesPerHour = float64(leg.Distance.Value) / metersPerMile / (float64(leg.Duration.Value) / 3600)
+	}
+
+	return fmt.Sprintf("Low confidence: directions could not be found (%s), so the drive time was estimated "+
+		"from the straight-line distance of %s, assuming roads are %g times longer and an average speed of "+
+		"%.0f mph. Actual drive times can differ by 30%% or more.", errorCode(err),
+		formatDistance(int(float64(leg.Distance.Value)/circuity)), circuity, averageMilesPerHour)
+}
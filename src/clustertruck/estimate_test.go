@@ -0,0 +1,140 @@
+package clustertruck
+
+import (
+	"testing"
+	"net/http"
+	"bytes"
+	"context"
+	"os"
+	"strings"
+)
+
+// Directions calls fail with a 503, while the Geocoding and Kitchens APIs still answer
+func createClientWithFailingDirections() *MockClient {
+	client := createClientWithRoutesToEveryKitchen()
+	doFunc := client.DoFunc
+	client.DoFunc = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "directions") {
+			return createHttpResponseForTest(http.StatusServiceUnavailable, bytes.NewBufferString("")), nil
+		}
+		return doFunc(req)
+	}
+
+	return client
+}
+
+func TestParseSpeedProfile(t *testing.T) {
+	profile, err := parseSpeedProfile("5:25, 20:45, 60")
+	assertResult(t, nil, err)
+	assertResult(t, 3, len(profile))
+	for i, speedBand := range DefaultSpeedProfile() {
+		assertResult(t, speedBand, profile[i])
+	}
+
+	profile, err = parseSpeedProfile("50")
+	assertResult(t, nil, err)
+	assertResult(t, 1, len(profile))
+	assertResult(t, SpeedBand{MilesPerHour: 50}, profile[0])
+
+	_, err = parseSpeedProfile("5:25,20:45")
+	assertResult(t, true, err != nil)
+	_, err = parseSpeedProfile("20:25,5:45,60")
+	assertResult(t, "\"5\" is not a valid distance, distances must be positive and increasing", err.Error())
+	_, err = parseSpeedProfile("5:fast,60")
+	assertResult(t, "\"fast\" is not a valid speed, it must be a positive number", err.Error())
+}
+
+func TestEstimateDriveSeconds(t *testing.T) {
+	// 5 miles at 25 mph, then 5 miles at 45 mph
+	assertResult(t, 1120, int(estimateDriveSeconds(10*metersPerMile, DefaultSpeedProfile())+0.5))
+	// 5 miles at 25 mph, 15 miles at 45 mph, then 30 miles at 60 mph
+	assertResult(t, 3720, int(estimateDriveSeconds(50*metersPerMile, DefaultSpeedProfile())+0.5))
+	assertResult(t, 0.0, estimateDriveSeconds(0, DefaultSpeedProfile()))
+}
+
+func TestEstimateRoute(t *testing.T) {
+	// About 10 miles apart, as the crow flies
+	route := estimateRoute(Coordinates{Lat: 39.7684, Lng: -86.1581}, Coordinates{Lat: 39.9134, Lng: -86.1581},
+		1.3, []SpeedBand{{MilesPerHour: 30}})
+
+	assertResult(t, estimatedRouteSummary, route.Summary)
+	assertResult(t, "13.0 mi", route.Legs[0].Distance.Text)
+	assertResult(t, "26 mins", route.Legs[0].Duration.Text)
+	assertResult(t, (*MeasurementValues)(nil), route.Legs[0].DurationInTraffic)
+}
+
+func TestFindDriveTimeEstimatesWhenDirectionsFail(t *testing.T) {
+	service := createDriveTimeServiceForTest(createClientWithFailingDirections(), "2017-12-04 12:00")
+
+	closestClusterTruckInfo, err := service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{StartingAddress: "Martinsville, IN", Limit: 6, Explain: true})
+	assertResult(t, nil, err)
+	assertResult(t, true, closestClusterTruckInfo.Estimated)
+	// Either the 503, or the circuit breaker that opened after the first calls failed
+	assertResult(t, true, strings.HasPrefix(closestClusterTruckInfo.ConfidenceNote,
+		"Low confidence: directions could not be found (upstream_unavailable), ") ||
+		strings.HasPrefix(closestClusterTruckInfo.ConfidenceNote,
+			"Low confidence: directions could not be found (upstream_circuit_open), "))
+	assertResult(t, 0, len(closestClusterTruckInfo.ExcludedKitchens))
+	assertResult(t, 6, len(closestClusterTruckInfo.Kitchens))
+
+	// Kitchens are ranked by their estimated drive time
+	for i := 1; i < len(closestClusterTruckInfo.Kitchens); i++ {
+		previous, kitchen := closestClusterTruckInfo.Kitchens[i-1], closestClusterTruckInfo.Kitchens[i]
+		if previous.KitchenStatus == kitchen.KitchenStatus {
+			assertResult(t, true, previous.DriveTime.Value <= kitchen.DriveTime.Value)
+		}
+	}
+	assertResult(t, closestClusterTruckInfo.Kitchens[0].LocationName, closestClusterTruckInfo.LocationName)
+
+	explanation := findExplanationForTest(closestClusterTruckInfo.Explanation, closestClusterTruckInfo.LocationName)
+	assertResult(t, explanationOutcomeSelected, explanation.Outcome)
+	// Either the 503, or the circuit breaker that opened after the first calls failed
+	assertResult(t, true, explanation.UpstreamStatus != "OK")
+	assertResult(t, estimatedRouteSummary, explanation.BestRoute.Summary)
+}
+
+func TestFindDriveTimeWithoutEstimateFallback(t *testing.T) {
+	service := createDriveTimeServiceForTest(createClientWithFailingDirections(), "2017-12-04 12:00")
+	service.config.EstimateFallback = false
+
+	_, err := service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{StartingAddress: "Martinsville, IN"})
+	assertResult(t, http.StatusServiceUnavailable, err.(*APIError).StatusCode())
+}
+
+func TestFindDriveTimeDoesNotEstimateWhenThereIsNoRoute(t *testing.T) {
+	client := createClientWithRoutesToEveryKitchen()
+	doFunc := client.DoFunc
+	client.DoFunc = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "directions") {
+			return createHttpResponseForTest(http.StatusOK,
+				bytes.NewBuffer(readMockFile("directions_response_no_route.json"))), nil
+		}
+		return doFunc(req)
+	}
+	service := createDriveTimeServiceForTest(client, "2017-12-04 12:00")
+
+	_, err := service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{StartingAddress: "Martinsville, IN"})
+	assertResult(t, ErrorCodeNoRoute, errorCode(err))
+}
+
+func TestLoadConfigFromEnvWithEstimateSettings(t *testing.T) {
+	os.Setenv("CT_ESTIMATE_FALLBACK", "false")
+	os.Setenv("CT_ESTIMATE_SPEED_PROFILE", "10:30,55")
+	defer os.Unsetenv("CT_ESTIMATE_FALLBACK")
+	defer os.Unsetenv("CT_ESTIMATE_SPEED_PROFILE")
+
+	config, err := LoadConfigFromEnv()
+	assertResult(t, nil, err)
+	assertResult(t, false, config.EstimateFallback)
+	assertResult(t, 2, len(config.EstimateSpeedProfile))
+	assertResult(t, SpeedBand{UpToMiles: 10, MilesPerHour: 30}, config.EstimateSpeedProfile[0])
+	assertResult(t, SpeedBand{MilesPerHour: 55}, config.EstimateSpeedProfile[1])
+
+	os.Setenv("CT_ESTIMATE_CIRCUITY", "0.8")
+	defer os.Unsetenv("CT_ESTIMATE_CIRCUITY")
+	_, err = LoadConfigFromEnv()
+	assertResult(t, "CT_ESTIMATE_CIRCUITY must be at least 1, but was 0.8", err.Error())
+}
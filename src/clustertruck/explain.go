@@ -0,0 +1,175 @@
+package clustertruck
+
+import (
+	"time"
+)
+
+// Outcome of each kitchen in the explanation of a response
+const (
+	// The kitchen the user was sent to
+	explanationOutcomeSelected = "selected"
+	// Directions were found to the kitchen, but another kitchen was ranked first
+	explanationOutcomeRankedLower = "ranked_lower"
+	// The kitchen was not ranked. The reason is the same as in excluded_kitchens
+	explanationOutcomeExcluded = "excluded"
+	// The kitchen did not answer within max_latency_ms
+	explanationOutcomePending = "pending"
+)
+
+// Reasons a kitchen that directions were found to was not selected
+const (
+	// The kitchen is closed when the user arrives, while another kitchen is open
+	explanationReasonClosed = "closed"
+	// Another kitchen has a better ranking score
+	explanationReasonRankedLower = "ranked_lower"
+	// The directions provider did not answer within max_latency_ms
+	explanationReasonMaxLatency = "max_latency"
+)
+
+// Tells why a kitchen was or was not selected. Only returned when an explanation is requested.
+type KitchenExplanation struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Either "selected", "ranked_lower", "excluded" or "pending"
+	Outcome string `json:"outcome"`
+	// Why the kitchen was not selected, such as "closed" or "inactive"
+	Reason string `json:"reason,omitempty"`
+	// Position among the kitchens that directions were found to, starting at 1. Not set for excluded kitchens
+	Rank int `json:"rank,omitempty"`
+	// Score of the best route, given by the ranking strategy. Lower is better
+	Score *float64 `json:"score,omitempty"`
+	// Either "open" or "closed", depending on whether the kitchen is open when the user arrives
+	KitchenStatus string `json:"kitchen_status,omitempty"`
+	// The route that was ranked first among the routes to the kitchen
+	BestRoute *ExplainedRoute `json:"best_route,omitempty"`
+	// The other routes to the kitchen, in the order the directions provider returned them
+	Alternatives []ExplainedRoute `json:"alternatives,omitempty"`
+	// Status returned by the directions provider for this kitchen, such as "OK" or "ZERO_RESULTS".
+	// Not set if the directions provider wasn't asked about the kitchen
+	UpstreamStatus string `json:"upstream_status,omitempty"`
+	// How long the directions provider took to answer. 0 if the answer was cached
+	LatencyMillis float64 `json:"latency_ms"`
+	// Whether the answer of the directions provider came from the directions cache
+	Cached bool `json:"cached"`
+	// Whether the answer is an expired one from the directions cache, because the circuit breaker of the
+	// directions provider is open
+	Stale bool `json:"stale,omitempty"`
+	// Only set if directions to the kitchen could not be found
+	Error *HTTPError `json:"error,omitempty"`
+}
+
+type ExplainedRoute struct {
+	Summary            string                     `json:"summary"`
+	DriveTime          ResponseMeasurementValues  `json:"drive_time"`
+	DriveTimeInTraffic *ResponseMeasurementValues `json:"drive_time_in_traffic,omitempty"`
+	DriveDistance      ResponseMeasurementValues  `json:"drive_distance"`
+	// Given by the ranking strategy. Lower is better
+	Score float64 `json:"score"`
+}
+
+// Explains every kitchen that was considered. Ranked kitchens come first, in the order they were ranked,
+// followed by the excluded kitchens, and the kitchens that did not answer in time.
+func explainKitchens(kitchenIdToRouteMap map[string]*Route,
+	kitchenIdToDirectionsMap map[string]*KitchenIDDirectionsPair, kitchens map[string]Kitchen,
+	excludedKitchens []ExcludedKitchen, pendingKitchens []PendingKitchen, departureTime time.Time,
+	ranker Ranker) []KitchenExplanation {
+
+	kitchenIds, openKitchenIdToRouteMap := sortKitchensOpenFirst(kitchenIdToRouteMap, kitchens, departureTime,
+		ranker)
+	explanations := make([]KitchenExplanation, 0, len(kitchenIds)+len(excludedKitchens)+len(pendingKitchens))
+	for i, kitchenId := range kitchenIds {
+		bestRoute := kitchenIdToRouteMap[kitchenId]
+		score := ranker.Score(&bestRoute.Legs[0])
+		explanation := KitchenExplanation{
+			ID:            kitchenId,
+			Name:          kitchens[kitchenId].Name,
+			Outcome:       explanationOutcomeSelected,
+			Rank:          i + 1,
+			Score:         &score,
+			KitchenStatus: kitchenStatusOpen,
+		}
+		if _, isOpen := openKitchenIdToRouteMap[kitchenId]; !isOpen {
+			explanation.KitchenStatus = kitchenStatusClosed
+		}
+		if i > 0 {
+			explanation.Outcome = explanationOutcomeRankedLower
+			explanation.Reason = explanationReasonRankedLower
+			if explanation.KitchenStatus == kitchenStatusClosed && len(openKitchenIdToRouteMap) > 0 {
+				explanation.Reason = explanationReasonClosed
+			}
+		}
+		explainDirections(&explanation, kitchenIdToDirectionsMap[kitchenId], bestRoute, ranker)
+		// Estimated routes aren't among the answers of the directions provider
+		if explanation.BestRoute == nil {
+			explainedRoute := explainRoute(bestRoute, ranker)
+			explanation.BestRoute = &explainedRoute
+		}
+		explanations = append(explanations, explanation)
+	}
+
+	for _, excludedKitchen := range excludedKitchens {
+		explanation := KitchenExplanation{
+			ID:      excludedKitchen.ID,
+			Name:    excludedKitchen.Name,
+			Outcome: explanationOutcomeExcluded,
+			Reason:  excludedKitchen.Reason,
+			Error:   excludedKitchen.Error,
+		}
+		explainDirections(&explanation, kitchenIdToDirectionsMap[excludedKitchen.ID], nil, ranker)
+		explanations = append(explanations, explanation)
+	}
+
+	for _, pendingKitchen := range pendingKitchens {
+		explanations = append(explanations, KitchenExplanation{
+			ID:      pendingKitchen.ID,
+			Name:    pendingKitchen.Name,
+			Outcome: explanationOutcomePending,
+			Reason:  explanationReasonMaxLatency,
+		})
+	}
+
+	return explanations
+}
+
+// Adds the answer of the directions provider to the explanation. Does nothing if the directions provider
+// wasn't asked about the kitchen.
+func explainDirections(explanation *KitchenExplanation, kitchenIdDirectionsPair *KitchenIDDirectionsPair,
+	bestRoute *Route, ranker Ranker) {
+
+	if kitchenIdDirectionsPair == nil {
+		return
+	}
+
+	explanation.LatencyMillis = durationInMillis(kitchenIdDirectionsPair.Latency)
+	explanation.Cached = kitchenIdDirectionsPair.Cached
+	explanation.Stale = kitchenIdDirectionsPair.Stale
+	explanation.UpstreamStatus = "OK"
+	if kitchenIdDirectionsPair.Error != nil {
+		explanation.UpstreamStatus = errorCode(kitchenIdDirectionsPair.Error)
+		if apiError, ok := kitchenIdDirectionsPair.Error.(*APIError); ok && apiError.UpstreamStatus != "" {
+			explanation.UpstreamStatus = apiError.UpstreamStatus
+		}
+	}
+
+	for i := range kitchenIdDirectionsPair.Routes {
+		route := &kitchenIdDirectionsPair.Routes[i]
+		explainedRoute := explainRoute(route, ranker)
+		if route == bestRoute {
+			explanation.BestRoute = &explainedRoute
+		} else {
+			explanation.Alternatives = append(explanation.Alternatives, explainedRoute)
+		}
+	}
+}
+
+func explainRoute(route *Route, ranker Ranker) ExplainedRoute {
+	leg := &route.Legs[0]
+
+	return ExplainedRoute{
+		Summary:            route.Summary,
+		DriveTime:          driveTime(leg),
+		DriveTimeInTraffic: driveTimeInTraffic(leg),
+		DriveDistance:      driveDistance(leg),
+		Score:              ranker.Score(leg),
+	}
+}
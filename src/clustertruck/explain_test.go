@@ -0,0 +1,81 @@
+package clustertruck
+
+import (
+	"testing"
+	"context"
+	"net/http"
+	"strings"
+	"bytes"
+)
+
+func findExplanationForTest(explanations []KitchenExplanation, name string) *KitchenExplanation {
+	for i := range explanations {
+		if explanations[i].Name == name {
+			return &explanations[i]
+		}
+	}
+
+	return nil
+}
+
+func TestFindDriveTimeToClosestClusterTruckKitchenWithExplanation(t *testing.T) {
+	client := createClientWithRoutesToEveryKitchen()
+	doFunc := client.DoFunc
+	client.DoFunc = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "Denver") {
+			mockGmapsResponseData := readMockFile("directions_response_no_route.json")
+			return createHttpResponseForTest(http.StatusOK, bytes.NewBuffer(mockGmapsResponseData)), nil
+		}
+		return doFunc(req)
+	}
+	service := createDriveTimeServiceForTest(client, "2017-12-04 12:00")
+
+	closestClusterTruckInfo, err := service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{StartingAddress: "startingAddress", Explain: true})
+	assertResult(t, nil, err)
+	explanations := closestClusterTruckInfo.Explanation
+	assertResult(t, 6, len(explanations))
+
+	selected := explanations[0]
+	assertResult(t, "Downtown Columbus", selected.Name)
+	assertResult(t, explanationOutcomeSelected, selected.Outcome)
+	assertResult(t, 1, selected.Rank)
+	assertResult(t, 2001.0, *selected.Score)
+	assertResult(t, 2001, selected.BestRoute.DriveTime.Value)
+	assertResult(t, 2, len(selected.Alternatives))
+	assertResult(t, "OK", selected.UpstreamStatus)
+	assertResult(t, false, selected.Cached)
+
+	bloomington := explanations[1]
+	assertResult(t, "Bloomington", bloomington.Name)
+	assertResult(t, explanationOutcomeRankedLower, bloomington.Outcome)
+	assertResult(t, explanationReasonRankedLower, bloomington.Reason)
+	assertResult(t, 2, bloomington.Rank)
+
+	// Kansas City is closer than Cleveland, but closed when the user arrives
+	kansasCity := findExplanationForTest(explanations, "Kansas City")
+	assertResult(t, explanationReasonClosed, kansasCity.Reason)
+	assertResult(t, kitchenStatusClosed, kansasCity.KitchenStatus)
+	assertResult(t, 5, kansasCity.Rank)
+
+	denver := explanations[5]
+	assertResult(t, "Denver", denver.Name)
+	assertResult(t, explanationOutcomeExcluded, denver.Outcome)
+	assertResult(t, exclusionReasonNoRoute, denver.Reason)
+	assertResult(t, "ZERO_RESULTS", denver.UpstreamStatus)
+	assertResult(t, ErrorCodeNoRoute, denver.Error.Code)
+	assertResult(t, true, denver.BestRoute == nil)
+
+	closestClusterTruckInfo, _ = service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{StartingAddress: "startingAddress", Explain: true})
+	assertResult(t, true, closestClusterTruckInfo.Explanation[0].Cached)
+	assertResult(t, 0.0, closestClusterTruckInfo.Explanation[0].LatencyMillis)
+}
+
+func TestFindDriveTimeToClosestClusterTruckKitchenWithoutExplanation(t *testing.T) {
+	closestClusterTruckInfo, _ := createDriveTimeServiceForTest(createClientWithRoutesToEveryKitchen(),
+		"2017-12-04 12:00").findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{StartingAddress: "startingAddress"})
+
+	assertResult(t, 0, len(closestClusterTruckInfo.Explanation))
+}
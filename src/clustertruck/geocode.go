@@ -0,0 +1,126 @@
+package clustertruck
+
+import (
+	"net/url"
+	"net/http"
+	"io/ioutil"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"context"
+	"time"
+)
+
+// Contains data returned from a call to the GMaps Geocoding API
+// The GMaps Geocoding API returns a lot more data, but we ignore the unused portions.
+type GMapsGeocoding struct {
+	Results []GeocodingResult `json:"results"`
+	Status  string            `json:"status"`
+}
+
+type GeocodingResult struct {
+	FormattedAddress string           `json:"formatted_address"`
+	Geometry         GeocodingGeometry `json:"geometry"`
+	PlaceID          string           `json:"place_id"`
+}
+
+type GeocodingGeometry struct {
+	Location Coordinates `json:"location"`
+}
+
+// Finds coordinates of addresses with the GMaps Geocoding API
+type GoogleGeocoder struct {
+	httpClient HttpClient
+	baseURL    string
+	apiKey     string
+	timeout    time.Duration
+}
+
+func NewGoogleGeocoder(httpClient HttpClient, config Config) *GoogleGeocoder {
+	return &GoogleGeocoder{
+		httpClient: httpClient,
+		baseURL:    config.GoogleMapsURL,
+		apiKey:     config.GoogleMapsAPIKey,
+		timeout:    config.GoogleMapsTimeout,
+	}
+}
+
+// Finds the coordinates of an address, using the first result of the GMaps Geocoding API
+func (g *GoogleGeocoder) Geocode(ctx context.Context, address string) (*GeocodingResult, error) {
+	parameters := url.Values{}
+	parameters.Add("address", address)
+
+	return g.geocode(ctx, parameters, "address")
+}
+
+// Finds the coordinates and address of a GMaps place ID
+func (g *GoogleGeocoder) GeocodePlaceID(ctx context.Context, placeId string) (*GeocodingResult, error) {
+	parameters := url.Values{}
+	parameters.Add("place_id", placeId)
+
+	return g.geocode(ctx, parameters, "place ID")
+}
+
+// Finds the address closest to the coordinates, using the first result of the GMaps Geocoding API
+func (g *GoogleGeocoder) ReverseGeocode(ctx context.Context, coordinates Coordinates) (*GeocodingResult, error) {
+	parameters := url.Values{}
+	parameters.Add("latlng", googleMapsLocation(Waypoint{Coordinates: &coordinates}))
+
+	return g.geocode(ctx, parameters, "coordinates")
+}
+
+// Calls the GMaps Geocoding API with the parameters that tell what to geocode, and returns the first result
+func (g *GoogleGeocoder) geocode(ctx context.Context, parameters url.Values, what string) (*GeocodingResult,
+	error) {
+
+	requestUrl, err := url.Parse(g.baseURL + "/maps/api/geocode/json")
+	if err != nil {
+		return nil, errors.New(
+			fmt.Sprintf("There was an error creating a request to geocode the %s: %s", what, err.Error()))
+	}
+	parameters.Add("key", g.apiKey)
+	requestUrl.RawQuery = parameters.Encode()
+
+	req, err := http.NewRequest("GET", requestUrl.String(), nil)
+	if err != nil {
+		return nil, errors.New(
+			fmt.Sprintf("There was an error creating a request to geocode the %s: %s", what, err.Error()))
+	}
+
+	ctx, cancel := contextWithUpstreamTimeout(ctx, g.timeout)
+	defer cancel()
+	res, err := g.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, upstreamTransportError(upstreamGoogleGeocoding, "There was an error performing a request to the GMaps "+
+			"Geocoding API", err)
+	}
+	defer res.Body.Close()
+
+	if isUpstreamFailureStatus(res.StatusCode) {
+		return nil, upstreamHTTPStatusError(upstreamGoogleGeocoding, res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, upstreamRequestError(upstreamGoogleGeocoding, "There was an error reading the response from the GMaps "+
+			"Geocoding API", err)
+	}
+
+	var geocoding GMapsGeocoding
+	err = json.Unmarshal(body, &geocoding)
+	if err != nil {
+		return nil, upstreamRequestError(upstreamGoogleGeocoding, "There was an error deserializing the response from the "+
+			"GMaps Geocoding API", err)
+	}
+
+	if geocoding.Status != "OK" {
+		return nil, googleMapsStatusError(upstreamGoogleGeocoding, geocoding.Status,
+			fmt.Sprintf("Status of GMaps Geocoding API response was %s", geocoding.Status))
+	}
+	if len(geocoding.Results) == 0 {
+		return nil, googleMapsStatusError(upstreamGoogleGeocoding, "ZERO_RESULTS",
+			"GMaps Geocoding API did not return any results")
+	}
+
+	return &geocoding.Results[0], nil
+}
@@ -0,0 +1,55 @@
+package clustertruck
+
+import (
+	"testing"
+	"net/http"
+	"bytes"
+	"context"
+)
+
+func TestGeocodeAddress(t *testing.T) {
+	mockGeocodeResponse := readMockFile("geocode_response.json")
+	client := &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			return createHttpResponseForTest(http.StatusOK, bytes.NewBuffer(mockGeocodeResponse)), nil
+		},
+	}
+
+	result, _ := NewGoogleGeocoder(client, DefaultConfig()).Geocode(context.Background(), "Martinsville, IN")
+	assertResult(t, "Martinsville, IN, USA", result.FormattedAddress)
+	assertResult(t, 39.4278244, result.Geometry.Location.Lat)
+	assertResult(t, -86.4283333, result.Geometry.Location.Lng)
+}
+
+func TestGeocodeAddressWithNoResults(t *testing.T) {
+	mockGeocodeResponse := readMockFile("geocode_response_zero_results.json")
+	client := &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			return createHttpResponseForTest(http.StatusOK, bytes.NewBuffer(mockGeocodeResponse)), nil
+		},
+	}
+
+	_, err := NewGoogleGeocoder(client, DefaultConfig()).
+		Geocode(context.Background(), "3400 Invalid Street, Unknown, UGR, 00000")
+	assertResult(t, "Status of GMaps Geocoding API response was ZERO_RESULTS", err.Error())
+}
+
+func TestGeocodePlaceIDAndCoordinates(t *testing.T) {
+	mockGeocodeResponse := readMockFile("geocode_response.json")
+	var requestUrls []string
+	client := &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			requestUrls = append(requestUrls, req.URL.RawQuery)
+			return createHttpResponseForTest(http.StatusOK, bytes.NewBuffer(mockGeocodeResponse)), nil
+		},
+	}
+	geocoder := NewGoogleGeocoder(client, DefaultConfig())
+
+	result, _ := geocoder.GeocodePlaceID(context.Background(), "ChIJ1ZpXWxmFbIgRb1m7Y3cmM3E")
+	assertResult(t, "Martinsville, IN, USA", result.FormattedAddress)
+	assertResult(t, "key=&place_id=ChIJ1ZpXWxmFbIgRb1m7Y3cmM3E", requestUrls[0])
+
+	result, _ = geocoder.ReverseGeocode(context.Background(), Coordinates{Lat: 39.4278244, Lng: -86.4283333})
+	assertResult(t, "ChIJ1ZpXWxmFbIgRb1m7Y3cmM3E", result.PlaceID)
+	assertResult(t, "key=&latlng=39.427824%2C-86.428333", requestUrls[1])
+}
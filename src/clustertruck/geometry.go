@@ -0,0 +1,101 @@
+package clustertruck
+
+import "math"
+
+// Mean radius of the Earth, in meters
+const earthRadiusMeters = 6371008.8
+
+// Returns the great-circle distance between two points, in meters
+func haversineDistance(from Coordinates, to Coordinates) float64 {
+	fromLat := degreesToRadians(from.Lat)
+	toLat := degreesToRadians(to.Lat)
+	deltaLat := degreesToRadians(to.Lat - from.Lat)
+	deltaLng := degreesToRadians(to.Lng - from.Lng)
+
+	a := math.Sin(deltaLat/2)*math.Sin(deltaLat/2) +
+		math.Cos(fromLat)*math.Cos(toLat)*math.Sin(deltaLng/2)*math.Sin(deltaLng/2)
+
+	return 2 * earthRadiusMeters * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// Returns whether the point is inside the delivery area, or within the area's buffer (in meters) of its edges
+func (a *DeliveryArea) Contains(point Coordinates) bool {
+	if len(a.Coordinates) < 3 {
+		return false
+	}
+
+	if isPointInPolygon(point, a.Coordinates) {
+		return true
+	}
+
+	return a.Buffer > 0 && distanceToPolygonEdges(point, a.Coordinates) <= a.Buffer
+}
+
+// Returns the first delivery area of the kitchen that contains the point, or nil if there is none
+func (k *Kitchen) DeliveryAreaContaining(point Coordinates) *DeliveryArea {
+	for i := range k.DeliveryAreas {
+		if k.DeliveryAreas[i].Contains(point) {
+			return &k.DeliveryAreas[i]
+		}
+	}
+
+	return nil
+}
+
+// Ray casting algorithm, treating longitude as x and latitude as y.
+// Polygons are small enough for the curvature of the Earth not to matter.
+func isPointInPolygon(point Coordinates, polygon []Coordinates) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Lat > point.Lat) != (b.Lat > point.Lat) &&
+			point.Lng < (b.Lng-a.Lng)*(point.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lng {
+			inside = !inside
+		}
+	}
+
+	return inside
+}
+
+// Returns the shortest distance from the point to any edge of the polygon, in meters
+func distanceToPolygonEdges(point Coordinates, polygon []Coordinates) float64 {
+	shortestDistance := math.MaxFloat64
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		distance := distanceToSegment(point, polygon[j], polygon[i])
+		if distance < shortestDistance {
+			shortestDistance = distance
+		}
+	}
+
+	return shortestDistance
+}
+
+// Projects the segment onto a flat plane centered on the point (in meters), which is accurate enough
+// for the short distances buffers cover
+func distanceToSegment(point Coordinates, start Coordinates, end Coordinates) float64 {
+	metersPerDegreeLat := earthRadiusMeters * math.Pi / 180
+	metersPerDegreeLng := metersPerDegreeLat * math.Cos(degreesToRadians(point.Lat))
+
+	startX := (start.Lng - point.Lng) * metersPerDegreeLng
+	startY := (start.Lat - point.Lat) * metersPerDegreeLat
+	endX := (end.Lng - point.Lng) * metersPerDegreeLng
+	endY := (end.Lat - point.Lat) * metersPerDegreeLat
+
+	segmentX, segmentY := endX-startX, endY-startY
+	segmentLengthSquared := segmentX*segmentX + segmentY*segmentY
+
+	// Position of the closest point on the segment, from 0 (start) to 1 (end)
+	position := 0.0
+	if segmentLengthSquared > 0 {
+		position = math.Max(0, math.Min(1, -(startX*segmentX+startY*segmentY)/segmentLengthSquared))
+	}
+
+	closestX := startX + position*segmentX
+	closestY := startY + position*segmentY
+
+	return math.Hypot(closestX, closestY)
+}
+
+func degreesToRadians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
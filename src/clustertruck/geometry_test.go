@@ -0,0 +1,53 @@
+package clustertruck
+
+import (
+	"testing"
+	"math"
+)
+
+// Roughly 1.1km wide, around downtown Indianapolis
+var squareDeliveryAreaForTest = DeliveryArea{
+	Name: "square",
+	Type: "polygon",
+	Coordinates: []Coordinates{
+		{Lat: 39.77, Lng: -86.16},
+		{Lat: 39.78, Lng: -86.16},
+		{Lat: 39.78, Lng: -86.15},
+		{Lat: 39.77, Lng: -86.15},
+	},
+}
+
+func TestHaversineDistance(t *testing.T) {
+	indianapolis := Coordinates{Lat: 39.7776023, Lng: -86.1555877}
+	bloomington := Coordinates{Lat: 39.17093690000001, Lng: -86.500373}
+
+	distance := haversineDistance(indianapolis, bloomington)
+	assertResult(t, 74.0, math.Floor(distance/1000+0.5))
+	assertResult(t, 0.0, haversineDistance(indianapolis, indianapolis))
+}
+
+func TestDeliveryAreaContains(t *testing.T) {
+	area := squareDeliveryAreaForTest
+
+	assertResult(t, true, area.Contains(Coordinates{Lat: 39.775, Lng: -86.155}))
+	assertResult(t, false, area.Contains(Coordinates{Lat: 39.785, Lng: -86.155}))
+	assertResult(t, false, area.Contains(Coordinates{Lat: 39.775, Lng: -86.14}))
+}
+
+func TestDeliveryAreaContainsWithBuffer(t *testing.T) {
+	area := squareDeliveryAreaForTest
+	// About 450 meters north of the northern edge
+	point := Coordinates{Lat: 39.784, Lng: -86.155}
+
+	area.Buffer = 400
+	assertResult(t, false, area.Contains(point))
+	area.Buffer = 500
+	assertResult(t, true, area.Contains(point))
+}
+
+func TestKitchenDeliveryAreaContaining(t *testing.T) {
+	kitchen := Kitchen{DeliveryAreas: []DeliveryArea{squareDeliveryAreaForTest}}
+
+	assertResult(t, "square", kitchen.DeliveryAreaContaining(Coordinates{Lat: 39.775, Lng: -86.155}).Name)
+	assertResult(t, true, kitchen.DeliveryAreaContaining(Coordinates{Lat: 0, Lng: 0}) == nil)
+}
@@ -0,0 +1,94 @@
+package clustertruck
+
+import (
+	"time"
+	"errors"
+	"fmt"
+)
+
+const minutesInDay = 24 * 60
+
+// Returns whether the kitchen is open at the given time, based on its hours and timezone.
+//
+// An interval that closes at or before the time it opens (such as ["22:00", "02:00"]) is assumed to
+// close on the next day. Kitchens without hours are never open.
+func (k *Kitchen) IsOpenAt(t time.Time) (bool, error) {
+	if k.Hours == nil {
+		return false, nil
+	}
+	location, err := k.loadLocation()
+	if err != nil {
+		return false, err
+	}
+
+	localTime := t.In(location)
+	minuteOfDay := localTime.Hour()*60 + localTime.Minute()
+
+	for _, interval := range k.Hours.ForWeekday(localTime.Weekday()) {
+		opens, closes := int(interval.Opens), int(interval.Closes)
+		if closes <= opens {
+			closes += minutesInDay
+		}
+		if minuteOfDay >= opens && minuteOfDay < closes {
+			return true, nil
+		}
+	}
+
+	// Intervals from the previous day can run past midnight
+	previousWeekday := (localTime.Weekday() + 6) % 7
+	for _, interval := range k.Hours.ForWeekday(previousWeekday) {
+		if interval.Closes <= interval.Opens && minuteOfDay < int(interval.Closes) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Returns the first time at or after t when one of the kitchen's opening intervals starts.
+// The boolean is false if the kitchen has no opening intervals during the following week.
+func (k *Kitchen) NextOpeningAt(t time.Time) (time.Time, bool, error) {
+	if k.Hours == nil {
+		return time.Time{}, false, nil
+	}
+	location, err := k.loadLocation()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	localTime := t.In(location)
+	for dayOffset := 0; dayOffset <= 7; dayOffset++ {
+		day := localTime.AddDate(0, 0, dayOffset)
+
+		var nextOpening time.Time
+		found := false
+		for _, interval := range k.Hours.ForWeekday(day.Weekday()) {
+			opening := time.Date(day.Year(), day.Month(), day.Day(), int(interval.Opens)/60,
+				int(interval.Opens)%60, 0, 0, location)
+			if !opening.Before(t) && (!found || opening.Before(nextOpening)) {
+				nextOpening = opening
+				found = true
+			}
+		}
+
+		if found {
+			return nextOpening, true, nil
+		}
+	}
+
+	return time.Time{}, false, nil
+}
+
+func (k *Kitchen) loadLocation() (*time.Location, error) {
+	if k.Timezone == "" {
+		return nil, errors.New(fmt.Sprintf("kitchen %s does not have a timezone", k.ID))
+	}
+
+	location, err := time.LoadLocation(k.Timezone)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("kitchen %s has an unknown timezone \"%s\": %s", k.ID, k.Timezone,
+			err.Error()))
+	}
+
+	return location, nil
+}
@@ -0,0 +1,92 @@
+package clustertruck
+
+import (
+	"testing"
+	"time"
+	"encoding/json"
+)
+
+func createKitchenWithHoursForTest(hours string) *Kitchen {
+	var kitchenHours KitchenHours
+	err := json.Unmarshal([]byte(hours), &kitchenHours)
+	if err != nil {
+		panic(err)
+	}
+
+	return &Kitchen{ID: "kitchenId", Timezone: "America/New_York", Hours: &kitchenHours}
+}
+
+func parseTimeForTest(value string) time.Time {
+	location, _ := time.LoadLocation("America/New_York")
+	parsed, err := time.ParseInLocation("2006-01-02 15:04", value, location)
+	if err != nil {
+		panic(err)
+	}
+
+	return parsed
+}
+
+func TestIsOpenAtWithMultipleIntervals(t *testing.T) {
+	// 2017-12-04 is a Monday
+	kitchen := createKitchenWithHoursForTest(`{"monday": [["11:00", "14:00"], ["17:00", "22:00"]]}`)
+
+	isOpen, _ := kitchen.IsOpenAt(parseTimeForTest("2017-12-04 12:00"))
+	assertResult(t, true, isOpen)
+	isOpen, _ = kitchen.IsOpenAt(parseTimeForTest("2017-12-04 15:00"))
+	assertResult(t, false, isOpen)
+	isOpen, _ = kitchen.IsOpenAt(parseTimeForTest("2017-12-04 17:00"))
+	assertResult(t, true, isOpen)
+	isOpen, _ = kitchen.IsOpenAt(parseTimeForTest("2017-12-04 22:00"))
+	assertResult(t, false, isOpen)
+}
+
+func TestIsOpenAtWithIntervalPastMidnight(t *testing.T) {
+	kitchen := createKitchenWithHoursForTest(`{"monday": [["20:00", "02:00"]]}`)
+
+	isOpen, _ := kitchen.IsOpenAt(parseTimeForTest("2017-12-04 23:00"))
+	assertResult(t, true, isOpen)
+	isOpen, _ = kitchen.IsOpenAt(parseTimeForTest("2017-12-05 01:59"))
+	assertResult(t, true, isOpen)
+	isOpen, _ = kitchen.IsOpenAt(parseTimeForTest("2017-12-05 02:00"))
+	assertResult(t, false, isOpen)
+}
+
+func TestIsOpenAtUsesKitchenTimezone(t *testing.T) {
+	kitchen := createKitchenWithHoursForTest(`{"monday": [["08:00", "22:00"]]}`)
+	kitchen.Timezone = "America/Denver"
+
+	isOpen, _ := kitchen.IsOpenAt(parseTimeForTest("2017-12-04 23:00"))
+	assertResult(t, true, isOpen)
+	isOpen, _ = kitchen.IsOpenAt(parseTimeForTest("2017-12-04 09:00"))
+	assertResult(t, false, isOpen)
+}
+
+func TestIsOpenAtWithoutTimezone(t *testing.T) {
+	kitchen := createKitchenWithHoursForTest(`{"monday": [["08:00", "22:00"]]}`)
+	kitchen.Timezone = ""
+
+	_, err := kitchen.IsOpenAt(parseTimeForTest("2017-12-04 12:00"))
+	assertResult(t, "kitchen kitchenId does not have a timezone", err.Error())
+}
+
+func TestNextOpeningAt(t *testing.T) {
+	kitchen := createKitchenWithHoursForTest(`{"monday": [["17:00", "22:00"], ["11:00", "14:00"]], ` +
+		`"thursday": [["09:00", "10:00"]]}`)
+
+	nextOpening, found, _ := kitchen.NextOpeningAt(parseTimeForTest("2017-12-04 08:00"))
+	assertResult(t, true, found)
+	assertResult(t, "2017-12-04T11:00:00-05:00", nextOpening.Format(time.RFC3339))
+
+	nextOpening, _, _ = kitchen.NextOpeningAt(parseTimeForTest("2017-12-04 15:00"))
+	assertResult(t, "2017-12-04T17:00:00-05:00", nextOpening.Format(time.RFC3339))
+
+	nextOpening, _, _ = kitchen.NextOpeningAt(parseTimeForTest("2017-12-04 23:00"))
+	assertResult(t, "2017-12-07T09:00:00-05:00", nextOpening.Format(time.RFC3339))
+}
+
+func TestNextOpeningAtWithoutHours(t *testing.T) {
+	kitchen := &Kitchen{ID: "kitchenId", Timezone: "America/New_York"}
+
+	_, found, _ := kitchen.NextOpeningAt(parseTimeForTest("2017-12-04 08:00"))
+	assertResult(t, false, found)
+}
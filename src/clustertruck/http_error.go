@@ -4,6 +4,8 @@ import "encoding/json"
 
 // Used to carry error responses sent to users
 type HTTPError struct {
+	// Machine readable error code, such as "no_route"
+	Code string `json:"code,omitempty"`
 	Message string `json:"message"`
 	Parameters map[string]interface{} `json:"parameters,omitempty"`
 }
@@ -3,12 +3,55 @@ package clustertruck
 import (
 	"net/http"
 	"io"
+	"context"
+	"time"
 )
 
 type HttpClient interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
+// Limits how long something can take, such as a call to an upstream API. A timeout of 0 means there is no limit,
+// other than the deadline of the context itself.
+func contextWithTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// Context value holding the deadline set by contextWithUpstreamTimeout, when it's earlier than the deadline of
+// the caller
+type upstreamDeadlineKey struct{}
+
+// Limits how long a single call to an upstream API can take. When the call runs out of time, the context records
+// whether it was the timeout of the upstream API that ran out, rather than the deadline of the caller, so the
+// circuit breaker of the upstream API can tell a slow upstream API apart from an impatient caller.
+func contextWithUpstreamTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	deadline := time.Now().Add(timeout)
+	if callerDeadline, ok := ctx.Deadline(); ok && !deadline.Before(callerDeadline) {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithDeadline(context.WithValue(ctx, upstreamDeadlineKey{}, deadline), deadline)
+}
+
+// Whether the call stopped because the caller stopped waiting, either because it was canceled or because its own
+// deadline passed, rather than because the upstream API took longer than its timeout
+func callerStoppedWaiting(ctx context.Context) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+
+	_, upstreamDeadline := ctx.Value(upstreamDeadlineKey{}).(time.Time)
+	return !upstreamDeadline || ctx.Err() != context.DeadlineExceeded
+}
+
 type MockClient struct {
 	DoFunc func(req *http.Request) (*http.Response, error)
 }
@@ -0,0 +1,200 @@
+package clustertruck
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Names of the files kept for each job, in a directory named after the job ID
+const (
+	jobFileName     = "job.json"
+	jobItemsName    = "items.json"
+	jobResultsName  = "results.ndjson"
+	jobTempFileName = "job.json.tmp"
+)
+
+// Keeps jobs on disk, so they survive a restart of the server. Each job has its own directory, with:
+//
+// * job.json: the status of the job, rewritten whenever the status changes
+// * items.json: the items of the job, written once when the job is created
+// * results.ndjson: one result per line, appended as each item is done
+//
+// Progress is not written to job.json, since it can be counted from the results.
+type JobStore struct {
+	dir string
+}
+
+// A job read back from disk
+type storedJob struct {
+	job   Job
+	items []json.RawMessage
+	// Index of every item that has a result
+	done []bool
+	// Where each result starts in the results file, followed by where the last one ends
+	resultOffsets []int64
+}
+
+func NewJobStore(dir string) *JobStore {
+	return &JobStore{dir: dir}
+}
+
+func (s *JobStore) jobPath(id string, name string) string {
+	return filepath.Join(s.dir, id, name)
+}
+
+func (s *JobStore) create(job Job, items []json.RawMessage) error {
+	err := os.MkdirAll(filepath.Join(s.dir, job.ID), 0755)
+	if err != nil {
+		return err
+	}
+
+	itemsData, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(s.jobPath(job.ID, jobItemsName), itemsData, 0644)
+	if err != nil {
+		return err
+	}
+
+	return s.save(job)
+}
+
+// Writes the job to a temporary file first, so a crash never leaves a half written job.json behind
+func (s *JobStore) save(job Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	tempPath := s.jobPath(job.ID, jobTempFileName)
+	err = ioutil.WriteFile(tempPath, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, s.jobPath(job.ID, jobFileName))
+}
+
+// Deletes the job and its results
+func (s *JobStore) remove(id string) error {
+	return os.RemoveAll(filepath.Join(s.dir, id))
+}
+
+// Opens the results file of a job for appending
+func (s *JobStore) openResultsForAppend(id string) (*os.File, error) {
+	return os.OpenFile(s.jobPath(id, jobResultsName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+func (s *JobStore) openResultsForRead(id string) (*os.File, error) {
+	return os.Open(s.jobPath(id, jobResultsName))
+}
+
+// Reads every job in the store. There are no jobs if the directory doesn't exist yet. Jobs that can't be read
+// are logged and skipped, so they don't stop the other jobs from being resumed.
+func (s *JobStore) load() ([]storedJob, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var storedJobs []storedJob
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		storedJob, err := s.loadJob(entry.Name())
+		if err != nil {
+			log.Printf("Skipping job %s, it could not be read: %s\n", entry.Name(), err.Error())
+			continue
+		}
+		storedJobs = append(storedJobs, *storedJob)
+	}
+
+	return storedJobs, nil
+}
+
+func (s *JobStore) loadJob(id string) (*storedJob, error) {
+	var stored storedJob
+	jobData, err := ioutil.ReadFile(s.jobPath(id, jobFileName))
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(jobData, &stored.job)
+	if err != nil {
+		return nil, err
+	}
+
+	itemsData, err := ioutil.ReadFile(s.jobPath(id, jobItemsName))
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(itemsData, &stored.items)
+	if err != nil {
+		return nil, err
+	}
+
+	stored.job.Total = len(stored.items)
+	stored.job.Completed = 0
+	stored.job.Failed = 0
+	stored.done = make([]bool, len(stored.items))
+	err = s.loadResults(&stored)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stored, nil
+}
+
+// Counts the results of a job, and finds where each of them starts. A result that was only partly written
+// before the server stopped is removed, so its item is looked up again.
+func (s *JobStore) loadResults(stored *storedJob) error {
+	resultsFile, err := os.OpenFile(s.jobPath(stored.job.ID, jobResultsName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer resultsFile.Close()
+
+	reader := bufio.NewReader(resultsFile)
+	var offset int64
+	stored.resultOffsets = []int64{0}
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return resultsFile.Truncate(offset)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var result BatchResult
+		if json.Unmarshal(line, &result) != nil || result.Index < 0 || result.Index >= len(stored.items) ||
+			stored.done[result.Index] {
+
+			return errors.New(fmt.Sprintf("the result at byte %d is invalid", offset))
+		}
+
+		stored.done[result.Index] = true
+		stored.job.Completed++
+		if result.Status != http.StatusOK {
+			stored.job.Failed++
+		}
+		offset += int64(len(line))
+		stored.resultOffsets = append(stored.resultOffsets, offset)
+	}
+}
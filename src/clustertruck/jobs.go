@@ -0,0 +1,440 @@
+package clustertruck
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Statuses of a job
+const (
+	jobStatusRunning   = "running"
+	jobStatusCompleted = "completed"
+	jobStatusCanceled  = "canceled"
+	// The results of the job could not be written to the job store
+	jobStatusFailed = "failed"
+)
+
+// Number of results returned in a page of job results, unless the user asks for another number
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// Wait before an item that the server was too busy to look up is tried again. Doubles on every try, up to
+// the max
+const (
+	jobRetryInitialBackoff = time.Second
+	jobRetryMaxBackoff     = time.Minute
+)
+
+// A batch of addresses that's looked up in the background, for batches that take longer than a request can
+type Job struct {
+	ID string `json:"id"`
+	// Either "running", "completed", "canceled" or "failed"
+	Status string `json:"status"`
+	// Number of items in the job
+	Total int `json:"total"`
+	// Number of items that are done, including the ones that failed
+	Completed int `json:"completed"`
+	// Number of items whose status is not 200
+	Failed     int        `json:"failed"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// Only set if the job failed
+	Error string `json:"error,omitempty"`
+}
+
+// A page of the results of a job. Results are in the order the items were done, so pages of a running job
+// don't change as more results are found.
+type JobResultsPage struct {
+	Results []BatchResult `json:"results"`
+	Offset  int           `json:"offset"`
+	// Number of results found so far
+	Total int `json:"total"`
+	// Offset of the next page. Not set once every result of a finished job has been returned
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+type jobState struct {
+	job Job
+	// Only kept while the job is running
+	items []json.RawMessage
+	done  []bool
+	// Where each result starts in the results file, followed by where the last one ends
+	resultOffsets []int64
+	resultsFile   *os.File
+	cancel        context.CancelFunc
+	// Closed once the job stops running
+	finished chan struct{}
+}
+
+// Runs jobs in the background and keeps them in the job store. Jobs that were running when the server stopped
+// are resumed by Resume, and only the items that have no result yet are looked up again. Jobs that finished
+// longer than the retention ago are deleted the next time jobs are created or looked up.
+type JobManager struct {
+	service *DriveTimeService
+	store   *JobStore
+	// Number of items of each job that are looked up at the same time
+	concurrency int
+	itemTimeout time.Duration
+	// 0 means finished jobs are kept forever
+	retention      time.Duration
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	now            func() time.Time
+
+	mutex sync.Mutex
+	jobs  map[string]*jobState
+}
+
+func NewJobManager(service *DriveTimeService, store *JobStore, concurrency int,
+	itemTimeout time.Duration, retention time.Duration) *JobManager {
+
+	return &JobManager{
+		service:        service,
+		store:          store,
+		concurrency:    concurrency,
+		itemTimeout:    itemTimeout,
+		retention:      retention,
+		initialBackoff: jobRetryInitialBackoff,
+		maxBackoff:     jobRetryMaxBackoff,
+		now:            time.Now,
+		jobs:           make(map[string]*jobState),
+	}
+}
+
+// Reads the jobs in the job store, and starts the ones that were running again
+func (m *JobManager) Resume() error {
+	storedJobs, err := m.store.load()
+	for _, storedJob := range storedJobs {
+		state := &jobState{
+			job:           storedJob.job,
+			items:         storedJob.items,
+			done:          storedJob.done,
+			resultOffsets: storedJob.resultOffsets,
+			finished:      make(chan struct{}),
+		}
+
+		if state.job.Status == jobStatusRunning {
+			log.Printf("Resuming job %s, %d of %d items are done\n", state.job.ID, state.job.Completed,
+				state.job.Total)
+			m.start(state)
+		} else {
+			state.items = nil
+			state.done = nil
+			close(state.finished)
+		}
+
+		m.mutex.Lock()
+		m.jobs[state.job.ID] = state
+		m.mutex.Unlock()
+	}
+
+	m.mutex.Lock()
+	m.removeExpiredLocked()
+	m.mutex.Unlock()
+
+	return err
+}
+
+// Creates a job for the items, and starts it
+func (m *JobManager) Create(items []json.RawMessage) (Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return Job{}, err
+	}
+
+	state := &jobState{
+		job: Job{
+			ID:        id,
+			Status:    jobStatusRunning,
+			Total:     len(items),
+			CreatedAt: m.now().UTC(),
+		},
+		items:         items,
+		done:          make([]bool, len(items)),
+		resultOffsets: []int64{0},
+		finished:      make(chan struct{}),
+	}
+	err = m.store.create(state.job, items)
+	if err != nil {
+		return Job{}, errors.New(fmt.Sprintf("the job could not be saved: %s", err.Error()))
+	}
+
+	m.start(state)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.removeExpiredLocked()
+	m.jobs[id] = state
+
+	return state.job, nil
+}
+
+func (m *JobManager) Get(id string) (Job, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	state, err := m.findLocked(id)
+	if err != nil {
+		return Job{}, err
+	}
+
+	return state.job, nil
+}
+
+// Returns up to limit results, starting at offset
+func (m *JobManager) Results(id string, offset int, limit int) (*JobResultsPage, error) {
+	m.mutex.Lock()
+	state, err := m.findLocked(id)
+	if err != nil {
+		m.mutex.Unlock()
+		return nil, err
+	}
+
+	total := len(state.resultOffsets) - 1
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	// Past the results found so far, the same offset is asked for again, rather than going back to the last result
+	if end < offset {
+		end = offset
+	}
+	page := &JobResultsPage{Results: []BatchResult{}, Offset: offset, Total: total}
+	if end < total || state.job.Status == jobStatusRunning {
+		page.NextOffset = &end
+	}
+	if offset >= end {
+		m.mutex.Unlock()
+		return page, nil
+	}
+	start, stop := state.resultOffsets[offset], state.resultOffsets[end]
+	m.mutex.Unlock()
+
+	// Results are never changed once they are written, so they can be read without holding the lock
+	resultsFile, err := m.store.openResultsForRead(id)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsFile.Close()
+
+	data := make([]byte, stop-start)
+	_, err = resultsFile.ReadAt(data, start)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(append(append([]byte("["), joinLines(data)...), ']'), &page.Results)
+	if err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// Stops a running job. The results found so far are kept. Jobs that already stopped are left as they are.
+func (m *JobManager) Cancel(id string) (Job, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	state, err := m.findLocked(id)
+	if err != nil {
+		return Job{}, err
+	}
+
+	if state.job.Status == jobStatusRunning {
+		m.finishLocked(state, jobStatusCanceled, "")
+		state.cancel()
+	}
+
+	return state.job, nil
+}
+
+func (m *JobManager) findLocked(id string) (*jobState, error) {
+	m.removeExpiredLocked()
+	state, ok := m.jobs[id]
+	if !ok {
+		return nil, newAPIError(ErrorCodeJobNotFound, fmt.Sprintf("there is no job with ID \"%s\"", id))
+	}
+
+	return state, nil
+}
+
+// Looks up the items of the job that have no result yet, in the background. Called before the job is added
+// to the jobs, so nobody can cancel it before it's started
+func (m *JobManager) start(state *jobState) {
+	var pendingItems []json.RawMessage
+	var pendingIndexes []int
+	for index, item := range state.items {
+		if !state.done[index] {
+			pendingItems = append(pendingItems, item)
+			pendingIndexes = append(pendingIndexes, index)
+		}
+	}
+
+	resultsFile, err := m.store.openResultsForAppend(state.job.ID)
+	if err != nil {
+		m.mutex.Lock()
+		m.finishLocked(state, jobStatusFailed, fmt.Sprintf("the results could not be opened: %s", err.Error()))
+		m.mutex.Unlock()
+		close(state.finished)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	state.resultsFile = resultsFile
+	state.cancel = cancel
+
+	go func() {
+		defer close(state.finished)
+		defer resultsFile.Close()
+		defer cancel()
+
+		m.service.findDriveTimesForBatch(ctx, pendingItems, m.concurrency, m.itemTimeout,
+			func(result BatchResult) {
+				result = m.retryWhileBusy(ctx, pendingItems[result.Index], result)
+				result.Index = pendingIndexes[result.Index]
+				m.addResult(ctx, state, result)
+			})
+
+		m.mutex.Lock()
+		if state.job.Status == jobStatusRunning {
+			m.finishLocked(state, jobStatusCompleted, "")
+		}
+		m.mutex.Unlock()
+	}()
+}
+
+// Looks the item up again, with a growing wait in between, for as long as it's rejected because the server
+// is too busy. Those items didn't fail, so their results are not saved. Returns the last result once the item
+// is looked up, or once the job is stopped.
+func (m *JobManager) retryWhileBusy(ctx context.Context, item json.RawMessage, result BatchResult) BatchResult {
+	backoff := m.initialBackoff
+	for isRetryableJobResult(result) {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return result
+		}
+
+		result = m.service.findDriveTimeForBatchItem(ctx, result.Index, item, m.itemTimeout)
+		backoff *= 2
+		if backoff > m.maxBackoff {
+			backoff = m.maxBackoff
+		}
+	}
+
+	return result
+}
+
+// Whether the item was rejected before it was looked up, because the server or an upstream API was
+// overloaded, rather than failing
+func isRetryableJobResult(result BatchResult) bool {
+	return result.Error != nil &&
+		(result.Error.Code == ErrorCodeServerBusy || result.Error.Code == ErrorCodeUpstreamCircuitOpen)
+}
+
+func (m *JobManager) addResult(ctx context.Context, state *jobState, result BatchResult) {
+	line, err := json.Marshal(result)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// Items that failed because the job was stopped are looked up again if the job is resumed
+	if state.job.Status != jobStatusRunning || (ctx.Err() != nil && result.Status != http.StatusOK) {
+		return
+	}
+
+	if err == nil {
+		_, err = state.resultsFile.Write(append(line, '\n'))
+	}
+	if err != nil {
+		m.finishLocked(state, jobStatusFailed, fmt.Sprintf("a result could not be saved: %s", err.Error()))
+		state.cancel()
+		return
+	}
+
+	state.done[result.Index] = true
+	state.resultOffsets = append(state.resultOffsets, state.resultOffsets[len(state.resultOffsets)-1]+
+		int64(len(line)+1))
+	state.job.Completed++
+	if result.Status != http.StatusOK {
+		state.job.Failed++
+	}
+}
+
+func (m *JobManager) finishLocked(state *jobState, status string, message string) {
+	finishedAt := m.now().UTC()
+	state.job.Status = status
+	state.job.FinishedAt = &finishedAt
+	state.job.Error = message
+	// Results are read from the results file, so the items are no longer needed
+	state.items = nil
+	state.done = nil
+
+	err := m.store.save(state.job)
+	if err != nil {
+		log.Printf("Status of job %s could not be saved: %s\n", state.job.ID, err.Error())
+	}
+}
+
+// Deletes the jobs that finished longer than the retention ago, from memory and from the job store
+func (m *JobManager) removeExpiredLocked() {
+	if m.retention == 0 {
+		return
+	}
+
+	for id, state := range m.jobs {
+		if state.job.FinishedAt == nil || m.now().Sub(*state.job.FinishedAt) < m.retention {
+			continue
+		}
+
+		err := m.store.remove(id)
+		if err != nil {
+			log.Printf("Job %s could not be deleted: %s\n", id, err.Error())
+			continue
+		}
+		delete(m.jobs, id)
+	}
+}
+
+// Waits until the job stops running. Used by tests
+func (m *JobManager) wait(id string) {
+	m.mutex.Lock()
+	state := m.jobs[id]
+	m.mutex.Unlock()
+
+	<-state.finished
+}
+
+func newJobID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// Turns newline delimited JSON into the items of a JSON array
+func joinLines(data []byte) []byte {
+	data = data[:len(data)-1]
+	for i := range data {
+		if data[i] == '\n' {
+			data[i] = ','
+		}
+	}
+
+	return data
+}
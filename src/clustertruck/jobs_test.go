@@ -0,0 +1,302 @@
+package clustertruck
+
+import (
+	"testing"
+	"net/http"
+	"net/http/httptest"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+func createJobManagerForTest(t *testing.T, client *MockClient, dir string) *JobManager {
+	service := createDriveTimeServiceForTest(client, "2017-12-04 12:00")
+	jobManager := NewJobManager(service, NewJobStore(dir), 2, 10*time.Second, time.Hour)
+	err := jobManager.Resume()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return jobManager
+}
+
+func createJobsDirForTest(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "clustertruck-jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func TestJobLooksUpEveryItemAndPagesThroughResults(t *testing.T) {
+	dir := createJobsDirForTest(t)
+	defer os.RemoveAll(dir)
+	jobManager := createJobManagerForTest(t, createClientWithRoutesToEveryKitchen(), dir)
+
+	items, _ := parseBatchBody(
+		[]byte(`["Martinsville, IN", {"id": "b", "address": "Mooresville, IN"}, "Franklin, IN"]`), 0)
+	job, err := jobManager.Create(items)
+	assertResult(t, nil, err)
+	assertResult(t, jobStatusRunning, job.Status)
+	assertResult(t, 3, job.Total)
+	jobManager.wait(job.ID)
+
+	job, _ = jobManager.Get(job.ID)
+	assertResult(t, jobStatusCompleted, job.Status)
+	assertResult(t, 3, job.Completed)
+	assertResult(t, 0, job.Failed)
+	assertResult(t, true, job.FinishedAt != nil)
+
+	page, err := jobManager.Results(job.ID, 0, 2)
+	assertResult(t, nil, err)
+	assertResult(t, 2, len(page.Results))
+	assertResult(t, 3, page.Total)
+	assertResult(t, 2, *page.NextOffset)
+	assertResult(t, "Downtown Columbus", page.Results[0].Result.LocationName)
+
+	page, _ = jobManager.Results(job.ID, 2, 2)
+	assertResult(t, 1, len(page.Results))
+	assertResult(t, true, page.NextOffset == nil)
+
+	_, err = jobManager.Get("unknown")
+	assertResult(t, ErrorCodeJobNotFound, errorCode(err))
+}
+
+func TestJobIsResumedAfterRestart(t *testing.T) {
+	dir := createJobsDirForTest(t)
+	defer os.RemoveAll(dir)
+
+	// The server stopped after the first item was done, while the second one was being written
+	items, _ := parseBatchBody([]byte(`["Martinsville, IN", "Mooresville, IN", "Franklin, IN"]`), 0)
+	store := NewJobStore(dir)
+	store.create(Job{ID: "job", Status: jobStatusRunning}, items)
+	ioutil.WriteFile(store.jobPath("job", jobResultsName),
+		[]byte("{\"index\":0,\"id\":\"before\",\"status\":200}\n{\"index\":1,\"st"), 0644)
+
+	var directionsCalls int32
+	jobManager := createJobManagerForTest(t, createCountingClientWithRoutesToEveryKitchen(&directionsCalls), dir)
+	jobManager.wait("job")
+
+	job, _ := jobManager.Get("job")
+	assertResult(t, jobStatusCompleted, job.Status)
+	assertResult(t, 3, job.Completed)
+	assertResult(t, int32(12), atomic.LoadInt32(&directionsCalls))
+
+	page, _ := jobManager.Results("job", 0, 10)
+	assertResult(t, 3, len(page.Results))
+	assertResult(t, "before", page.Results[0].ID)
+
+	// Finished jobs are not started again
+	jobManager = createJobManagerForTest(t, createCountingClientWithRoutesToEveryKitchen(&directionsCalls), dir)
+	job, _ = jobManager.Get("job")
+	assertResult(t, jobStatusCompleted, job.Status)
+	assertResult(t, int32(12), atomic.LoadInt32(&directionsCalls))
+}
+
+func TestJobsAreResumedWhenAnotherJobCannotBeRead(t *testing.T) {
+	dir := createJobsDirForTest(t)
+	defer os.RemoveAll(dir)
+
+	items, _ := parseBatchBody([]byte(`["Martinsville, IN"]`), 0)
+	store := NewJobStore(dir)
+	store.create(Job{ID: "broken", Status: jobStatusRunning}, items)
+	ioutil.WriteFile(store.jobPath("broken", jobFileName), []byte("{\"id\":"), 0644)
+	store.create(Job{ID: "job", Status: jobStatusRunning}, items)
+
+	jobManager := createJobManagerForTest(t, createClientWithRoutesToEveryKitchen(), dir)
+	jobManager.wait("job")
+
+	job, _ := jobManager.Get("job")
+	assertResult(t, jobStatusCompleted, job.Status)
+	assertResult(t, 1, job.Completed)
+	_, err := jobManager.Get("broken")
+	assertResult(t, ErrorCodeJobNotFound, errorCode(err))
+}
+
+func TestResultsPastTheEndOfARunningJobKeepTheirOffset(t *testing.T) {
+	dir := createJobsDirForTest(t)
+	defer os.RemoveAll(dir)
+
+	client := createClientWithRoutesToEveryKitchen()
+	doFunc := client.DoFunc
+	client.DoFunc = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "directions") {
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		}
+		return doFunc(req)
+	}
+	jobManager := createJobManagerForTest(t, client, dir)
+
+	items, _ := parseBatchBody([]byte(`["Martinsville, IN"]`), 0)
+	job, _ := jobManager.Create(items)
+	page, err := jobManager.Results(job.ID, 5, 2)
+	assertResult(t, nil, err)
+	assertResult(t, 0, len(page.Results))
+	assertResult(t, 0, page.Total)
+	assertResult(t, 5, *page.NextOffset)
+
+	jobManager.Cancel(job.ID)
+	jobManager.wait(job.ID)
+	page, _ = jobManager.Results(job.ID, 5, 2)
+	assertResult(t, true, page.NextOffset == nil)
+}
+
+func TestCancelJob(t *testing.T) {
+	dir := createJobsDirForTest(t)
+	defer os.RemoveAll(dir)
+
+	client := createClientWithRoutesToEveryKitchen()
+	doFunc := client.DoFunc
+	client.DoFunc = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "directions") {
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		}
+		return doFunc(req)
+	}
+	jobManager := createJobManagerForTest(t, client, dir)
+
+	items, _ := parseBatchBody([]byte(`["Martinsville, IN", "Mooresville, IN", "Franklin, IN"]`), 0)
+	job, _ := jobManager.Create(items)
+	job, err := jobManager.Cancel(job.ID)
+	assertResult(t, nil, err)
+	assertResult(t, jobStatusCanceled, job.Status)
+	jobManager.wait(job.ID)
+
+	// Items interrupted by the cancellation have no result
+	job, _ = jobManager.Get(job.ID)
+	assertResult(t, jobStatusCanceled, job.Status)
+	assertResult(t, 0, job.Completed)
+
+	jobManager = createJobManagerForTest(t, client, dir)
+	job, _ = jobManager.Get(job.ID)
+	assertResult(t, jobStatusCanceled, job.Status)
+}
+
+func TestJobItemsRejectedByBusyServerAreRetried(t *testing.T) {
+	dir := createJobsDirForTest(t)
+	defer os.RemoveAll(dir)
+	jobManager := createJobManagerForTest(t, createClientWithRoutesToEveryKitchen(), dir)
+	jobManager.initialBackoff = time.Millisecond
+
+	busyResult := BatchResult{Index: 0, Status: http.StatusServiceUnavailable,
+		Error: &HTTPError{Code: ErrorCodeServerBusy}}
+	result := jobManager.retryWhileBusy(context.Background(), json.RawMessage(`"Martinsville, IN"`), busyResult)
+	assertResult(t, http.StatusOK, result.Status)
+	assertResult(t, "Downtown Columbus", result.Result.LocationName)
+
+	// Once the job is stopped, the item is left without a result, so it's looked up again if the job is resumed
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result = jobManager.retryWhileBusy(ctx, json.RawMessage(`"Martinsville, IN"`), busyResult)
+	assertResult(t, ErrorCodeServerBusy, result.Error.Code)
+
+	// Other errors are not retried
+	noRouteResult := BatchResult{Index: 0, Status: http.StatusNotFound, Error: &HTTPError{Code: ErrorCodeNoRoute}}
+	result = jobManager.retryWhileBusy(context.Background(), json.RawMessage(`"Martinsville, IN"`), noRouteResult)
+	assertResult(t, ErrorCodeNoRoute, result.Error.Code)
+}
+
+func TestFinishedJobsAreDeletedAfterRetention(t *testing.T) {
+	dir := createJobsDirForTest(t)
+	defer os.RemoveAll(dir)
+	jobManager := createJobManagerForTest(t, createClientWithRoutesToEveryKitchen(), dir)
+	now := time.Now()
+	jobManager.now = func() time.Time { return now }
+
+	items, _ := parseBatchBody([]byte(`["Martinsville, IN"]`), 0)
+	job, _ := jobManager.Create(items)
+	jobManager.wait(job.ID)
+
+	now = now.Add(59 * time.Minute)
+	_, err := jobManager.Get(job.ID)
+	assertResult(t, nil, err)
+
+	now = now.Add(time.Minute)
+	_, err = jobManager.Get(job.ID)
+	assertResult(t, ErrorCodeJobNotFound, errorCode(err))
+	_, err = os.Stat(filepath.Join(dir, job.ID))
+	assertResult(t, true, os.IsNotExist(err))
+}
+
+func TestAPICreatesAndReportsJobs(t *testing.T) {
+	dir := createJobsDirForTest(t)
+	defer os.RemoveAll(dir)
+	config := DefaultConfig()
+	config.JobsDir = dir
+	api := SetupAPI(createClientWithRoutesToEveryKitchen(), config)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/api/jobs", noopCloser{bytes.NewBufferString(`["Martinsville, IN"]`)})
+	request.Header.Add("Access-Key", "JVvlYlqTBwhs2yu8")
+	api.ServeHTTP(recorder, request)
+
+	assertResult(t, http.StatusAccepted, recorder.Code)
+	var job Job
+	json.Unmarshal(recorder.Body.Bytes(), &job)
+	assertResult(t, "/api/jobs/"+job.ID, recorder.Header().Get("Location"))
+	assertResult(t, 1, job.Total)
+
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest("GET", "/api/jobs/"+job.ID+"/results?limit=0", nil)
+	request.Header.Add("Access-Key", "JVvlYlqTBwhs2yu8")
+	api.ServeHTTP(recorder, request)
+	assertResult(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest("POST", "/api/jobs/"+job.ID+"/cancel", nil)
+	request.Header.Add("Access-Key", "JVvlYlqTBwhs2yu8")
+	api.ServeHTTP(recorder, request)
+	assertResult(t, http.StatusOK, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest("GET", "/api/jobs/"+job.ID+"/cancel", nil)
+	request.Header.Add("Access-Key", "JVvlYlqTBwhs2yu8")
+	api.ServeHTTP(recorder, request)
+	assertResult(t, http.StatusMethodNotAllowed, recorder.Code)
+	assertResult(t, "POST", recorder.Header().Get("Allow"))
+
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest("GET", "/api/jobs/unknown", nil)
+	request.Header.Add("Access-Key", "JVvlYlqTBwhs2yu8")
+	api.ServeHTTP(recorder, request)
+
+	assertResult(t, http.StatusNotFound, recorder.Code)
+	var response HTTPError
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	assertResult(t, ErrorCodeJobNotFound, response.Code)
+}
+
+func TestAPIResumesJobsOnlyOnceStarted(t *testing.T) {
+	dir := createJobsDirForTest(t)
+	defer os.RemoveAll(dir)
+	items, _ := parseBatchBody([]byte(`["Martinsville, IN"]`), 0)
+	NewJobStore(dir).create(Job{ID: "job", Status: jobStatusRunning}, items)
+	config := DefaultConfig()
+	config.JobsDir = dir
+	api := SetupAPI(createClientWithRoutesToEveryKitchen(), config)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/api/jobs/job", nil)
+	request.Header.Add("Access-Key", "JVvlYlqTBwhs2yu8")
+	api.ServeHTTP(recorder, request)
+	assertResult(t, http.StatusNotFound, recorder.Code)
+
+	api.Start()
+	api.jobManager.wait("job")
+
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, request)
+	assertResult(t, http.StatusOK, recorder.Code)
+	var job Job
+	json.Unmarshal(recorder.Body.Bytes(), &job)
+	assertResult(t, jobStatusCompleted, job.Status)
+}
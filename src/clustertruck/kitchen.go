@@ -6,43 +6,117 @@ import (
 	"encoding/json"
 	"fmt"
 	"errors"
+	"time"
+	"context"
 )
 
 type Kitchens []Kitchen
 
-// Contains ClusterTruck Kitchen Information
+// Contains ClusterTruck Kitchen Information, as returned by version 2 of the ClusterTruck Kitchens API
 type Kitchen struct {
-	ID      string `json:"id"`
-	Name    string `json:"name"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Address1 string `json:"address_1"`
+	// Optional, can be null or empty
+	Address2 string `json:"address_2"`
+	City     string `json:"city"`
+	State    string `json:"state"`
+	ZipCode  string `json:"zip_code"`
+	// Coordinates of the kitchen itself
+	Location Coordinates `json:"location"`
+	// Opening hours of the kitchen, in the kitchen's own timezone. Null for kitchens that are not set up yet
+	Hours *KitchenHours `json:"hours"`
+	// IANA timezone name, such as America/New_York. Can be null
+	Timezone string `json:"timezone"`
+	// Tax rate as a decimal string, such as "7.0". Can be null
+	TaxRate              string         `json:"tax_rate"`
+	Active               bool           `json:"active"`
+	KitchenState         string         `json:"kitchen_state"`
+	Slug                 string         `json:"slug"`
+	Subdomain            string         `json:"subdomain"`
+	FriendlyID           string         `json:"friendly_id"`
+	Announcement         string         `json:"announcement"`
+	ForceScheduleMessage string         `json:"force_schedule_message"`
+	DeliveryAreas        []DeliveryArea `json:"delivery_areas"`
+	CreatedAt            time.Time      `json:"created_at"`
+	UpdatedAt            time.Time      `json:"updated_at"`
+	RecruitingState      string         `json:"recruiting_state"`
+	// Full address condensed into one string, for easy searching with GMaps Directions API
 	Address string `json:"-"`
 }
 
-func getClusterTruckKitchenInfo(httpClient HttpClient) (map[string]Kitchen, error) {
-	req, err := http.NewRequest("GET", "https://api.staging.clustertruck.com/api/kitchens", nil)
+// A point on the map
+type Coordinates struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// Opening hours for each day of the week. Each day can have multiple intervals.
+type KitchenHours struct {
+	Sunday    []HoursInterval `json:"sunday"`
+	Monday    []HoursInterval `json:"monday"`
+	Tuesday   []HoursInterval `json:"tuesday"`
+	Wednesday []HoursInterval `json:"wednesday"`
+	Thursday  []HoursInterval `json:"thursday"`
+	Friday    []HoursInterval `json:"friday"`
+	Saturday  []HoursInterval `json:"saturday"`
+}
+
+// A single opening interval, represented as ["08:00", "22:00"] by the ClusterTruck Kitchens API
+type HoursInterval struct {
+	Opens  TimeOfDay
+	Closes TimeOfDay
+}
+
+// Minutes after midnight, represented as "HH:MM" by the ClusterTruck Kitchens API
+type TimeOfDay int
+
+// An area a kitchen delivers to
+type DeliveryArea struct {
+	Name string `json:"name"`
+	// Only "polygon" is used by the ClusterTruck Kitchens API
+	Type string `json:"type"`
+	// Extra distance around the polygon that is still considered part of the delivery area
+	Buffer      float64       `json:"buffer"`
+	Coordinates []Coordinates `json:"coordinates"`
+}
+
+// Fields that have to be present (and not null) for a kitchen to be usable
+var requiredKitchenFields = []string{"id", "name", "address_1", "city", "state", "location", "active",
+	"kitchen_state"}
+
+func getClusterTruckKitchenInfo(ctx context.Context, httpClient HttpClient,
+	kitchensAPIURL string) (map[string]Kitchen, error) {
+
+	req, err := http.NewRequest("GET", kitchensAPIURL, nil)
 	if err != nil {
 		return nil, errors.New(
 			fmt.Sprintf("There was an error creating a request to get kitchen info: %s", err.Error()))
 	}
 	req.Header.Add("Accept", "application/vnd.api.clustertruck.com; version=2")
 
-	res, err := httpClient.Do(req)
+	res, err := httpClient.Do(req.WithContext(ctx))
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("There was an error sending a request to the ClusterTruck "+
-			"Kitchens API: %s", err.Error()))
+		return nil, upstreamTransportError(upstreamKitchensAPI, "There was an error sending a request to the ClusterTruck "+
+			"Kitchens API", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, upstreamHTTPStatusError(upstreamKitchensAPI, res.StatusCode)
 	}
 
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return nil, errors.New(
-			fmt.Sprintf("There was an error reading the response from the ClusterTruck Kitchens API: %s",
-				err.Error()))
+		return nil, upstreamRequestError(upstreamKitchensAPI, "There was an error reading the response from the "+
+			"ClusterTruck Kitchens API", err)
 	}
 
 	var kitchens Kitchens
 	err = json.Unmarshal(body, &kitchens)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("There was an error deserializing the response from the "+
-			"ClusterTruck Kitchens API: %s", err.Error()))
+		return nil, upstreamRequestError(upstreamKitchensAPI, "There was an error deserializing the response from the "+
+			"ClusterTruck Kitchens API", err)
 	}
 
 	kitchenMap := make(map[string]Kitchen)
@@ -53,50 +127,140 @@ func getClusterTruckKitchenInfo(httpClient HttpClient) (map[string]Kitchen, erro
 	return kitchenMap, nil
 }
 
+// Decodes kitchens one by one, so errors can point to the kitchen that could not be decoded
 func (k *Kitchens) UnmarshalJSON(b []byte) error {
-	var kitchens []map[string]interface{}
-	err := json.Unmarshal(b, &kitchens)
+	var rawKitchens []json.RawMessage
+	err := json.Unmarshal(b, &rawKitchens)
 	if err != nil {
 		return err
 	}
 
-	*k = make([]Kitchen, len(kitchens))
-	for i, kitchen := range kitchens {
-		(*k)[i].ID = kitchen["id"].(string)
-		(*k)[i].Name = kitchen["name"].(string)
+	*k = make([]Kitchen, len(rawKitchens))
+	for i, rawKitchen := range rawKitchens {
+		err = json.Unmarshal(rawKitchen, &(*k)[i])
+		if err != nil {
+			return errors.New(fmt.Sprintf("kitchen at index %d could not be decoded: %s", i, err.Error()))
+		}
+	}
 
-		unmarshalAddress(kitchen, k, i)
+	return nil
+}
+
+func (k *Kitchen) UnmarshalJSON(b []byte) error {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(b, &fields)
+	if err != nil {
+		return err
+	}
+
+	for _, field := range requiredKitchenFields {
+		value, ok := fields[field]
+		if !ok || string(value) == "null" {
+			return errors.New(fmt.Sprintf("required field \"%s\" is missing", field))
+		}
 	}
 
+	// The alias type does not have an UnmarshalJSON method, so this doesn't recurse
+	type kitchenAlias Kitchen
+	var kitchen kitchenAlias
+	err = json.Unmarshal(b, &kitchen)
+	if err != nil {
+		return err
+	}
+
+	*k = Kitchen(kitchen)
+	k.Address = k.fullAddress()
+
 	return nil
 }
 
 // Condense address into one variable, for easy searching with GMaps Directions API
 //
-// We perform a check to see if the value exists (ok == false if type is not string)
-// and also check the length of the variable to make sure it's not empty
-func unmarshalAddress(kitchen map[string]interface{}, k *Kitchens, i int) {
-	fullAddress := ""
-	address1, ok := kitchen["address_1"].(string)
-	if ok && len(address1) > 0 {
-		fullAddress += address1
+// Empty parts of the address are skipped
+func (k *Kitchen) fullAddress() string {
+	fullAddress := k.Address1
+	if len(k.Address2) > 0 {
+		fullAddress += " " + k.Address2
 	}
-	address2, ok := kitchen["address_2"].(string)
-	if ok && len(address2) > 0 {
-		fullAddress += " " + address2
+	if len(k.City) > 0 {
+		fullAddress += ", " + k.City
 	}
-	city, ok := kitchen["city"].(string)
-	if ok && len(city) > 0 {
-		fullAddress += ", " + city
+	if len(k.State) > 0 {
+		fullAddress += ", " + k.State
 	}
-	state, ok := kitchen["state"].(string)
-	if ok && len(state) > 0 {
-		fullAddress += ", " + state
+	if len(k.ZipCode) > 0 {
+		fullAddress += ", " + k.ZipCode
 	}
-	zipCode, ok := kitchen["zip_code"].(string)
-	if ok && len(zipCode) > 0 {
-		fullAddress += ", " + zipCode
+
+	return fullAddress
+}
+
+// Returns the opening intervals for the given day of the week
+func (h *KitchenHours) ForWeekday(weekday time.Weekday) []HoursInterval {
+	switch weekday {
+	case time.Sunday:
+		return h.Sunday
+	case time.Monday:
+		return h.Monday
+	case time.Tuesday:
+		return h.Tuesday
+	case time.Wednesday:
+		return h.Wednesday
+	case time.Thursday:
+		return h.Thursday
+	case time.Friday:
+		return h.Friday
+	case time.Saturday:
+		return h.Saturday
+	}
+
+	return nil
+}
+
+func (i *HoursInterval) UnmarshalJSON(b []byte) error {
+	var interval []TimeOfDay
+	err := json.Unmarshal(b, &interval)
+	if err != nil {
+		return err
+	}
+
+	if len(interval) != 2 {
+		return errors.New(fmt.Sprintf("expected an opening interval with 2 times, but got %d", len(interval)))
+	}
+
+	i.Opens = interval[0]
+	i.Closes = interval[1]
+
+	return nil
+}
+
+func (i HoursInterval) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]TimeOfDay{i.Opens, i.Closes})
+}
+
+func (t *TimeOfDay) UnmarshalJSON(b []byte) error {
+	var value string
+	err := json.Unmarshal(b, &value)
+	if err != nil {
+		return err
+	}
+
+	var hours, minutes int
+	_, err = fmt.Sscanf(value, "%2d:%2d", &hours, &minutes)
+	if err != nil || len(value) != 5 || hours < 0 || hours > 24 || minutes < 0 || minutes > 59 ||
+		(hours == 24 && minutes > 0) {
+		return errors.New(fmt.Sprintf("\"%s\" is not a valid time of day, expected HH:MM", value))
 	}
 
-	(*k)[i].Address = fullAddress
+	*t = TimeOfDay(hours*60 + minutes)
+
+	return nil
+}
+
+func (t TimeOfDay) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+func (t TimeOfDay) String() string {
+	return fmt.Sprintf("%02d:%02d", int(t)/60, int(t)%60)
 }
@@ -0,0 +1,190 @@
+package clustertruck
+
+import (
+	"sync"
+	"time"
+	"log"
+	"context"
+)
+
+// How long to wait before trying again after a failed refresh, so a broken Kitchens API
+// isn't called on every request
+const kitchenRefreshRetryInterval = time.Minute
+
+// Caches kitchen information from the ClusterTruck Kitchens API.
+//
+// Once the TTL expires, the cached kitchens are still served while they are refreshed in the background.
+// They can also be refreshed on a schedule with StartRefreshing, so they are refreshed before they expire
+// instead of waiting for a request to find them stale. If the refresh fails, the stale kitchens keep being
+// served and the failure is logged and reported through Status(). When there are no kitchens yet, all callers
+// wait on a single request to the Kitchens API.
+type KitchenStore struct {
+	httpClient     HttpClient
+	kitchensAPIURL string
+	ttl            time.Duration
+	// How long a single fetch can take. 0 means no limit
+	fetchTimeout time.Duration
+	now          func() time.Time
+
+	mutex     sync.Mutex
+	kitchens  map[string]Kitchen
+	fetchedAt time.Time
+	// Closed when the fetch in progress finishes, nil if there is no fetch in progress
+	fetchDone          chan struct{}
+	lastAttemptAt      time.Time
+	lastRefreshError   error
+	lastRefreshErrorAt time.Time
+
+	// Closed to stop the scheduled refreshes
+	stopRefreshing chan struct{}
+	closeOnce      sync.Once
+}
+
+// Reports the state of the kitchen store
+type KitchenStoreStatus struct {
+	Kitchens  int       `json:"kitchens"`
+	FetchedAt time.Time `json:"fetched_at"`
+	Stale     bool      `json:"stale"`
+	// How long ago the kitchens were fetched. Left out if there are no kitchens yet
+	AgeSeconds *float64 `json:"age_seconds,omitempty"`
+	// Set when the last refresh failed
+	LastRefreshError   string     `json:"last_refresh_error,omitempty"`
+	LastRefreshErrorAt *time.Time `json:"last_refresh_error_at,omitempty"`
+}
+
+func NewKitchenStore(httpClient HttpClient, kitchensAPIURL string, ttl time.Duration,
+	fetchTimeout time.Duration) *KitchenStore {
+
+	return &KitchenStore{
+		httpClient:     httpClient,
+		kitchensAPIURL: kitchensAPIURL,
+		ttl:            ttl,
+		fetchTimeout:   fetchTimeout,
+		now:            time.Now,
+		stopRefreshing: make(chan struct{}),
+	}
+}
+
+// Refreshes the kitchens every interval in the background, until the store is closed
+func (s *KitchenStore) StartRefreshing(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		s.refreshOnTicks(ticker.C)
+	}()
+}
+
+func (s *KitchenStore) refreshOnTicks(ticks <-chan time.Time) {
+	for {
+		select {
+		case <-ticks:
+			s.mutex.Lock()
+			if s.fetchDone == nil {
+				s.startFetchLocked()
+			}
+			s.mutex.Unlock()
+		case <-s.stopRefreshing:
+			return
+		}
+	}
+}
+
+// Stops the scheduled refreshes. Kitchens are still fetched when they are asked for.
+func (s *KitchenStore) Close() {
+	s.closeOnce.Do(func() { close(s.stopRefreshing) })
+}
+
+// Returns the cached kitchens, keyed by kitchen ID. The returned map must not be modified.
+//
+// Fetches are shared by every caller, so they aren't canceled along with the context. The context only
+// limits how long this caller waits for the kitchens.
+func (s *KitchenStore) Kitchens(ctx context.Context) (map[string]Kitchen, error) {
+	s.mutex.Lock()
+	if s.kitchens != nil {
+		kitchens := s.kitchens
+		if s.isStaleLocked() && s.fetchDone == nil && s.now().Sub(s.lastAttemptAt) >= kitchenRefreshRetryInterval {
+			s.startFetchLocked()
+		}
+		s.mutex.Unlock()
+		return kitchens, nil
+	}
+
+	if s.fetchDone == nil {
+		s.startFetchLocked()
+	}
+	fetchDone := s.fetchDone
+	s.mutex.Unlock()
+
+	select {
+	case <-fetchDone:
+	case <-ctx.Done():
+		return nil, contextError(ctx)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.kitchens == nil {
+		return nil, s.lastRefreshError
+	}
+
+	return s.kitchens, nil
+}
+
+func (s *KitchenStore) Status() KitchenStoreStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	status := KitchenStoreStatus{
+		Kitchens:  len(s.kitchens),
+		FetchedAt: s.fetchedAt,
+		Stale:     s.isStaleLocked(),
+	}
+	if s.kitchens != nil {
+		ageSeconds := s.now().Sub(s.fetchedAt).Seconds()
+		status.AgeSeconds = &ageSeconds
+	}
+	if s.lastRefreshError != nil {
+		lastRefreshErrorAt := s.lastRefreshErrorAt
+		status.LastRefreshError = s.lastRefreshError.Error()
+		status.LastRefreshErrorAt = &lastRefreshErrorAt
+	}
+
+	return status
+}
+
+func (s *KitchenStore) isStaleLocked() bool {
+	return s.kitchens == nil || s.now().Sub(s.fetchedAt) >= s.ttl
+}
+
+// Must be called while holding the mutex
+func (s *KitchenStore) startFetchLocked() {
+	fetchDone := make(chan struct{})
+	s.fetchDone = fetchDone
+	s.lastAttemptAt = s.now()
+
+	go func() {
+		ctx, cancel := contextWithUpstreamTimeout(context.Background(), s.fetchTimeout)
+		kitchens, err := getClusterTruckKitchenInfo(ctx, s.httpClient, s.kitchensAPIURL)
+		cancel()
+
+		s.mutex.Lock()
+		if err != nil {
+			s.lastRefreshError = err
+			s.lastRefreshErrorAt = s.now()
+			if s.kitchens != nil {
+				log.Printf("Kitchen refresh failed, serving kitchens fetched at %s: %s\n",
+					s.fetchedAt.Format(time.RFC3339), err.Error())
+			} else {
+				log.Printf("Kitchen fetch failed: %s\n", err.Error())
+			}
+		} else {
+			s.kitchens = kitchens
+			s.fetchedAt = s.now()
+			s.lastRefreshError = nil
+		}
+		s.fetchDone = nil
+		s.mutex.Unlock()
+
+		close(fetchDone)
+	}()
+}
@@ -0,0 +1,142 @@
+package clustertruck
+
+import (
+	"testing"
+	"net/http"
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+	"errors"
+	"context"
+)
+
+func TestKitchenStoreCachesKitchens(t *testing.T) {
+	mockKitchenResponse := readMockFile("kitchen_response.json")
+	var calls int32
+	client := &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&calls, 1)
+			return createHttpResponseForTest(http.StatusOK, bytes.NewBuffer(mockKitchenResponse)), nil
+		},
+	}
+
+	store := NewKitchenStore(client, DefaultConfig().KitchensAPIURL, time.Hour, 0)
+	store.Kitchens(context.Background())
+	kitchens, err := store.Kitchens(context.Background())
+	assertResult(t, nil, err)
+	assertResult(t, 6, len(kitchens))
+	assertResult(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestKitchenStoreFetchesOnceOnConcurrentColdStart(t *testing.T) {
+	mockKitchenResponse := readMockFile("kitchen_response.json")
+	var calls int32
+	release := make(chan struct{})
+	client := &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return createHttpResponseForTest(http.StatusOK, bytes.NewBuffer(mockKitchenResponse)), nil
+		},
+	}
+
+	store := NewKitchenStore(client, DefaultConfig().KitchensAPIURL, time.Hour, 0)
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			defer waitGroup.Done()
+			kitchens, _ := store.Kitchens(context.Background())
+			if len(kitchens) != 6 {
+				t.Error("Expected every caller to receive the kitchens")
+			}
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	waitGroup.Wait()
+
+	assertResult(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestKitchenStoreServesStaleKitchensWhenRefreshFails(t *testing.T) {
+	mockKitchenResponse := readMockFile("kitchen_response.json")
+	var failing int32
+	client := &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			if atomic.LoadInt32(&failing) == 1 {
+				return nil, errors.New("connection refused")
+			}
+			return createHttpResponseForTest(http.StatusOK, bytes.NewBuffer(mockKitchenResponse)), nil
+		},
+	}
+
+	now := time.Date(2017, 12, 4, 12, 0, 0, 0, time.UTC)
+	store := NewKitchenStore(client, DefaultConfig().KitchensAPIURL, 24*time.Hour, 0)
+	store.now = func() time.Time { return now }
+	store.Kitchens(context.Background())
+
+	atomic.StoreInt32(&failing, 1)
+	now = now.Add(25 * time.Hour)
+	kitchens, err := store.Kitchens(context.Background())
+	assertResult(t, nil, err)
+	assertResult(t, 6, len(kitchens))
+
+	// Wait for the background refresh to fail
+	for i := 0; i < 100 && store.Status().LastRefreshError == ""; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	status := store.Status()
+	assertResult(t, true, status.Stale)
+	assertResult(t, 6, status.Kitchens)
+	assertResult(t, "There was an error sending a request to the ClusterTruck Kitchens API: connection refused",
+		status.LastRefreshError)
+
+	kitchens, err = store.Kitchens(context.Background())
+	assertResult(t, nil, err)
+	assertResult(t, 6, len(kitchens))
+}
+
+func TestKitchenStoreRefreshesOnSchedule(t *testing.T) {
+	mockKitchenResponse := readMockFile("kitchen_response.json")
+	var calls int32
+	client := &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&calls, 1)
+			return createHttpResponseForTest(http.StatusOK, bytes.NewBuffer(mockKitchenResponse)), nil
+		},
+	}
+
+	now := time.Date(2017, 12, 4, 12, 0, 0, 0, time.UTC)
+	store := NewKitchenStore(client, DefaultConfig().KitchensAPIURL, 24*time.Hour, 0)
+	store.now = func() time.Time { return now }
+	assertResult(t, true, store.Status().AgeSeconds == nil)
+	store.Kitchens(context.Background())
+
+	ticks := make(chan time.Time)
+	stopped := make(chan struct{})
+	go func() {
+		store.refreshOnTicks(ticks)
+		close(stopped)
+	}()
+
+	now = now.Add(time.Hour)
+	assertResult(t, float64(3600), *store.Status().AgeSeconds)
+
+	// The kitchens are refreshed even though they aren't stale yet
+	ticks <- now
+	for i := 0; i < 100 && atomic.LoadInt32(&calls) < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assertResult(t, int32(2), atomic.LoadInt32(&calls))
+	for i := 0; i < 100 && *store.Status().AgeSeconds != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assertResult(t, float64(0), *store.Status().AgeSeconds)
+
+	store.Close()
+	<-stopped
+}
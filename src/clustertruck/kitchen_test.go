@@ -4,6 +4,8 @@ import (
 	"testing"
 	"net/http"
 	"bytes"
+	"time"
+	"context"
 )
 
 func TestGetClusterTruckKitchenInfoAddress(t *testing.T) {
@@ -14,7 +16,7 @@ func TestGetClusterTruckKitchenInfoAddress(t *testing.T) {
 		},
 	}
 
-	kitchens, _ := getClusterTruckKitchenInfo(client)
+	kitchens, _ := getClusterTruckKitchenInfo(context.Background(), client, DefaultConfig().KitchensAPIURL)
 	assertResult(t, 6, len(kitchens))
 	kitchenId := "00000000-0000-0000-0000-000000000000"
 	assertResult(t, "729 N. Pennsylvania St., Indianapolis, IN, 46204", kitchens[kitchenId].Address)
@@ -27,8 +29,66 @@ func TestGetClusterTruckKitchenInfoReturnError(t *testing.T) {
 		},
 	}
 
-	_, err := getClusterTruckKitchenInfo(client)
+	_, err := getClusterTruckKitchenInfo(context.Background(), client, DefaultConfig().KitchensAPIURL)
 	expected := "There was an error deserializing the response from the ClusterTruck Kitchens API: invalid " +
 		"character 'i' looking for beginning of value"
 	assertResult(t, expected, err.Error())
 }
+
+func TestGetClusterTruckKitchenInfoTypedFields(t *testing.T) {
+	mockKitchenResponse := readMockFile("kitchen_response.json")
+	client := &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			return createHttpResponseForTest(http.StatusOK, bytes.NewBuffer(mockKitchenResponse)), nil
+		},
+	}
+
+	kitchens, _ := getClusterTruckKitchenInfo(context.Background(), client, DefaultConfig().KitchensAPIURL)
+	kitchen := kitchens["78b8942a-f2b2-11e6-a354-9b8e27ea137d"]
+	assertResult(t, 39.17093690000001, kitchen.Location.Lat)
+	assertResult(t, "America/New_York", kitchen.Timezone)
+	assertResult(t, "7.0", kitchen.TaxRate)
+	assertResult(t, true, kitchen.Active)
+	assertResult(t, "online", kitchen.KitchenState)
+	assertResult(t, "btown", kitchen.Slug)
+	assertResult(t, TimeOfDay(11*60), kitchen.Hours.ForWeekday(time.Monday)[0].Opens)
+	assertResult(t, "22:00", kitchen.Hours.Monday[0].Closes.String())
+	assertResult(t, "bloomington-polygon", kitchen.DeliveryAreas[0].Name)
+	assertResult(t, 48, len(kitchen.DeliveryAreas[0].Coordinates))
+
+	kansasCity := kitchens["bd5f1db0-8687-11e7-ae69-b7647581c6c3"]
+	assertResult(t, true, kansasCity.Hours == nil)
+	assertResult(t, "", kansasCity.Timezone)
+	assertResult(t, "pending", kansasCity.KitchenState)
+}
+
+func TestGetClusterTruckKitchenInfoMissingField(t *testing.T) {
+	client := &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			return createHttpResponseForTest(http.StatusOK,
+				bytes.NewBufferString(`[{"name": "No ID", "address_1": "1 Main St", "city": "Anywhere", `+
+					`"state": "OH", "location": {"lat": 1, "lng": 2}, "active": true, "kitchen_state": "online"}]`)), nil
+		},
+	}
+
+	_, err := getClusterTruckKitchenInfo(context.Background(), client, DefaultConfig().KitchensAPIURL)
+	expected := "There was an error deserializing the response from the ClusterTruck Kitchens API: " +
+		"kitchen at index 0 could not be decoded: required field \"id\" is missing"
+	assertResult(t, expected, err.Error())
+}
+
+func TestGetClusterTruckKitchenInfoUnexpectedHours(t *testing.T) {
+	client := &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			return createHttpResponseForTest(http.StatusOK,
+				bytes.NewBufferString(`[{"id": "1", "name": "Bad Hours", "address_1": "1 Main St", `+
+					`"city": "Anywhere", "state": "OH", "location": {"lat": 1, "lng": 2}, "active": true, `+
+					`"kitchen_state": "online", "hours": {"monday": [["8am", "10pm"]]}}]`)), nil
+		},
+	}
+
+	_, err := getClusterTruckKitchenInfo(context.Background(), client, DefaultConfig().KitchensAPIURL)
+	expected := "There was an error deserializing the response from the ClusterTruck Kitchens API: " +
+		"kitchen at index 0 could not be decoded: \"8am\" is not a valid time of day, expected HH:MM"
+	assertResult(t, expected, err.Error())
+}
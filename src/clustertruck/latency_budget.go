@@ -0,0 +1,109 @@
+package clustertruck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// What happens to the calls to the directions provider that are still in progress when the latency budget
+// of a request runs out
+const (
+	// The calls are canceled
+	OutstandingCallsCancel = "cancel"
+	// The calls are left to finish in the background, so their answers are cached for the next request
+	OutstandingCallsFinish = "finish"
+)
+
+func parseOutstandingCallsPolicy(value string) (string, error) {
+	switch value {
+	case OutstandingCallsCancel, OutstandingCallsFinish:
+		return value, nil
+	}
+
+	return "", errors.New(fmt.Sprintf("\"%s\" is not a valid policy, it must be %s or %s", value,
+		OutstandingCallsCancel, OutstandingCallsFinish))
+}
+
+// Context for the calls to the directions provider of a request with a latency budget. Depending on the policy,
+// the calls are either canceled by the returned function, or detached from the request and limited by the
+// timeout, which starts when the calls do, so they can't keep running in the background forever. A timeout of
+// 0 leaves them limited only by their own timeouts.
+func directionsCallsContext(ctx context.Context, policy string, timeout time.Duration) (context.Context,
+	context.CancelFunc) {
+
+	if policy == OutstandingCallsFinish {
+		if timeout <= 0 {
+			return context.Background(), func() {}
+		}
+		detachedCtx, cancelDetached := context.WithTimeout(context.Background(), timeout)
+		// Released when the timeout runs out, rather than when the request is done
+		go func() {
+			<-detachedCtx.Done()
+			cancelDetached()
+		}()
+		return detachedCtx, func() {}
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// Passes on the answers of the directions provider until the deadline, and closes the returned channel once
+// the deadline has passed. If none of the kitchens have a route by then, answers keep being passed on until
+// one of them does, so there is always a kitchen to return. The channel is also closed when the request is done.
+func limitDirectionsToDeadline(ctx context.Context, allPossibleDirections chan *KitchenIDDirectionsPair,
+	deadline time.Time) chan *KitchenIDDirectionsPair {
+
+	directionsBeforeDeadline := make(chan *KitchenIDDirectionsPair, cap(allPossibleDirections))
+	go func() {
+		defer close(directionsBeforeDeadline)
+
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		deadlinePassed := timer.C
+		foundRoute := false
+		for {
+			select {
+			case kitchenIdDirectionsPair, ok := <-allPossibleDirections:
+				if !ok {
+					return
+				}
+				directionsBeforeDeadline <- kitchenIdDirectionsPair
+				foundRoute = foundRoute || (kitchenIdDirectionsPair.Error == nil &&
+					len(kitchenIdDirectionsPair.Routes) > 0)
+				if foundRoute && deadlinePassed == nil {
+					return
+				}
+			case <-deadlinePassed:
+				if foundRoute {
+					return
+				}
+				// Receiving from a nil channel blocks forever, so the deadline is only handled once
+				deadlinePassed = nil
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return directionsBeforeDeadline
+}
+
+// Lists the kitchens that did not answer before the latency budget ran out
+func findUnansweredKitchens(kitchenIdToDirectionsMap map[string]*KitchenIDDirectionsPair,
+	kitchens map[string]Kitchen) []PendingKitchen {
+
+	var pendingKitchens []PendingKitchen
+	for kitchenId, kitchen := range kitchens {
+		if _, answered := kitchenIdToDirectionsMap[kitchenId]; !answered {
+			pendingKitchens = append(pendingKitchens, PendingKitchen{ID: kitchenId, Name: kitchen.Name})
+		}
+	}
+	sort.Slice(pendingKitchens, func(i, j int) bool {
+		return pendingKitchens[i].ID < pendingKitchens[j].ID
+	})
+
+	return pendingKitchens
+}
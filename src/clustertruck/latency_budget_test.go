@@ -0,0 +1,132 @@
+package clustertruck
+
+import (
+	"testing"
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+	"os"
+)
+
+func TestFindDriveTimeWithinLatencyBudgetCancelsOutstandingCalls(t *testing.T) {
+	var canceledCalls int32
+	client := createClientWithRoutesToEveryKitchen()
+	doFunc := client.DoFunc
+	client.DoFunc = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "Denver") {
+			<-req.Context().Done()
+			atomic.AddInt32(&canceledCalls, 1)
+			return nil, req.Context().Err()
+		}
+		return doFunc(req)
+	}
+	service := createDriveTimeServiceForTest(client, "2017-12-04 12:00")
+	service.config.GoogleMapsTimeout = 0
+
+	closestClusterTruckInfo, err := service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{StartingAddress: "startingAddress", MaxLatencyMillis: 500, Explain: true})
+	assertResult(t, nil, err)
+	assertResult(t, "Downtown Columbus", closestClusterTruckInfo.LocationName)
+	assertResult(t, true, closestClusterTruckInfo.Partial)
+	assertResult(t, 1, len(closestClusterTruckInfo.PendingKitchens))
+	assertResult(t, "Denver", closestClusterTruckInfo.PendingKitchens[0].Name)
+
+	denver := findExplanationForTest(closestClusterTruckInfo.Explanation, "Denver")
+	assertResult(t, explanationOutcomePending, denver.Outcome)
+	assertResult(t, explanationReasonMaxLatency, denver.Reason)
+
+	for i := 0; i < 100 && atomic.LoadInt32(&canceledCalls) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertResult(t, int32(1), atomic.LoadInt32(&canceledCalls))
+}
+
+func TestFindDriveTimeWithinLatencyBudgetLetsOutstandingCallsWarmTheCache(t *testing.T) {
+	release := make(chan struct{})
+	client := createClientWithRoutesToEveryKitchen()
+	doFunc := client.DoFunc
+	client.DoFunc = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "Denver") {
+			<-release
+		}
+		return doFunc(req)
+	}
+	service := createDriveTimeServiceForTest(client, "2017-12-04 12:00")
+	service.config.OutstandingCalls = OutstandingCallsFinish
+
+	closestClusterTruckInfo, _ := service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{StartingAddress: "startingAddress", MaxLatencyMillis: 500})
+	assertResult(t, true, closestClusterTruckInfo.Partial)
+
+	close(release)
+	for i := 0; i < 100 && service.directionsCache.Metrics().Entries < 6; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	closestClusterTruckInfo, _ = service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{StartingAddress: "startingAddress", MaxLatencyMillis: 500})
+	assertResult(t, false, closestClusterTruckInfo.Partial)
+	assertResult(t, 0, len(closestClusterTruckInfo.PendingKitchens))
+	assertResult(t, cacheStatusHit, closestClusterTruckInfo.Metadata.Cache)
+}
+
+func TestFindDriveTimeWaitsForFirstRouteAfterLatencyBudget(t *testing.T) {
+	client := createClientWithRoutesToEveryKitchen()
+	doFunc := client.DoFunc
+	client.DoFunc = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "Bloomington") {
+			time.Sleep(30 * time.Millisecond)
+		} else if strings.Contains(req.URL.Path, "directions") {
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		}
+		return doFunc(req)
+	}
+	service := createDriveTimeServiceForTest(client, "2017-12-04 12:00")
+	service.config.GoogleMapsTimeout = 0
+
+	closestClusterTruckInfo, err := service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{StartingAddress: "startingAddress", MaxLatencyMillis: 1})
+	assertResult(t, nil, err)
+	assertResult(t, "Bloomington", closestClusterTruckInfo.LocationName)
+	assertResult(t, 5, len(closestClusterTruckInfo.PendingKitchens))
+}
+
+func TestRequestPayloadWithNegativeMaxLatency(t *testing.T) {
+	payload := RequestPayload{StartingAddress: "startingAddress", MaxLatencyMillis: -1}
+
+	assertResult(t, "max_latency_ms must be a positive number, but was -1", payload.validate().Error())
+}
+
+func TestLoadConfigFromEnvWithOutstandingCalls(t *testing.T) {
+	os.Setenv("CT_OUTSTANDING_CALLS", "finish")
+	defer os.Unsetenv("CT_OUTSTANDING_CALLS")
+
+	config, err := LoadConfigFromEnv()
+	assertResult(t, nil, err)
+	assertResult(t, OutstandingCallsFinish, config.OutstandingCalls)
+
+	os.Setenv("CT_OUTSTANDING_CALLS", "wait")
+	_, err = LoadConfigFromEnv()
+	assertResult(t, true, err != nil)
+}
+
+func TestOutstandingCallsThatFinishAreBoundedByTimeout(t *testing.T) {
+	requestCtx, cancelRequest := context.WithCancel(context.Background())
+	callsCtx, cancelCalls := directionsCallsContext(requestCtx, OutstandingCallsFinish, time.Hour)
+	cancelCalls()
+	cancelRequest()
+
+	// The calls outlive the request, but not the timeout
+	assertResult(t, nil, callsCtx.Err())
+	deadline, ok := callsCtx.Deadline()
+	assertResult(t, true, ok)
+	assertResult(t, true, deadline.Before(time.Now().Add(time.Hour+time.Second)))
+
+	callsCtx, cancelCalls = directionsCallsContext(context.Background(), OutstandingCallsFinish, time.Millisecond)
+	defer cancelCalls()
+	<-callsCtx.Done()
+	assertResult(t, context.DeadlineExceeded, callsCtx.Err())
+}
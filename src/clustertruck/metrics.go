@@ -0,0 +1,22 @@
+package clustertruck
+
+// Metrics returned by the /api/metrics endpoint
+type ServiceMetrics struct {
+	DirectionsPool  WorkerPoolMetrics      `json:"directions_pool"`
+	DirectionsCache DirectionsCacheMetrics `json:"directions_cache"`
+	CircuitBreakers []CircuitBreakerStatus `json:"circuit_breakers"`
+}
+
+// Values of the "status" of the /api/health endpoint
+const (
+	healthStatusOK       = "ok"
+	healthStatusDegraded = "degraded"
+)
+
+// Returned by the /api/health endpoint
+type HealthStatus struct {
+	// Either "ok", or "degraded" while an upstream API is failing
+	Status          string                 `json:"status"`
+	Kitchens        KitchenStoreStatus     `json:"kitchens"`
+	CircuitBreakers []CircuitBreakerStatus `json:"circuit_breakers"`
+}
@@ -0,0 +1,124 @@
+package clustertruck
+
+import (
+	"net/http"
+	"io/ioutil"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"context"
+	"time"
+)
+
+// Contains data returned from a call to the route service of an OSRM server
+// OSRM returns a lot more data, but we ignore the unused portions.
+type OSRMRoutes struct {
+	// "Ok" if the request was successful
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Routes  []OSRMRoute `json:"routes"`
+}
+
+type OSRMRoute struct {
+	Legs []OSRMLeg `json:"legs"`
+}
+
+type OSRMLeg struct {
+	// Names of the main roads used by the leg
+	Summary string `json:"summary"`
+	// In meters
+	Distance float64 `json:"distance"`
+	// In seconds
+	Duration float64 `json:"duration"`
+}
+
+// Gets directions from an OSRM server, such as a self-hosted OSRM or a local stand-in that speaks the
+// same format. OSRM only works with coordinates, so waypoints without coordinates can't be routed.
+type OSRMDirectionsProvider struct {
+	httpClient HttpClient
+	baseURL    string
+	timeout    time.Duration
+}
+
+func NewOSRMDirectionsProvider(httpClient HttpClient, config Config) *OSRMDirectionsProvider {
+	return &OSRMDirectionsProvider{
+		httpClient: httpClient,
+		baseURL:    config.OSRMURL,
+		timeout:    config.OSRMTimeout,
+	}
+}
+
+func (p *OSRMDirectionsProvider) Name() string {
+	return DirectionsProviderOSRM
+}
+
+// OSRM does not know about traffic, so the travel options are ignored
+func (p *OSRMDirectionsProvider) GetDirections(ctx context.Context, origin Waypoint, destination Waypoint,
+	options TravelOptions) ([]Route, error) {
+
+	if origin.Coordinates == nil || destination.Coordinates == nil {
+		return nil, newAPIError(ErrorCodeAddressNotFound, "OSRM can only find directions between coordinates, "+
+			"but the coordinates of the starting address or the kitchen are unknown")
+	}
+
+	// OSRM expects coordinates in "lng,lat" order
+	requestUrl := fmt.Sprintf("%s/route/v1/driving/%f,%f;%f,%f?alternatives=true&overview=false&steps=false",
+		p.baseURL, origin.Coordinates.Lng, origin.Coordinates.Lat, destination.Coordinates.Lng,
+		destination.Coordinates.Lat)
+
+	req, err := http.NewRequest("GET", requestUrl, nil)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("There was an error creating a request to get direction info: %s",
+			err.Error()))
+	}
+
+	ctx, cancel := contextWithUpstreamTimeout(ctx, p.timeout)
+	defer cancel()
+	res, err := p.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, upstreamTransportError(upstreamOSRM, "There was an error performing a request to the OSRM server", err)
+	}
+	defer res.Body.Close()
+
+	if isUpstreamFailureStatus(res.StatusCode) {
+		return nil, upstreamHTTPStatusError(upstreamOSRM, res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, upstreamRequestError(upstreamOSRM, "There was an error reading the response from the OSRM server", err)
+	}
+
+	// OSRM responds with a 400 and an error code when it can't find a route, so the body is always read
+	var osrmRoutes OSRMRoutes
+	err = json.Unmarshal(body, &osrmRoutes)
+	if err != nil {
+		return nil, upstreamRequestError(upstreamOSRM, "There was an error deserializing the response from the OSRM "+
+			"server", err)
+	}
+
+	if osrmRoutes.Code != "Ok" {
+		return nil, osrmCodeError(osrmRoutes.Code, fmt.Sprintf("Code of OSRM response was %s: %s", osrmRoutes.Code,
+			osrmRoutes.Message))
+	}
+
+	return osrmRoutes.toRoutes(), nil
+}
+
+func (o *OSRMRoutes) toRoutes() []Route {
+	routes := make([]Route, len(o.Routes))
+	for i, osrmRoute := range o.Routes {
+		routes[i].Legs = make([]Leg, len(osrmRoute.Legs))
+		for j, osrmLeg := range osrmRoute.Legs {
+			distance := int(osrmLeg.Distance + 0.5)
+			duration := int(osrmLeg.Duration + 0.5)
+			routes[i].Summary = osrmLeg.Summary
+			routes[i].Legs[j] = Leg{
+				Distance: MeasurementValues{Text: formatDistance(distance), Value: distance},
+				Duration: MeasurementValues{Text: formatDuration(duration), Value: duration},
+			}
+		}
+	}
+
+	return routes
+}
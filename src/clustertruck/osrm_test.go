@@ -0,0 +1,66 @@
+package clustertruck
+
+import (
+	"testing"
+	"net/http"
+	"bytes"
+	"context"
+)
+
+var osrmOriginForTest = Waypoint{Coordinates: &Coordinates{Lat: 39.4278244, Lng: -86.4283333}}
+var osrmDestinationForTest = Waypoint{
+	Address:     "destination",
+	Coordinates: &Coordinates{Lat: 39.1709369, Lng: -86.500373},
+}
+
+func TestGetOSRMDirections(t *testing.T) {
+	mockOSRMResponse := readMockFile("osrm_route_response.json")
+	var requestUrl string
+	client := &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			requestUrl = req.URL.String()
+			return createHttpResponseForTest(http.StatusOK, bytes.NewBuffer(mockOSRMResponse)), nil
+		},
+	}
+
+	config := DefaultConfig()
+	config.OSRMURL = "http://osrm.local"
+	routes, _ := NewOSRMDirectionsProvider(client, config).
+		GetDirections(context.Background(), osrmOriginForTest, osrmDestinationForTest, TravelOptions{})
+
+	assertResult(t, "http://osrm.local/route/v1/driving/-86.428333,39.427824;-86.500373,39.170937"+
+		"?alternatives=true&overview=false&steps=false", requestUrl)
+	assertResult(t, 2, len(routes))
+	assertResult(t, 2144, routes[0].Legs[0].Duration.Value)
+	assertResult(t, "36 mins", routes[0].Legs[0].Duration.Text)
+	assertResult(t, 34903, routes[0].Legs[0].Distance.Value)
+	assertResult(t, "21.7 mi", routes[0].Legs[0].Distance.Text)
+}
+
+func TestGetOSRMDirectionsWithNoRoute(t *testing.T) {
+	mockOSRMResponse := readMockFile("osrm_route_response_no_route.json")
+	client := &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			return createHttpResponseForTest(http.StatusBadRequest, bytes.NewBuffer(mockOSRMResponse)), nil
+		},
+	}
+
+	_, err := NewOSRMDirectionsProvider(client, DefaultConfig()).
+		GetDirections(context.Background(), osrmOriginForTest, osrmDestinationForTest, TravelOptions{})
+	assertResult(t, "Code of OSRM response was NoRoute: Impossible route between points", err.Error())
+}
+
+func TestGetOSRMDirectionsWithoutCoordinates(t *testing.T) {
+	_, err := NewOSRMDirectionsProvider(&MockClient{}, DefaultConfig()).
+		GetDirections(context.Background(), Waypoint{Address: "origin"}, osrmDestinationForTest, TravelOptions{})
+	assertResult(t, "OSRM can only find directions between coordinates, but the coordinates of the starting "+
+		"address or the kitchen are unknown", err.Error())
+}
+
+func TestNewDirectionsProviderUsesConfig(t *testing.T) {
+	config := DefaultConfig()
+	assertResult(t, "google", NewDirectionsProvider(&MockClient{}, config).Name())
+
+	config.DirectionsProvider = DirectionsProviderOSRM
+	assertResult(t, "osrm", NewDirectionsProvider(&MockClient{}, config).Name())
+}
@@ -0,0 +1,56 @@
+package clustertruck
+
+import "sort"
+
+const metersPerMile = 1609.344
+
+// Reason for excluding kitchens that are too far away from the starting address, as the crow flies
+const exclusionReasonTooFar = "too_far"
+
+type kitchenDistance struct {
+	kitchen Kitchen
+	// Great-circle distance from the starting address, in meters
+	distance float64
+}
+
+// Ranks kitchens by great-circle distance from the starting address, and keeps the ones within the radius
+// (if radiusMeters is positive), up to a maximum of topK kitchens (if topK is positive).
+//
+// Great-circle distance is only an estimate of drive distance, so this should only be used to avoid calling
+// the directions provider for kitchens that are clearly too far away.
+func prefilterKitchensByDistance(kitchens map[string]Kitchen, origin Coordinates, topK int,
+	radiusMeters float64) (map[string]Kitchen, []ExcludedKitchen) {
+
+	kitchenDistances := make([]kitchenDistance, 0, len(kitchens))
+	for _, kitchen := range kitchens {
+		kitchenDistances = append(kitchenDistances, kitchenDistance{
+			kitchen:  kitchen,
+			distance: haversineDistance(origin, kitchen.Location),
+		})
+	}
+	sort.Slice(kitchenDistances, func(i, j int) bool {
+		if kitchenDistances[i].distance != kitchenDistances[j].distance {
+			return kitchenDistances[i].distance < kitchenDistances[j].distance
+		}
+		return kitchenDistances[i].kitchen.ID < kitchenDistances[j].kitchen.ID
+	})
+
+	candidateKitchens := make(map[string]Kitchen)
+	var excludedKitchens []ExcludedKitchen
+	for _, kitchenDistance := range kitchenDistances {
+		kitchen := kitchenDistance.kitchen
+		isWithinRadius := radiusMeters <= 0 || kitchenDistance.distance <= radiusMeters
+		isWithinTopK := topK <= 0 || len(candidateKitchens) < topK
+		if isWithinRadius && isWithinTopK {
+			candidateKitchens[kitchen.ID] = kitchen
+		} else {
+			excludedKitchens = append(excludedKitchens, ExcludedKitchen{
+				ID:     kitchen.ID,
+				Name:   kitchen.Name,
+				Reason: exclusionReasonTooFar,
+			})
+		}
+	}
+
+	return candidateKitchens, excludedKitchens
+}
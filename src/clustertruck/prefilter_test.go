@@ -0,0 +1,33 @@
+package clustertruck
+
+import (
+	"testing"
+	"net/http"
+	"bytes"
+	"context"
+)
+
+func TestPrefilterKitchensByDistance(t *testing.T) {
+	mockKitchenResponse := readMockFile("kitchen_response.json")
+	client := &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			return createHttpResponseForTest(http.StatusOK, bytes.NewBuffer(mockKitchenResponse)), nil
+		},
+	}
+	kitchens, _ := getClusterTruckKitchenInfo(context.Background(), client, DefaultConfig().KitchensAPIURL)
+	martinsville := Coordinates{Lat: 39.4278244, Lng: -86.4283333}
+
+	candidateKitchens, excludedKitchens := prefilterKitchensByDistance(kitchens, martinsville, 2, 0)
+	assertResult(t, 2, len(candidateKitchens))
+	assertResult(t, "Bloomington", candidateKitchens["78b8942a-f2b2-11e6-a354-9b8e27ea137d"].Name)
+	assertResult(t, "Downtown Indy", candidateKitchens["00000000-0000-0000-0000-000000000000"].Name)
+	assertResult(t, 4, len(excludedKitchens))
+	assertResult(t, "too_far", excludedKitchens[0].Reason)
+
+	// Columbus is about 186 miles away, and Cleveland is about 288 miles away
+	candidateKitchens, _ = prefilterKitchensByDistance(kitchens, martinsville, 0, 200*metersPerMile)
+	assertResult(t, 3, len(candidateKitchens))
+
+	candidateKitchens, _ = prefilterKitchensByDistance(kitchens, martinsville, 0, 0)
+	assertResult(t, 6, len(candidateKitchens))
+}
@@ -0,0 +1,150 @@
+package clustertruck
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Decides what "closest" means, used to select a ranking strategy in the configuration or in a request
+type RankingStrategy string
+
+const (
+	// Shortest drive time, in traffic if a departure time was given
+	RankingShortestTime RankingStrategy = "shortest_time"
+	// Shortest drive distance
+	RankingShortestDistance RankingStrategy = "shortest_distance"
+	// A blend of drive time and drive distance, weighted by the configuration
+	RankingWeighted RankingStrategy = "weighted"
+	// Smallest difference between the drive time in traffic and in normal conditions
+	RankingLowestTrafficDelay RankingStrategy = "lowest_traffic_delay"
+)
+
+// Ranks legs, both to pick a route among the alternatives to a kitchen, and to pick a kitchen among the candidates.
+// Legs with the same score are ranked by drive time, then by drive distance.
+type Ranker interface {
+	// Name of the strategy, such as "shortest_time"
+	Name() RankingStrategy
+	// The leg with the lowest score is the best one
+	Score(leg *Leg) float64
+}
+
+type shortestTimeRanker struct{}
+
+type shortestDistanceRanker struct{}
+
+type weightedRanker struct {
+	// Per second of drive time
+	timeWeight float64
+	// Per meter of drive distance
+	distanceWeight float64
+}
+
+type lowestTrafficDelayRanker struct{}
+
+func parseRankingStrategy(value string) (RankingStrategy, error) {
+	strategy := RankingStrategy(value)
+	switch strategy {
+	case RankingShortestTime, RankingShortestDistance, RankingWeighted, RankingLowestTrafficDelay:
+		return strategy, nil
+	}
+
+	return "", errors.New(fmt.Sprintf("\"%s\" is not a valid ranking strategy, expected one of %s, %s, %s or %s",
+		value, RankingShortestTime, RankingShortestDistance, RankingWeighted, RankingLowestTrafficDelay))
+}
+
+// The strategy must be valid. The weighted strategy uses the weights of the configuration.
+func newRanker(strategy RankingStrategy, config Config) Ranker {
+	switch strategy {
+	case RankingShortestDistance:
+		return shortestDistanceRanker{}
+	case RankingWeighted:
+		return weightedRanker{timeWeight: config.RankingTimeWeight, distanceWeight: config.RankingDistanceWeight}
+	case RankingLowestTrafficDelay:
+		return lowestTrafficDelayRanker{}
+	}
+
+	return shortestTimeRanker{}
+}
+
+func (shortestTimeRanker) Name() RankingStrategy {
+	return RankingShortestTime
+}
+
+func (shortestTimeRanker) Score(leg *Leg) float64 {
+	return float64(leg.DriveDuration().Value)
+}
+
+func (shortestDistanceRanker) Name() RankingStrategy {
+	return RankingShortestDistance
+}
+
+func (shortestDistanceRanker) Score(leg *Leg) float64 {
+	return float64(leg.Distance.Value)
+}
+
+func (r weightedRanker) Name() RankingStrategy {
+	return RankingWeighted
+}
+
+func (r weightedRanker) Score(leg *Leg) float64 {
+	return r.timeWeight*float64(leg.DriveDuration().Value) + r.distanceWeight*float64(leg.Distance.Value)
+}
+
+func (lowestTrafficDelayRanker) Name() RankingStrategy {
+	return RankingLowestTrafficDelay
+}
+
+// Legs without a drive time in traffic have no delay, so they are ranked by drive time
+func (lowestTrafficDelayRanker) Score(leg *Leg) float64 {
+	return float64(leg.DriveDuration().Value - leg.Duration.Value)
+}
+
+// Whether leg a is ranked before leg b
+func rankedBefore(ranker Ranker, a *Leg, b *Leg) bool {
+	scoreA, scoreB := ranker.Score(a), ranker.Score(b)
+	if scoreA != scoreB {
+		return scoreA < scoreB
+	}
+	if a.DriveDuration().Value != b.DriveDuration().Value {
+		return a.DriveDuration().Value < b.DriveDuration().Value
+	}
+
+	return a.Distance.Value < b.Distance.Value
+}
+
+// Picks the best of the alternative routes to a kitchen. The first route wins ties.
+func findBestRoute(routes []Route, ranker Ranker) *Route {
+	bestRoute := &routes[0]
+	for i := range routes[1:] {
+		route := &routes[i+1]
+		if rankedBefore(ranker, &route.Legs[0], &bestRoute.Legs[0]) {
+			bestRoute = route
+		}
+	}
+
+	return bestRoute
+}
+
+// Sorts kitchen IDs from the best route to the worst. Ties are broken by ID, so kitchens are always
+// in the same order.
+func sortKitchens(kitchenIdToRouteMap map[string]*Route, ranker Ranker) []string {
+	kitchenIds := make([]string, 0, len(kitchenIdToRouteMap))
+	for kitchenId := range kitchenIdToRouteMap {
+		kitchenIds = append(kitchenIds, kitchenId)
+	}
+
+	sort.Slice(kitchenIds, func(i, j int) bool {
+		legI := &kitchenIdToRouteMap[kitchenIds[i]].Legs[0]
+		legJ := &kitchenIdToRouteMap[kitchenIds[j]].Legs[0]
+		if rankedBefore(ranker, legI, legJ) {
+			return true
+		}
+		if rankedBefore(ranker, legJ, legI) {
+			return false
+		}
+		return kitchenIds[i] < kitchenIds[j]
+	})
+
+	return kitchenIds
+}
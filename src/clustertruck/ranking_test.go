@@ -0,0 +1,141 @@
+package clustertruck
+
+import (
+	"testing"
+	"strings"
+	"context"
+	"os"
+	"encoding/json"
+	"fmt"
+)
+
+func createLegForTest(duration int, durationInTraffic int, distance int) Leg {
+	leg := Leg{
+		Duration: MeasurementValues{Value: duration},
+		Distance: MeasurementValues{Value: distance},
+	}
+	if durationInTraffic > 0 {
+		leg.DurationInTraffic = &MeasurementValues{Value: durationInTraffic}
+	}
+
+	return leg
+}
+
+func TestRankersScoreLegs(t *testing.T) {
+	leg := createLegForTest(600, 900, 10000)
+
+	assertResult(t, 900.0, shortestTimeRanker{}.Score(&leg))
+	assertResult(t, 10000.0, shortestDistanceRanker{}.Score(&leg))
+	assertResult(t, 1400.0, weightedRanker{timeWeight: 1, distanceWeight: 0.05}.Score(&leg))
+	assertResult(t, 300.0, lowestTrafficDelayRanker{}.Score(&leg))
+}
+
+func TestFindBestRouteUsesRanker(t *testing.T) {
+	routes := []Route{
+		{Summary: "fast", Legs: []Leg{createLegForTest(600, 0, 20000)}},
+		{Summary: "short", Legs: []Leg{createLegForTest(900, 0, 10000)}},
+	}
+
+	assertResult(t, "fast", findBestRoute(routes, shortestTimeRanker{}).Summary)
+	assertResult(t, "short", findBestRoute(routes, shortestDistanceRanker{}).Summary)
+	assertResult(t, "fast", findBestRoute(routes, weightedRanker{timeWeight: 1, distanceWeight: 0.01}).Summary)
+	assertResult(t, "short", findBestRoute(routes, weightedRanker{timeWeight: 1, distanceWeight: 0.1}).Summary)
+}
+
+// Cases of findShortestRouteByDriveTime, which the shortest time ranker replaced
+func TestShortestTimeRankerFindsShortestRouteByDriveTime(t *testing.T) {
+	// The shortest route is first, in the middle or last
+	expectedDriveTimes := []int{5610, 2519, 2001, 4896, 5560, 5401}
+	for i, expectedDriveTime := range expectedDriveTimes {
+		var directions GMapsDirections
+		json.Unmarshal(readMockFile(fmt.Sprintf("directions_response_multiple_routes_simplified_%d.json", i+1)),
+			&directions)
+		assertResult(t, expectedDriveTime,
+			findBestRoute(directions.Routes, shortestTimeRanker{}).Legs[0].Duration.Value)
+	}
+
+	// A single route is always the shortest
+	routes := []Route{{Summary: "only", Legs: []Leg{createLegForTest(600, 0, 10000)}}}
+	assertResult(t, "only", findBestRoute(routes, shortestTimeRanker{}).Summary)
+
+	// The first of the routes with the same drive time wins
+	routes = []Route{
+		{Summary: "slow", Legs: []Leg{createLegForTest(900, 0, 10000)}},
+		{Summary: "first", Legs: []Leg{createLegForTest(600, 0, 20000)}},
+		{Summary: "second", Legs: []Leg{createLegForTest(600, 0, 20000)}},
+	}
+	assertResult(t, "first", findBestRoute(routes, shortestTimeRanker{}).Summary)
+}
+
+func TestLowestTrafficDelayRankerBreaksTiesByDriveTime(t *testing.T) {
+	routes := []Route{
+		{Summary: "delayed", Legs: []Leg{createLegForTest(600, 1200, 10000)}},
+		{Summary: "slow", Legs: []Leg{createLegForTest(1500, 1500, 10000)}},
+		{Summary: "fast", Legs: []Leg{createLegForTest(1000, 1000, 10000)}},
+	}
+
+	assertResult(t, "fast", findBestRoute(routes, lowestTrafficDelayRanker{}).Summary)
+}
+
+func TestSortKitchensBreaksTies(t *testing.T) {
+	route := func(duration int, distance int) *Route {
+		return &Route{Legs: []Leg{createLegForTest(duration, 0, distance)}}
+	}
+	kitchenIdToRouteMap := map[string]*Route{
+		"d": route(100, 500),
+		"c": route(100, 400),
+		"b": route(100, 400),
+		"a": route(200, 100),
+	}
+
+	for i := 0; i < 10; i++ {
+		assertResult(t, "b,c,d,a", strings.Join(sortKitchens(kitchenIdToRouteMap, shortestTimeRanker{}), ","))
+	}
+	assertResult(t, "a,b,c,d", strings.Join(sortKitchens(kitchenIdToRouteMap, shortestDistanceRanker{}), ","))
+}
+
+func TestFindDriveTimeToClosestClusterTruckKitchenWithRanking(t *testing.T) {
+	service := createDriveTimeServiceForTest(createClientWithRoutesToEveryKitchen(), "2017-12-04 12:00")
+
+	closestClusterTruckInfo, _ := service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{StartingAddress: "startingAddress"})
+	assertResult(t, "Downtown Columbus", closestClusterTruckInfo.LocationName)
+	assertResult(t, RankingShortestTime, closestClusterTruckInfo.Metadata.Ranking)
+
+	closestClusterTruckInfo, _ = service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{StartingAddress: "startingAddress", Ranking: "shortest_distance"})
+	assertResult(t, "Downtown Indy", closestClusterTruckInfo.LocationName)
+	assertResult(t, 6367, closestClusterTruckInfo.DriveDistance.Value)
+	assertResult(t, RankingShortestDistance, closestClusterTruckInfo.Metadata.Ranking)
+
+	// The shortest route to Bloomington is picked, instead of the fastest one
+	service.config.RankingStrategy = RankingWeighted
+	closestClusterTruckInfo, _ = service.findDriveTimeToClosestClusterTruckKitchen(context.Background(),
+		RequestPayload{StartingAddress: "startingAddress"})
+	assertResult(t, "Bloomington", closestClusterTruckInfo.LocationName)
+	assertResult(t, 21273, closestClusterTruckInfo.DriveDistance.Value)
+}
+
+func TestRequestPayloadWithInvalidRanking(t *testing.T) {
+	payload := RequestPayload{StartingAddress: "startingAddress", Ranking: "fastest"}
+
+	err := payload.validate()
+	assertResult(t, true, err != nil)
+	assertResult(t, true, strings.Contains(err.Error(), "\"fastest\" is not a valid ranking strategy"))
+}
+
+func TestLoadConfigFromEnvWithRankingStrategy(t *testing.T) {
+	os.Setenv("CT_RANKING_STRATEGY", "weighted")
+	os.Setenv("CT_RANKING_DISTANCE_WEIGHT", "0.2")
+	defer os.Unsetenv("CT_RANKING_STRATEGY")
+	defer os.Unsetenv("CT_RANKING_DISTANCE_WEIGHT")
+
+	config, err := LoadConfigFromEnv()
+	assertResult(t, nil, err)
+	assertResult(t, RankingWeighted, config.RankingStrategy)
+	assertResult(t, 0.2, config.RankingDistanceWeight)
+
+	os.Setenv("CT_RANKING_STRATEGY", "fastest")
+	_, err = LoadConfigFromEnv()
+	assertResult(t, true, err != nil)
+}
@@ -0,0 +1,215 @@
+package clustertruck
+
+import (
+	"net/http"
+	"time"
+	"math/rand"
+	"strconv"
+	"strings"
+	"io/ioutil"
+	"bytes"
+	"encoding/json"
+	"log"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Decides which failed upstream requests are retried, and how long to wait in between
+type RetryPolicy struct {
+	// Total number of attempts, including the first one. 1 means requests are never retried
+	MaxAttempts int
+	// Wait before the first retry. Doubles on every retry after that
+	InitialBackoff time.Duration
+	// Longest wait between two attempts, unless the upstream API asks for a longer one with Retry-After
+	MaxBackoff time.Duration
+	// Longest wait the upstream API can ask for with Retry-After. The request is not retried if it asks for more
+	MaxRetryAfter time.Duration
+	// Fraction of each wait that is random, between 0 and 1, so retries from concurrent requests are spread out
+	Jitter float64
+	// HTTP statuses, such as "503", and statuses in the body of GMaps responses, such as "OVER_QUERY_LIMIT",
+	// that are retried. Requests that fail without a response are always retried.
+	RetryableStatuses []string
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:       3,
+		InitialBackoff:    200 * time.Millisecond,
+		MaxBackoff:        2 * time.Second,
+		MaxRetryAfter:     10 * time.Second,
+		Jitter:            0.5,
+		RetryableStatuses: []string{"429", "500", "502", "503", "504", "OVER_QUERY_LIMIT", "UNKNOWN_ERROR"},
+	}
+}
+
+// Retries requests that fail in a way that is likely to be temporary, such as network errors, 5xx responses
+// or a GMaps OVER_QUERY_LIMIT status. Retries never wait past the deadline of the request's context.
+//
+// Only requests without a body are retried, since the body can't be sent twice.
+type RetryingHttpClient struct {
+	httpClient          HttpClient
+	policy              RetryPolicy
+	retryableHTTPStatus map[int]bool
+	retryableBodyStatus map[string]bool
+
+	randomMutex sync.Mutex
+	random      *rand.Rand
+	now         func() time.Time
+}
+
+func NewRetryingHttpClient(httpClient HttpClient, policy RetryPolicy) *RetryingHttpClient {
+	client := &RetryingHttpClient{
+		httpClient:          httpClient,
+		policy:              policy,
+		retryableHTTPStatus: make(map[int]bool),
+		retryableBodyStatus: make(map[string]bool),
+		random:              rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:                 time.Now,
+	}
+	for _, status := range policy.RetryableStatuses {
+		if statusCode, err := strconv.Atoi(status); err == nil {
+			client.retryableHTTPStatus[statusCode] = true
+		} else {
+			client.retryableBodyStatus[status] = true
+		}
+	}
+
+	return client
+}
+
+// Only used to find the status in the body of GMaps responses
+type upstreamBodyStatus struct {
+	Status string `json:"status"`
+}
+
+func (c *RetryingHttpClient) Do(req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		res, err := c.httpClient.Do(req)
+
+		retry, reason := c.shouldRetry(req, res, err)
+		if !retry || attempt >= c.policy.MaxAttempts {
+			return res, err
+		}
+
+		wait := c.backoff(attempt)
+		if res != nil {
+			if retryAfter, ok := parseRetryAfter(res.Header.Get("Retry-After"), c.now()); ok {
+				if retryAfter > c.policy.MaxRetryAfter {
+					log.Printf("Not retrying request to %s, which asked to wait %s after attempt %d failed: %s\n",
+						req.URL.Host, retryAfter, attempt, reason)
+					return res, err
+				}
+				wait = retryAfter
+			}
+		}
+
+		ctx := req.Context()
+		if deadline, ok := ctx.Deadline(); ok && c.now().Add(wait).After(deadline) {
+			return res, err
+		}
+
+		if res != nil {
+			res.Body.Close()
+		}
+		log.Printf("Retrying request to %s in %s after attempt %d failed: %s\n", req.URL.Host, wait, attempt,
+			reason)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Returns whether the request should be retried, and why. The body of the response is read to find its
+// status, and is replaced so it can still be read by the caller.
+func (c *RetryingHttpClient) shouldRetry(req *http.Request, res *http.Response, err error) (bool, string) {
+	if req.Body != nil {
+		return false, ""
+	}
+	if err != nil {
+		return true, err.Error()
+	}
+	if c.retryableHTTPStatus[res.StatusCode] {
+		return true, fmt.Sprintf("HTTP status %d", res.StatusCode)
+	}
+	if len(c.retryableBodyStatus) == 0 || res.Body == nil {
+		return false, ""
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil || !bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		return false, ""
+	}
+
+	var bodyStatus upstreamBodyStatus
+	json.Unmarshal(body, &bodyStatus)
+	if c.retryableBodyStatus[bodyStatus.Status] {
+		return true, fmt.Sprintf("status %s", bodyStatus.Status)
+	}
+
+	return false, ""
+}
+
+// Exponential backoff, with part of it replaced by a random amount
+func (c *RetryingHttpClient) backoff(attempt int) time.Duration {
+	backoff := c.policy.InitialBackoff
+	for i := 1; i < attempt && backoff < c.policy.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > c.policy.MaxBackoff {
+		backoff = c.policy.MaxBackoff
+	}
+
+	c.randomMutex.Lock()
+	random := c.random.Float64()
+	c.randomMutex.Unlock()
+
+	return backoff - time.Duration(float64(backoff)*c.policy.Jitter*random)
+}
+
+// Retry-After is either a number of seconds, or an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if date.Before(now) {
+		return 0, true
+	}
+
+	return date.Sub(now), true
+}
+
+// Parses a comma separated list of retryable statuses, such as "503,OVER_QUERY_LIMIT"
+func parseRetryableStatuses(value string) ([]string, error) {
+	var statuses []string
+	for _, status := range strings.Split(value, ",") {
+		status = strings.TrimSpace(status)
+		if status == "" {
+			continue
+		}
+		if strings.ToUpper(status) != status {
+			return nil, errors.New(fmt.Sprintf("\"%s\" is not a valid status, expected an HTTP status such as "+
+				"503, or a GMaps status such as OVER_QUERY_LIMIT", status))
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
@@ -0,0 +1,146 @@
+package clustertruck
+
+import (
+	"testing"
+	"net/http"
+	"bytes"
+	"errors"
+	"time"
+	"context"
+	"io/ioutil"
+)
+
+func createRetryPolicyForTest() RetryPolicy {
+	policy := DefaultRetryPolicy()
+	policy.InitialBackoff = time.Millisecond
+	policy.MaxBackoff = 5 * time.Millisecond
+
+	return policy
+}
+
+// Responds with the given responses in order, repeating the last one
+func createClientRespondingWith(calls *int, responses ...func() (*http.Response, error)) *MockClient {
+	return &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			*calls++
+			if *calls > len(responses) {
+				return responses[len(responses)-1]()
+			}
+			return responses[*calls-1]()
+		},
+	}
+}
+
+func TestRetryingHttpClientRetriesServerErrors(t *testing.T) {
+	calls := 0
+	client := createClientRespondingWith(&calls,
+		func() (*http.Response, error) {
+			return createHttpResponseForTest(http.StatusServiceUnavailable, bytes.NewBufferString("")), nil
+		},
+		func() (*http.Response, error) { return nil, errors.New("connection reset by peer") },
+		func() (*http.Response, error) {
+			return createHttpResponseForTest(http.StatusOK, bytes.NewBufferString("[]")), nil
+		})
+
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	res, err := NewRetryingHttpClient(client, createRetryPolicyForTest()).Do(req)
+	assertResult(t, nil, err)
+	assertResult(t, http.StatusOK, res.StatusCode)
+	assertResult(t, 3, calls)
+}
+
+func TestRetryingHttpClientRetriesGoogleMapsStatuses(t *testing.T) {
+	calls := 0
+	client := createClientRespondingWith(&calls,
+		func() (*http.Response, error) {
+			return createHttpResponseForTest(http.StatusOK,
+				bytes.NewBufferString(`{"routes": [], "status": "OVER_QUERY_LIMIT"}`)), nil
+		},
+		func() (*http.Response, error) {
+			return createHttpResponseForTest(http.StatusOK,
+				bytes.NewBufferString(`{"routes": [], "status": "ZERO_RESULTS"}`)), nil
+		})
+
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	res, _ := NewRetryingHttpClient(client, createRetryPolicyForTest()).Do(req)
+	assertResult(t, 2, calls)
+
+	// ZERO_RESULTS is not retried, and the body can still be read
+	body, _ := ioutil.ReadAll(res.Body)
+	assertResult(t, `{"routes": [], "status": "ZERO_RESULTS"}`, string(body))
+}
+
+func TestRetryingHttpClientStopsAfterMaxAttempts(t *testing.T) {
+	calls := 0
+	client := createClientRespondingWith(&calls, func() (*http.Response, error) {
+		return createHttpResponseForTest(http.StatusBadGateway, bytes.NewBufferString("")), nil
+	})
+
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	res, _ := NewRetryingHttpClient(client, createRetryPolicyForTest()).Do(req)
+	assertResult(t, http.StatusBadGateway, res.StatusCode)
+	assertResult(t, 3, calls)
+}
+
+func TestRetryingHttpClientDoesNotWaitPastDeadline(t *testing.T) {
+	calls := 0
+	client := createClientRespondingWith(&calls, func() (*http.Response, error) {
+		res := createHttpResponseForTest(http.StatusTooManyRequests, bytes.NewBufferString(""))
+		res.Header = http.Header{"Retry-After": []string{"30"}}
+		return res, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	res, _ := NewRetryingHttpClient(client, createRetryPolicyForTest()).Do(req.WithContext(ctx))
+	assertResult(t, http.StatusTooManyRequests, res.StatusCode)
+	assertResult(t, 1, calls)
+}
+
+func TestRetryingHttpClientGivesUpWhenRetryAfterIsTooLong(t *testing.T) {
+	retryAfter := "30"
+	calls := 0
+	client := createClientRespondingWith(&calls, func() (*http.Response, error) {
+		res := createHttpResponseForTest(http.StatusServiceUnavailable, bytes.NewBufferString(""))
+		res.Header = http.Header{"Retry-After": []string{retryAfter}}
+		return res, nil
+	})
+	policy := createRetryPolicyForTest()
+	policy.MaxRetryAfter = 10 * time.Second
+
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	res, _ := NewRetryingHttpClient(client, policy).Do(req)
+	assertResult(t, http.StatusServiceUnavailable, res.StatusCode)
+	assertResult(t, 1, calls)
+
+	// A wait within the limit is waited for
+	retryAfter = "0"
+	calls = 0
+	NewRetryingHttpClient(client, policy).Do(req)
+	assertResult(t, 3, calls)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2017, 12, 4, 17, 0, 0, 0, time.UTC)
+
+	wait, ok := parseRetryAfter("120", now)
+	assertResult(t, true, ok)
+	assertResult(t, 2*time.Minute, wait)
+
+	wait, ok = parseRetryAfter("Mon, 04 Dec 2017 17:00:30 GMT", now)
+	assertResult(t, true, ok)
+	assertResult(t, 30*time.Second, wait)
+
+	_, ok = parseRetryAfter("soon", now)
+	assertResult(t, false, ok)
+}
+
+func TestParseRetryableStatuses(t *testing.T) {
+	statuses, _ := parseRetryableStatuses("503, OVER_QUERY_LIMIT")
+	assertResult(t, 2, len(statuses))
+	assertResult(t, "OVER_QUERY_LIMIT", statuses[1])
+
+	_, err := parseRetryableStatuses("over_query_limit")
+	assertResult(t, true, err != nil)
+}
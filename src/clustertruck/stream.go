@@ -0,0 +1,162 @@
+package clustertruck
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Names of the Server-Sent Events sent by the stream endpoint
+const (
+	// Sent each time the directions to a kitchen arrive
+	streamEventProgress = "progress"
+	// Sent last, with the same response as the drive time endpoint
+	streamEventResult = "result"
+	// Sent last instead of the result, when the drive time could not be found
+	streamEventError = "error"
+)
+
+// Sent each time the directions to a kitchen arrive, while the closest kitchen is being found
+type DriveTimeProgress struct {
+	// Number of kitchens whose directions arrived so far, out of the kitchens directions were asked for
+	Answered int `json:"answered"`
+	Total    int `json:"total"`
+	// The kitchen whose directions just arrived
+	Kitchen ProgressKitchen `json:"kitchen"`
+	// The closest kitchen among the kitchens that answered so far, ranked the same way as the final result.
+	// Not set until directions to one of them are found
+	Best *RankedKitchen `json:"best,omitempty"`
+}
+
+type ProgressKitchen struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Whether the directions came from the directions cache
+	Cached bool `json:"cached"`
+	// Only set if directions to the kitchen could not be found
+	Error *HTTPError `json:"error,omitempty"`
+}
+
+// Sent in the error event. The status is the one the drive time endpoint would have returned
+type StreamError struct {
+	Status int `json:"status"`
+	*HTTPError
+}
+
+func newDriveTimeProgress(kitchenIdDirectionsPair *KitchenIDDirectionsPair, kitchenIdToRouteMap map[string]*Route,
+	kitchenIdToDirectionsMap map[string]*KitchenIDDirectionsPair, kitchens map[string]Kitchen,
+	departureTime time.Time, ranker Ranker) DriveTimeProgress {
+
+	progress := DriveTimeProgress{
+		Answered: len(kitchenIdToDirectionsMap),
+		Total:    len(kitchens),
+		Kitchen: ProgressKitchen{
+			ID:     kitchenIdDirectionsPair.ID,
+			Name:   kitchens[kitchenIdDirectionsPair.ID].Name,
+			Cached: kitchenIdDirectionsPair.Cached,
+		},
+	}
+	if kitchenIdDirectionsPair.Error != nil {
+		progress.Kitchen.Error = publicError(kitchenIdDirectionsPair.Error)
+	}
+	if bestKitchens := rankKitchens(kitchenIdToRouteMap, kitchens, departureTime, ranker, 1); len(bestKitchens) > 0 {
+		progress.Best = &bestKitchens[0]
+	}
+
+	return progress
+}
+
+// Builds a request from the query parameters of the stream endpoint, which have the same names as the
+// properties of the drive time endpoint. The location is given as "lat,lng".
+func requestPayloadFromQuery(query url.Values) (RequestPayload, error) {
+	requestPayload := RequestPayload{
+		StartingAddress: query.Get("address"),
+		PlaceID:         query.Get("place_id"),
+		Eligibility:     query.Get("eligibility"),
+		DepartureTime:   query.Get("departure_time"),
+		TrafficModel:    query.Get("traffic_model"),
+		Ranking:         query.Get("ranking"),
+	}
+
+	var err error
+	booleans := map[string]*bool{
+		"delivery_area_only": &requestPayload.DeliveryAreaOnly,
+		"route_details":      &requestPayload.RouteDetails,
+		"explain":            &requestPayload.Explain,
+	}
+	for name, value := range booleans {
+		if query.Get(name) != "" {
+			*value, err = strconv.ParseBool(query.Get(name))
+			if err != nil {
+				return requestPayload, errors.New(fmt.Sprintf("%s must be true or false, but was \"%s\"", name,
+					query.Get(name)))
+			}
+		}
+	}
+
+	numbers := map[string]*int{
+		"limit":          &requestPayload.Limit,
+		"max_latency_ms": &requestPayload.MaxLatencyMillis,
+	}
+	for name, value := range numbers {
+		if query.Get(name) != "" {
+			*value, err = strconv.Atoi(query.Get(name))
+			if err != nil {
+				return requestPayload, errors.New(fmt.Sprintf("%s must be a whole number, but was \"%s\"", name,
+					query.Get(name)))
+			}
+		}
+	}
+
+	if query.Get("location") != "" {
+		location, err := parseLocation(query.Get("location"))
+		if err != nil {
+			return requestPayload, err
+		}
+		requestPayload.Location = newRequestLocation(location)
+	}
+
+	return requestPayload, nil
+}
+
+func parseLocation(value string) (Coordinates, error) {
+	var location Coordinates
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return location, errors.New(fmt.Sprintf("location must be \"lat,lng\", but was \"%s\"", value))
+	}
+
+	var err error
+	location.Lat, err = strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err == nil {
+		location.Lng, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	}
+	// ParseFloat also accepts NaN and infinities, which are not coordinates
+	if err != nil || math.IsNaN(location.Lat) || math.IsInf(location.Lat, 0) || math.IsNaN(location.Lng) ||
+		math.IsInf(location.Lng, 0) {
+		return location, errors.New(fmt.Sprintf("location must be \"lat,lng\", but was \"%s\"", value))
+	}
+
+	return location, nil
+}
+
+// Writes a single Server-Sent Event, and sends it to the user right away
+func writeEvent(response http.ResponseWriter, event string, data interface{}) {
+	eventData, err := json.Marshal(data)
+	if err != nil {
+		_, httpError := driveTimeSearchError(err)
+		event = streamEventError
+		eventData, _ = json.Marshal(StreamError{Status: http.StatusInternalServerError, HTTPError: httpError})
+	}
+
+	fmt.Fprintf(response, "event: %s\ndata: %s\n\n", event, eventData)
+	if flusher, ok := response.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
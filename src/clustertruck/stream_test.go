@@ -0,0 +1,185 @@
+package clustertruck
+
+import (
+	"testing"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"errors"
+)
+
+type streamEventForTest struct {
+	event string
+	data  []byte
+}
+
+func readStreamEventsForTest(body string) []streamEventForTest {
+	var events []streamEventForTest
+	for _, block := range strings.Split(strings.TrimSpace(body), "\n\n") {
+		lines := strings.SplitN(block, "\n", 2)
+		events = append(events, streamEventForTest{
+			event: strings.TrimPrefix(lines[0], "event: "),
+			data:  []byte(strings.TrimPrefix(lines[1], "data: ")),
+		})
+	}
+
+	return events
+}
+
+func TestAPIStreamsProgressAndResult(t *testing.T) {
+	config := DefaultConfig()
+	config.KitchenEligibility = EligibilityIncludeAll
+	api := SetupAPI(createClientWithRoutesToEveryKitchen(), config)
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET",
+		"/api/drive-time/stream?address=Martinsville%2C+IN&limit=2&access_key=JVvlYlqTBwhs2yu8", nil)
+
+	api.ServeHTTP(recorder, request)
+
+	assertResult(t, http.StatusOK, recorder.Code)
+	assertResult(t, "text/event-stream", recorder.Header().Get("Content-Type"))
+	events := readStreamEventsForTest(recorder.Body.String())
+	assertResult(t, 7, len(events))
+
+	for i, event := range events[:6] {
+		var progress DriveTimeProgress
+		json.Unmarshal(event.data, &progress)
+		assertResult(t, streamEventProgress, event.event)
+		assertResult(t, i+1, progress.Answered)
+		assertResult(t, 6, progress.Total)
+		assertResult(t, true, progress.Best != nil)
+		if i == 5 {
+			assertResult(t, "Downtown Columbus", progress.Best.LocationName)
+		}
+	}
+
+	var result ClosestClusterTruck
+	json.Unmarshal(events[6].data, &result)
+	assertResult(t, streamEventResult, events[6].event)
+	assertResult(t, "Downtown Columbus", result.LocationName)
+	assertResult(t, 2, len(result.Kitchens))
+}
+
+func TestAPIStreamsError(t *testing.T) {
+	client := createClientWithRoutesToEveryKitchen()
+	doFunc := client.DoFunc
+	client.DoFunc = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "directions") {
+			return createHttpResponseForTest(http.StatusOK,
+				bytes.NewBuffer(readMockFile("directions_response_no_route.json"))), nil
+		}
+		return doFunc(req)
+	}
+	api := SetupAPI(client, DefaultConfig())
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/api/drive-time/stream?address=Martinsville%2C+IN", nil)
+	request.Header.Add("Access-Key", "JVvlYlqTBwhs2yu8")
+
+	api.ServeHTTP(recorder, request)
+
+	events := readStreamEventsForTest(recorder.Body.String())
+	lastEvent := events[len(events)-1]
+	var streamError StreamError
+	json.Unmarshal(lastEvent.data, &streamError)
+	assertResult(t, streamEventError, lastEvent.event)
+	assertResult(t, http.StatusNotFound, streamError.Status)
+	assertResult(t, ErrorCodeNoRoute, streamError.Code)
+}
+
+func TestAPIStreamsProgressWithoutGoogleMapsAPIKey(t *testing.T) {
+	client := createClientWithRoutesToEveryKitchen()
+	doFunc := client.DoFunc
+	client.DoFunc = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.String(), "Columbus") {
+			// The error of an HTTP client has the URL of the request, which has the API key
+			return nil, &url.Error{Op: "Get", URL: req.URL.String(), Err: errors.New("connection refused")}
+		}
+		return doFunc(req)
+	}
+	config := DefaultConfig()
+	config.KitchenEligibility = EligibilityIncludeAll
+	config.GoogleMapsAPIKey = "secret-gmaps-key"
+	api := SetupAPI(client, config)
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/api/drive-time/stream?address=Martinsville%2C+IN", nil)
+	request.Header.Add("Access-Key", "JVvlYlqTBwhs2yu8")
+
+	api.ServeHTTP(recorder, request)
+
+	var failedKitchen *ProgressKitchen
+	for _, event := range readStreamEventsForTest(recorder.Body.String()) {
+		var progress DriveTimeProgress
+		json.Unmarshal(event.data, &progress)
+		if event.event == streamEventProgress && progress.Kitchen.Error != nil {
+			failedKitchen = &progress.Kitchen
+		}
+	}
+	assertResult(t, true, failedKitchen != nil)
+	assertResult(t, ErrorCodeUpstreamBadResponse, failedKitchen.Error.Code)
+	assertResult(t, "There was an error performing a request to the GMaps Directions API: connection refused",
+		failedKitchen.Error.Message)
+	assertResult(t, false, strings.Contains(recorder.Body.String(), "secret-gmaps-key"))
+}
+
+func TestAPIStreamWithInvalidQueryParameters(t *testing.T) {
+	api := SetupAPI(createClientWithRoutesToEveryKitchen(), DefaultConfig())
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/api/drive-time/stream?address=a&limit=two", nil)
+	request.Header.Add("Access-Key", "JVvlYlqTBwhs2yu8")
+	api.ServeHTTP(recorder, request)
+	assertResult(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest("GET", "/api/drive-time/stream?address=a&access_key=wrong", nil)
+	api.ServeHTTP(recorder, request)
+	assertResult(t, http.StatusUnauthorized, recorder.Code)
+}
+
+func TestAccessKeyFromQueryIsRemovedFromURL(t *testing.T) {
+	var forwarded *http.Request
+	handler := accessKeyFromQueryMiddleware(http.HandlerFunc(func(response http.ResponseWriter,
+		request *http.Request) {
+		forwarded = request
+	}))
+
+	request := httptest.NewRequest("GET", "/api/drive-time/stream?address=a&access_key=JVvlYlqTBwhs2yu8", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	assertResult(t, "JVvlYlqTBwhs2yu8", forwarded.Header.Get("Access-Key"))
+	assertResult(t, "address=a", forwarded.URL.RawQuery)
+	assertResult(t, "/api/drive-time/stream?address=a", forwarded.RequestURI)
+}
+
+func TestRequestPayloadFromQuery(t *testing.T) {
+	query, _ := url.ParseQuery("address=123+Main+St&explain=true&limit=3&ranking=weighted&departure_time=now")
+
+	requestPayload, err := requestPayloadFromQuery(query)
+	assertResult(t, nil, err)
+	assertResult(t, RequestPayload{
+		StartingAddress: "123 Main St",
+		DepartureTime:   "now",
+		Limit:           3,
+		Ranking:         "weighted",
+		Explain:         true,
+	}, requestPayload)
+
+	query, _ = url.ParseQuery("location=39.43,-86.43")
+	requestPayload, err = requestPayloadFromQuery(query)
+	assertResult(t, nil, err)
+	assertResult(t, Coordinates{Lat: 39.43, Lng: -86.43}, *requestPayload.coordinates())
+
+	query, _ = url.ParseQuery("location=39.43")
+	_, err = requestPayloadFromQuery(query)
+	assertResult(t, "location must be \"lat,lng\", but was \"39.43\"", err.Error())
+
+	query, _ = url.ParseQuery("location=NaN,-86.43")
+	_, err = requestPayloadFromQuery(query)
+	assertResult(t, "location must be \"lat,lng\", but was \"NaN,-86.43\"", err.Error())
+
+	query, _ = url.ParseQuery("address=123+Main+St&route_details=yes")
+	_, err = requestPayloadFromQuery(query)
+	assertResult(t, "route_details must be true or false, but was \"yes\"", err.Error())
+}
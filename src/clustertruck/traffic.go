@@ -0,0 +1,106 @@
+package clustertruck
+
+import (
+	"time"
+	"strconv"
+	"errors"
+	"fmt"
+)
+
+// Departure time that means the user leaves as soon as they make the request
+const departureTimeNow = "now"
+
+// Traffic models supported by the GMaps Directions API
+const (
+	TrafficModelBestGuess   = "best_guess"
+	TrafficModelPessimistic = "pessimistic"
+	TrafficModelOptimistic  = "optimistic"
+)
+
+// Options that affect how long a drive takes. Without a departure time, traffic is not taken into account.
+type TravelOptions struct {
+	// Zero if no departure time was requested
+	DepartureTime time.Time
+	// Whether the user leaves as soon as they make the request
+	DepartNow bool
+	// One of the traffic models above. Only used with a departure time
+	TrafficModel string
+}
+
+// Whether drive times should take traffic into account
+func (o TravelOptions) usesTraffic() bool {
+	return o.DepartNow || !o.DepartureTime.IsZero()
+}
+
+// Checks the departure time ("now" or an RFC 3339 timestamp that isn't in the past) and traffic model
+func validateTravelOptions(departureTime string, trafficModel string, now time.Time) error {
+	if departureTime != "" && departureTime != departureTimeNow {
+		parsedDepartureTime, err := time.Parse(time.RFC3339, departureTime)
+		if err != nil {
+			return errors.New(fmt.Sprintf("departure_time must be \"%s\" or an RFC 3339 timestamp such as "+
+				"\"2017-12-04T17:30:00-05:00\", but was \"%s\"", departureTimeNow, departureTime))
+		}
+		if parsedDepartureTime.Before(now.Add(-time.Minute)) {
+			return errors.New("departure_time must not be in the past")
+		}
+	}
+
+	if trafficModel != "" {
+		if departureTime == "" {
+			return errors.New("traffic_model can only be used with a departure_time")
+		}
+		if trafficModel != TrafficModelBestGuess && trafficModel != TrafficModelPessimistic &&
+			trafficModel != TrafficModelOptimistic {
+			return errors.New(fmt.Sprintf("traffic_model must be %s, %s or %s, but was \"%s\"",
+				TrafficModelBestGuess, TrafficModelPessimistic, TrafficModelOptimistic, trafficModel))
+		}
+	}
+
+	return nil
+}
+
+// Must only be called once the request has been validated
+func (p *RequestPayload) travelOptions() TravelOptions {
+	options := TravelOptions{}
+	if p.DepartureTime == departureTimeNow {
+		options.DepartNow = true
+	} else if p.DepartureTime != "" {
+		options.DepartureTime, _ = time.Parse(time.RFC3339, p.DepartureTime)
+	}
+
+	if options.usesTraffic() {
+		options.TrafficModel = p.TrafficModel
+		if options.TrafficModel == "" {
+			options.TrafficModel = TrafficModelBestGuess
+		}
+	}
+
+	return options
+}
+
+// Returns when the user leaves. Users without a departure time leave as soon as they make the request.
+func (o TravelOptions) departureTime(now time.Time) time.Time {
+	if o.DepartureTime.IsZero() {
+		return now
+	}
+
+	return o.DepartureTime
+}
+
+// GMaps APIs expect "now" or a unix timestamp
+func (o TravelOptions) googleMapsDepartureTime() string {
+	if o.DepartNow {
+		return departureTimeNow
+	}
+
+	return strconv.FormatInt(o.DepartureTime.Unix(), 10)
+}
+
+// Returns the duration in traffic if there is one, and the duration in normal conditions otherwise
+func (l *Leg) DriveDuration() MeasurementValues {
+	if l.DurationInTraffic != nil {
+		return *l.DurationInTraffic
+	}
+
+	return l.Duration
+}
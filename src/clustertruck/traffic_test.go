@@ -0,0 +1,102 @@
+package clustertruck
+
+import (
+	"testing"
+	"net/http"
+	"bytes"
+	"strings"
+	"time"
+	"context"
+)
+
+func TestValidateTravelOptions(t *testing.T) {
+	now := time.Date(2017, 12, 4, 17, 0, 0, 0, time.UTC)
+
+	assertResult(t, nil, validateTravelOptions("", "", now))
+	assertResult(t, nil, validateTravelOptions("now", "pessimistic", now))
+	assertResult(t, nil, validateTravelOptions("2017-12-04T17:30:00-05:00", "", now))
+
+	err := validateTravelOptions("tomorrow", "", now)
+	assertResult(t, "departure_time must be \"now\" or an RFC 3339 timestamp such as "+
+		"\"2017-12-04T17:30:00-05:00\", but was \"tomorrow\"", err.Error())
+
+	err = validateTravelOptions("2017-12-04T10:00:00-05:00", "", now)
+	assertResult(t, "departure_time must not be in the past", err.Error())
+
+	err = validateTravelOptions("", "optimistic", now)
+	assertResult(t, "traffic_model can only be used with a departure_time", err.Error())
+
+	err = validateTravelOptions("now", "fastest", now)
+	assertResult(t, "traffic_model must be best_guess, pessimistic or optimistic, but was \"fastest\"",
+		err.Error())
+}
+
+func TestTravelOptionsDefaultToBestGuessTrafficModel(t *testing.T) {
+	options := (&RequestPayload{DepartureTime: "now"}).travelOptions()
+	assertResult(t, true, options.DepartNow)
+	assertResult(t, TrafficModelBestGuess, options.TrafficModel)
+
+	options = (&RequestPayload{}).travelOptions()
+	assertResult(t, false, options.usesTraffic())
+	assertResult(t, "", options.TrafficModel)
+}
+
+func TestGetDirectionsSendsTravelOptionsToGoogle(t *testing.T) {
+	mockGmapsResponseData := readMockFile("directions_response_with_traffic.json")
+	var query map[string][]string
+	client := &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			query = req.URL.Query()
+			return createHttpResponseForTest(http.StatusOK, bytes.NewBuffer(mockGmapsResponseData)), nil
+		},
+	}
+
+	options := (&RequestPayload{DepartureTime: "2017-12-04T17:30:00-05:00", TrafficModel: "pessimistic"}).
+		travelOptions()
+	routes, _ := NewGoogleDirectionsProvider(client, DefaultConfig()).
+		GetDirections(context.Background(), Waypoint{Address: "origin"}, Waypoint{Address: "destination"}, options)
+
+	assertResult(t, "1512426600", query["departure_time"][0])
+	assertResult(t, "pessimistic", query["traffic_model"][0])
+	assertResult(t, 3300, routes[0].Legs[0].DurationInTraffic.Value)
+}
+
+func TestFindBestRouteUsesDurationInTraffic(t *testing.T) {
+	routes := []Route{
+		{Legs: []Leg{{
+			Duration:          MeasurementValues{Value: 2001},
+			DurationInTraffic: &MeasurementValues{Value: 3300},
+		}}},
+		{Legs: []Leg{{
+			Duration:          MeasurementValues{Value: 2300},
+			DurationInTraffic: &MeasurementValues{Value: 2450},
+		}}},
+	}
+
+	assertResult(t, 2300, findBestRoute(routes, shortestTimeRanker{}).Legs[0].Duration.Value)
+}
+
+func TestFindDriveTimeToClosestClusterTruckKitchenInTraffic(t *testing.T) {
+	clientWithoutTraffic := createClientWithRoutesToEveryKitchen()
+	client := &MockClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			if strings.Contains(req.URL.String(), "Columbus") {
+				mockGmapsResponseData := readMockFile("directions_response_with_traffic.json")
+				return createHttpResponseForTest(http.StatusOK, bytes.NewBuffer(mockGmapsResponseData)), nil
+			}
+			return clientWithoutTraffic.Do(req)
+		},
+	}
+
+	// The shortest route to Columbus in normal conditions is slowed down by traffic, so the other route is used
+	closestClusterTruckInfo, _ := createDriveTimeServiceForTest(client, "2017-12-04 12:00").
+		findDriveTimeToClosestClusterTruckKitchen(context.Background(), RequestPayload{
+			StartingAddress: "startingAddress",
+			DepartureTime:   "2017-12-04T17:30:00-05:00",
+		})
+	assertResult(t, "Downtown Columbus", closestClusterTruckInfo.LocationName)
+	assertResult(t, 2300, closestClusterTruckInfo.DriveTime.Value)
+	assertResult(t, 2450, closestClusterTruckInfo.DriveTimeInTraffic.Value)
+	assertResult(t, "41 mins", closestClusterTruckInfo.DriveTimeInTraffic.Text)
+	assertResult(t, "2017-12-04T18:10:50-05:00", closestClusterTruckInfo.EstimatedArrivalTime.Format(time.RFC3339))
+}
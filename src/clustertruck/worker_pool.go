@@ -0,0 +1,229 @@
+package clustertruck
+
+import (
+	"sync"
+	"time"
+	"fmt"
+	"math"
+)
+
+// A process-wide pool of workers that make calls to the directions provider.
+//
+// The calls of each request are queued together, and idle workers take calls from the queued requests in turn,
+// so a request with many kitchens doesn't hold up the requests that come after it. Requests are rejected as a
+// whole when the pool can't queue all of their calls, instead of being partly queued. A request with more calls
+// than the queue can hold is only queued once the queue is empty, so it still runs when the pool is idle.
+type DirectionsWorkerPool struct {
+	workers     int
+	maxQueued   int
+	mutex       sync.Mutex
+	taskQueued  *sync.Cond
+	queues      []*poolQueue
+	nextQueue   int
+	queued      int
+	busyWorkers int
+	closed      bool
+	// Done once every worker has stopped
+	stopped sync.WaitGroup
+	now     func() time.Time
+
+	// Metrics
+	tasksCompleted  int64
+	tasksRejected   int64
+	totalWait       time.Duration
+	maxWait         time.Duration
+	totalRunTime    time.Duration
+	requestsRefused int64
+}
+
+// The queued calls of a single request
+type poolQueue struct {
+	tasks []*poolTask
+}
+
+type poolTask struct {
+	run        func()
+	enqueuedAt time.Time
+}
+
+// Reports the state of the worker pool
+type WorkerPoolMetrics struct {
+	Workers        int   `json:"workers"`
+	BusyWorkers    int   `json:"busy_workers"`
+	QueueDepth     int   `json:"queue_depth"`
+	QueueCapacity  int   `json:"queue_capacity"`
+	QueuedRequests int   `json:"queued_requests"`
+	TasksCompleted int64 `json:"tasks_completed"`
+	TasksRejected  int64 `json:"tasks_rejected"`
+	// Number of requests that were rejected because the queue was full
+	RequestsRejected int64 `json:"requests_rejected"`
+	// Time calls spend in the queue before a worker picks them up
+	AverageWaitMillis float64 `json:"average_wait_ms"`
+	MaxWaitMillis     float64 `json:"max_wait_ms"`
+}
+
+// Starts the given number of workers. At most maxQueued calls can wait for a worker at any time.
+func NewDirectionsWorkerPool(workers int, maxQueued int) *DirectionsWorkerPool {
+	pool := &DirectionsWorkerPool{
+		workers:   workers,
+		maxQueued: maxQueued,
+		now:       time.Now,
+	}
+	pool.taskQueued = sync.NewCond(&pool.mutex)
+	pool.stopped.Add(workers)
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+
+	return pool
+}
+
+// Stops taking new calls, and waits for the workers to make the calls that are already queued before they stop
+func (p *DirectionsWorkerPool) Close() {
+	p.mutex.Lock()
+	p.closed = true
+	p.taskQueued.Broadcast()
+	p.mutex.Unlock()
+
+	p.stopped.Wait()
+}
+
+// Queues the calls of a single request. Returns an error without queuing anything if the queue doesn't have
+// room for all of them, or if the pool is closed.
+func (p *DirectionsWorkerPool) submit(tasks []func()) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		p.tasksRejected += int64(len(tasks))
+		p.requestsRefused++
+		return newAPIError(ErrorCodeServerBusy, "the server is shutting down")
+	}
+
+	// A request that doesn't fit in the whole queue only needs the queue to be empty
+	needed := len(tasks)
+	if needed > p.maxQueued {
+		needed = p.maxQueued
+	}
+	if p.queued+needed > p.maxQueued {
+		p.tasksRejected += int64(len(tasks))
+		p.requestsRefused++
+		return &APIError{
+			Code: ErrorCodeServerBusy,
+			Message: fmt.Sprintf("the server is too busy to look for directions to %d kitchens, %d calls are "+
+				"already queued", len(tasks), p.queued),
+			RetryAfter: p.estimateWaitLocked(),
+		}
+	}
+
+	queue := &poolQueue{tasks: make([]*poolTask, len(tasks))}
+	enqueuedAt := p.now()
+	for i, task := range tasks {
+		queue.tasks[i] = &poolTask{run: task, enqueuedAt: enqueuedAt}
+	}
+	p.queues = append(p.queues, queue)
+	p.queued += len(tasks)
+	p.taskQueued.Broadcast()
+
+	return nil
+}
+
+// Makes queued calls until the pool is closed and the queue is empty
+func (p *DirectionsWorkerPool) work() {
+	defer p.stopped.Done()
+
+	for {
+		p.mutex.Lock()
+		for p.queued == 0 && !p.closed {
+			p.taskQueued.Wait()
+		}
+		if p.queued == 0 {
+			p.mutex.Unlock()
+			return
+		}
+		task := p.nextTaskLocked()
+		wait := p.now().Sub(task.enqueuedAt)
+		p.totalWait += wait
+		if wait > p.maxWait {
+			p.maxWait = wait
+		}
+		p.busyWorkers++
+		p.mutex.Unlock()
+
+		startedAt := p.now()
+		task.run()
+
+		p.mutex.Lock()
+		p.busyWorkers--
+		p.tasksCompleted++
+		p.totalRunTime += p.now().Sub(startedAt)
+		p.mutex.Unlock()
+	}
+}
+
+// Takes the first task of the next queue in turn. Must be called while holding the mutex, with tasks queued.
+func (p *DirectionsWorkerPool) nextTaskLocked() *poolTask {
+	if p.nextQueue >= len(p.queues) {
+		p.nextQueue = 0
+	}
+
+	queue := p.queues[p.nextQueue]
+	task := queue.tasks[0]
+	queue.tasks = queue.tasks[1:]
+	p.queued--
+
+	if len(queue.tasks) == 0 {
+		p.queues = append(p.queues[:p.nextQueue], p.queues[p.nextQueue+1:]...)
+	} else {
+		p.nextQueue++
+	}
+
+	return task
+}
+
+// Estimates how long it takes for the queue to be emptied, based on how long calls have taken so far.
+// Used to tell rejected users when to try again. Must be called while holding the mutex.
+func (p *DirectionsWorkerPool) estimateWaitLocked() time.Duration {
+	averageRunTime := time.Second
+	if p.tasksCompleted > 0 {
+		averageRunTime = p.totalRunTime / time.Duration(p.tasksCompleted)
+	}
+
+	wait := time.Duration(math.Ceil(float64(p.queued)/float64(p.workers))) * averageRunTime
+	if wait < time.Second {
+		return time.Second
+	}
+
+	return wait
+}
+
+func (p *DirectionsWorkerPool) Metrics() WorkerPoolMetrics {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	metrics := WorkerPoolMetrics{
+		Workers:          p.workers,
+		BusyWorkers:      p.busyWorkers,
+		QueueDepth:       p.queued,
+		QueueCapacity:    p.maxQueued,
+		QueuedRequests:   len(p.queues),
+		TasksCompleted:   p.tasksCompleted,
+		TasksRejected:    p.tasksRejected,
+		RequestsRejected: p.requestsRefused,
+		MaxWaitMillis:    durationInMillis(p.maxWait),
+	}
+	startedTasks := p.tasksCompleted + int64(p.busyWorkers)
+	if startedTasks > 0 {
+		metrics.AverageWaitMillis = durationInMillis(p.totalWait / time.Duration(startedTasks))
+	}
+
+	return metrics
+}
+
+func durationInMillis(duration time.Duration) float64 {
+	return float64(duration) / float64(time.Millisecond)
+}
@@ -0,0 +1,193 @@
+package clustertruck
+
+import (
+	"testing"
+	"sync"
+	"net/http"
+	"net/http/httptest"
+	"bytes"
+	"io/ioutil"
+	"encoding/json"
+	"strings"
+)
+
+func TestDirectionsWorkerPoolTakesTurnsBetweenRequests(t *testing.T) {
+	pool := NewDirectionsWorkerPool(1, 10)
+
+	// Keep the only worker busy until both requests are queued
+	started := make(chan struct{})
+	release := make(chan struct{})
+	pool.submit([]func(){func() {
+		close(started)
+		<-release
+	}})
+	<-started
+
+	var mutex sync.Mutex
+	var order []string
+	var waitGroup sync.WaitGroup
+	createTasks := func(name string, count int) []func() {
+		tasks := make([]func(), count)
+		for i := range tasks {
+			tasks[i] = func() {
+				mutex.Lock()
+				order = append(order, name)
+				mutex.Unlock()
+				waitGroup.Done()
+			}
+		}
+		return tasks
+	}
+	waitGroup.Add(5)
+	pool.submit(createTasks("a", 3))
+	pool.submit(createTasks("b", 2))
+	assertResult(t, 5, pool.Metrics().QueueDepth)
+	assertResult(t, 2, pool.Metrics().QueuedRequests)
+
+	close(release)
+	waitGroup.Wait()
+
+	assertResult(t, "a,b,a,b,a", strings.Join(order, ","))
+}
+
+func TestDirectionsWorkerPoolRejectsRequestsThatDoNotFit(t *testing.T) {
+	pool := NewDirectionsWorkerPool(1, 2)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	pool.submit([]func(){func() {
+		close(started)
+		<-release
+	}})
+	<-started
+	pool.submit([]func(){func() {}})
+
+	err := pool.submit([]func(){func() {}, func() {}})
+	apiError := err.(*APIError)
+	assertResult(t, ErrorCodeServerBusy, apiError.Code)
+	assertResult(t, http.StatusServiceUnavailable, apiError.StatusCode())
+	assertResult(t, true, apiError.RetryAfter > 0)
+
+	metrics := pool.Metrics()
+	assertResult(t, 1, metrics.QueueDepth)
+	assertResult(t, int64(2), metrics.TasksRejected)
+	assertResult(t, int64(1), metrics.RequestsRejected)
+}
+
+func TestAPIRejectsRequestsWhenDirectionsQueueIsFull(t *testing.T) {
+	// The only worker is kept busy by the first request, whose other calls fill the queue
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var startOnce sync.Once
+	client := createClientWithRoutesToEveryKitchen()
+	doFunc := client.DoFunc
+	client.DoFunc = func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "directions") {
+			startOnce.Do(func() { close(started) })
+			<-release
+		}
+		return doFunc(req)
+	}
+	config := DefaultConfig()
+	config.KitchenEligibility = EligibilityIncludeAll
+	config.DirectionsWorkers = 1
+	config.DirectionsQueueSize = 5
+	api := SetupAPI(client, config)
+
+	firstRequestDone := make(chan struct{})
+	go func() {
+		request := httptest.NewRequest("POST", "/api/drive-time",
+			noopCloser{bytes.NewBufferString(`{"address": "Martinsville, IN"}`)})
+		request.Header.Add("Access-Key", "JVvlYlqTBwhs2yu8")
+		api.ServeHTTP(httptest.NewRecorder(), request)
+		close(firstRequestDone)
+	}()
+	<-started
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/api/drive-time",
+		noopCloser{bytes.NewBufferString(`{"address": "Franklin, IN"}`)})
+	request.Header.Add("Access-Key", "JVvlYlqTBwhs2yu8")
+
+	api.ServeHTTP(recorder, request)
+	close(release)
+	<-firstRequestDone
+
+	assertResult(t, http.StatusServiceUnavailable, recorder.Code)
+	// 5 queued calls for a single worker, at the default estimate of a second each
+	assertResult(t, "5", recorder.Header().Get("Retry-After"))
+
+	result, _ := ioutil.ReadAll(recorder.Result().Body)
+	var response HTTPError
+	json.Unmarshal(result, &response)
+	assertResult(t, ErrorCodeServerBusy, response.Code)
+}
+
+func TestAPIReturnsMetrics(t *testing.T) {
+	api := SetupAPI(createClientWithRoutesToEveryKitchen(), DefaultConfig())
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/api/metrics", nil)
+	request.Header.Add("Access-Key", "JVvlYlqTBwhs2yu8")
+
+	api.ServeHTTP(recorder, request)
+
+	assertResult(t, http.StatusOK, recorder.Code)
+	result, _ := ioutil.ReadAll(recorder.Result().Body)
+	var metrics ServiceMetrics
+	json.Unmarshal(result, &metrics)
+	assertResult(t, 20, metrics.DirectionsPool.Workers)
+	assertResult(t, 500, metrics.DirectionsPool.QueueCapacity)
+	assertResult(t, 0, metrics.DirectionsPool.QueueDepth)
+}
+
+func TestDirectionsWorkerPoolQueuesRequestsLargerThanQueueWhenIdle(t *testing.T) {
+	pool := NewDirectionsWorkerPool(1, 2)
+	defer pool.Close()
+
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(3)
+	tasks := []func(){waitGroup.Done, waitGroup.Done, waitGroup.Done}
+	assertResult(t, nil, pool.submit(tasks))
+	waitGroup.Wait()
+
+	// The same request is rejected while other calls are queued
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	pool.submit([]func(){func() {
+		close(started)
+		<-release
+	}})
+	<-started
+	pool.submit([]func(){func() {}})
+	err := pool.submit(tasks)
+	assertResult(t, ErrorCodeServerBusy, errorCode(err))
+}
+
+func TestDirectionsWorkerPoolMakesQueuedCallsBeforeClosing(t *testing.T) {
+	pool := NewDirectionsWorkerPool(1, 10)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	pool.submit([]func(){func() {
+		close(started)
+		<-release
+	}})
+	<-started
+	var queuedCallsMade int
+	pool.submit([]func(){func() { queuedCallsMade++ }, func() { queuedCallsMade++ }})
+
+	closed := make(chan struct{})
+	go func() {
+		pool.Close()
+		close(closed)
+	}()
+	close(release)
+	<-closed
+
+	assertResult(t, 2, queuedCallsMade)
+	assertResult(t, 0, pool.Metrics().BusyWorkers)
+	err := pool.submit([]func(){func() {}})
+	assertResult(t, ErrorCodeServerBusy, errorCode(err))
+}
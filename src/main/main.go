@@ -13,11 +13,17 @@ const (
 )
 
 func main() {
-	httpClient := http.Client{}
-	httpMux := clustertruck.SetupAPI(&httpClient)
+	config, err := clustertruck.LoadConfigFromEnv()
+	if err != nil {
+		log.Fatal("Invalid configuration: " + err.Error())
+	}
+
+	httpClient := clustertruck.NewRetryingHttpClient(&http.Client{}, config.Retry)
+	api := clustertruck.SetupAPI(httpClient, config)
+	api.Start()
 
 	log.Printf("Server running on address and port %s:%d\n", address, port)
-	err := http.ListenAndServe(fmt.Sprintf("%s:%d", address, port), httpMux)
+	err = http.ListenAndServe(fmt.Sprintf("%s:%d", address, port), api)
 	if err != nil {
 		log.Fatal("Server shutdown with error: " + err.Error())
 	}